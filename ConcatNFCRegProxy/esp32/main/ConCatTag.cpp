@@ -3,6 +3,7 @@
 #include "ConCatTag.h"
 #include "mbedtls/base64.h"
 #include <esp_log.h>
+#include "esp_rom_crc.h"
 #include "mbedtls/base64.h"
 
 #define TAG "ConCatTag"
@@ -125,6 +126,49 @@ CardDefinition TagArray::toStruct(){
 }
 
 
+// Builds the text the card signature covers, keys sorted and without the
+// signature. Only the tags this firmware knows (0x01 to 0x05) are included,
+// and nothing checks it against testvectors/signing-payload.json yet.
+char *TagArray::toSigningPayload(){
+    char szBuffer[256];
+    uint32_t szBufferPos = 0;
+
+    szBufferPos = sprintf(szBuffer, "{");
+
+    Tag *attendee = getTag(ATTENDEE_CONVENTION_ID);
+    if (attendee != nullptr) {
+        szBufferPos += sprintf(szBuffer + szBufferPos, R"("conventionId":%lu,)", attendee->getTagValueDualUInt().second);
+    }
+
+    Tag *expiration = getTag(EXPIRATION);
+    if (expiration != nullptr) {
+        szBufferPos += sprintf(szBuffer + szBufferPos, R"("expiration":%llu,)", expiration->getTagValueULong());
+    }
+
+    Tag *issuance = getTag(ISSUANCE);
+    if (issuance != nullptr) {
+        szBufferPos += sprintf(szBuffer + szBufferPos, R"("issuanceCount":%llu,)", issuance->getTagValueULong());
+    }
+
+    Tag *timestamp = getTag(TIMESTAMP);
+    if (timestamp != nullptr) {
+        szBufferPos += sprintf(szBuffer + szBufferPos, R"("timestamp":"%llu",)", timestamp->getTagValueULong());
+    }
+
+    if (attendee != nullptr) {
+        szBufferPos += sprintf(szBuffer + szBufferPos, R"("userId":%lu,)", attendee->getTagValueDualUInt().first);
+    }
+
+    if (szBufferPos > 1) {
+        szBuffer[szBufferPos - 1] = '}';
+    } else {
+        szBufferPos += sprintf(szBuffer + szBufferPos, "}");
+    }
+
+    szBuffer[szBufferPos] = '\0';
+    return strdup(szBuffer);
+}
+
 char *CardDefinition::toJSON(){
     char szBuffer[1024];
     uint32_t szBufferPos = 0;
@@ -376,7 +420,7 @@ uint8_status ConCatTag::readByte() {
     return {byte, 0}; // Return the byte and the position of the next byte;
 }
 
-ByteArray ConCatTag::readBytes(uint8_t length) {
+ByteArray ConCatTag::readBytes(uint16_t length) {
     ByteArray bytes(length);
     for (int i = 0; i < length; i++) {
         auto result = readByte();
@@ -389,30 +433,93 @@ ByteArray ConCatTag::readBytes(uint8_t length) {
 }
 
 TagArrayStatus ConCatTag::readTags() {
-    auto tags = TagArray();
     bytePosition = 0;
-    while (true) {
+    auto first = readByte();
+    if (first.status != 0) {
+        return {{}, READ_FAILED};
+    }
+    if (first.data == 0) {
+        return {TagArray(), READ_OK};
+    }
+    if (first.data != HEADER_MAGIC) {
+        // Written before the header, the tags run until the end marker
+        bytePosition = 0;
+        return readTLV(MAX_PAYLOAD);
+    }
+
+    auto header = readBytes(HEADER_SIZE - 1);
+    if (header.data == nullptr) {
+        return {{}, READ_FAILED};
+    }
+    if (header.data[0] != HEADER_MAGIC) {
+        return {{}, READ_CORRUPT};
+    }
+    uint8_t version = header.data[1];
+    uint16_t length = header.data[2] << 8 | header.data[3];
+    uint32_t crc = header.data[4] << 24 | header.data[5] << 16 | header.data[6] << 8 | header.data[7];
+    ESP_LOGD(TAG, "Header version %d, payload %d bytes", version, length);
+    if (version != CARD_FORMAT_VERSION) {
+        // COSE cards and newer formats are left to the proxy
+        return {{}, READ_UNSUPPORTED_FORMAT};
+    }
+    if (length > MAX_PAYLOAD) {
+        return {{}, READ_CORRUPT};
+    }
+
+    auto payload = readBytes(length);
+    if (payload.data == nullptr) {
+        return {{}, READ_FAILED};
+    }
+    if (esp_rom_crc32_le(0, payload.data, payload.length) != crc) {
+        ESP_LOGE(TAG, "Payload CRC does not match the header");
+        return {{}, READ_CORRUPT};
+    }
+
+    // The pages are cached, parsing the payload again does not read the card
+    bytePosition = HEADER_SIZE;
+    return readTLV(HEADER_SIZE + length);
+}
+
+// Reads tags as id, length, value from bytePosition until the end marker or
+// the end position
+TagArrayStatus ConCatTag::readTLV(uint16_t end) {
+    auto tags = TagArray();
+    while (bytePosition < end) {
         auto result = readByte();
         if (result.status != 0) {
-            return {{}, 1};
+            return {{}, READ_FAILED};
         }
         uint8_t tag = result.data;
         if (tag == 0) {
             break;
         }
         ESP_LOGD(TAG, "Tag: %d", tag);
-        auto length = readByte();
-        if (length.status != 0) {
-            return {{}, 1};
+        auto lengthByte = readByte();
+        if (lengthByte.status != 0) {
+            return {{}, READ_FAILED};
+        }
+        uint16_t length = lengthByte.data;
+        if (length == EXTENDED_LENGTH) {
+            auto extended = readBytes(2);
+            if (extended.data == nullptr) {
+                return {{}, READ_FAILED};
+            }
+            length = extended.data[0] << 8 | extended.data[1];
+        }
+        ESP_LOGD(TAG, "Length: %d", length);
+        if (length == 0 || bytePosition + length > end) {
+            return {{}, READ_CORRUPT};
+        }
+        auto data = readBytes(length);
+        if (data.data == nullptr) {
+            return {{}, READ_FAILED};
         }
-        ESP_LOGD(TAG, "Length: %d", length.data);
-        auto data = readBytes(length.data);
         ESP_LOGD(TAG, "Data: ");
         ESP_LOG_BUFFER_HEX_LEVEL(TAG, data.data, data.length, ESP_LOG_DEBUG);
         tags.addTag(Tag(tag, data));
     }
 
-    return {tags, 0};
+    return {tags, READ_OK};
 }
 
 bool ConCatTag::format(){
@@ -42,6 +42,24 @@ struct DoubleUint {
     uint32_t second;
 };
 
+// Cards start with a header: two HEADER_MAGIC bytes, version, big endian
+// payload length and CRC32 of the payload. Cards written before it start
+// directly with a tag id.
+#define HEADER_MAGIC 'C'
+#define HEADER_SIZE 9
+#define CARD_FORMAT_VERSION 0x01
+// MAX_PAYLOAD is the user memory of an NTAG216, the largest supported card
+#define MAX_PAYLOAD 888
+// EXTENDED_LENGTH is followed by the tag length as a big endian uint16
+#define EXTENDED_LENGTH 0xFF
+
+enum ReadStatus {
+    READ_OK = 0,
+    READ_FAILED,
+    READ_CORRUPT,
+    READ_UNSUPPORTED_FORMAT,
+};
+
 enum TagId {
     ATTENDEE_CONVENTION_ID = 0x01,
     SIGNATURE,
@@ -106,6 +124,7 @@ public:
     uint64_t *getExpiration();
     
     CardDefinition toStruct();
+    char *toSigningPayload();
     std::vector<Tag> getTags();
 
 private:
@@ -125,7 +144,7 @@ public:
     bool checkIfLocked();
     ByteArray readPage(uint8_t pageAddress);
     uint8_status readByte();
-    ByteArray readBytes(uint8_t length);
+    ByteArray readBytes(uint16_t length);
     TagArrayStatus readTags();
     bool format();
     bool writeTags(TagArray &tags);
@@ -135,9 +154,11 @@ public:
 
     PN532 *nfc;
 private:
+    TagArrayStatus readTLV(uint16_t end);
+
     std::unordered_map<uint8_t, ByteArray*> tagMemory;
     uint8_t tagStartPage = 0x10;
-    uint8_t bytePosition = 0;
+    uint16_t bytePosition = 0;
 };
 
 
@@ -232,9 +232,18 @@ returnData read_tag_data(CardDefinition &tagsRead, ConCatTag *tags, uint8_t expe
         }
     }
     auto tagData = tags->readTags();
-    if (tagData.status != 0) {
+    if (tagData.status != READ_OK) {
         ret.success = false;
-        ret.message = (char*)"Failed to read tags";
+        switch (tagData.status) {
+            case READ_CORRUPT:
+                ret.message = (char*)"Corrupt ConCat badge";
+                break;
+            case READ_UNSUPPORTED_FORMAT:
+                ret.message = (char*)"ConCat badge in an unsupported format";
+                break;
+            default:
+                ret.message = (char*)"Failed to read tags";
+        }
         return ret;
     }
     tags->reset();
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"ConcatNFCRegProxy/internal/auth"
+	"ConcatNFCRegProxy/internal/config"
+	"ConcatNFCRegProxy/types"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+const READ_KEY = "cnfc_readonlykeyfortests"
+const TOKEN_SECRET = "0123456789abcdef0123456789abcdef"
+
+func setupAuthMock(t *testing.T) (*gin.Engine, *auth.Authenticator) {
+	auth.PAIRING_ATTEMPT_DELAY = 0
+	cfg := config.Default()
+	cfg.Auth.Enabled = true
+	cfg.Auth.CredentialsFile = filepath.Join(t.TempDir(), "credentials.json")
+	cfg.Auth.TokenSecret = TOKEN_SECRET
+	cfg.Auth.Keys = []config.APIKey{{Name: "reader", Key: READ_KEY, Scopes: []string{"read"}}}
+	a, err := newAuthenticator(cfg)
+	assert.NoError(t, err)
+
+	h := &HandlerContext{env: &MockNFC{}, cfg: cfg, auth: a}
+	r := gin.Default()
+	h.registerRoutes(r)
+	return r, a
+}
+
+func authRequest(r *gin.Engine, method string, path string, credential string, body any) *httptest.ResponseRecorder {
+	data, _ := json.Marshal(body)
+	req, _ := http.NewRequest(method, path, bytes.NewBuffer(data))
+	if credential != "" {
+		req.Header.Set("Authorization", "Bearer "+credential)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestAuthScopes(t *testing.T) {
+	r, a := setupAuthMock(t)
+	readReq := types.CardReadSetPasswordRequest{UUID: CARD_UUID}
+
+	assert.Equal(t, 401, authRequest(r, "PUT", "/read", "", readReq).Code)
+	assert.Equal(t, 401, authRequest(r, "PUT", "/read", "cnfc_wrong", readReq).Code)
+	// Authorized, so the handler answers that the mock card is empty
+	assert.Equal(t, 417, authRequest(r, "PUT", "/read", READ_KEY, readReq).Code)
+	assert.Equal(t, 403, authRequest(r, "POST", "/write", READ_KEY, types.CardDefinitionRequest{}).Code)
+	assert.Equal(t, 403, authRequest(r, "PUT", "/setpassword", READ_KEY, readReq).Code)
+
+	token, err := a.SignToken(auth.TokenClaims{Subject: "backend", Scopes: []auth.Scope{auth.SCOPE_ADMIN}, ExpiresAt: time.Now().Add(time.Hour).Unix()})
+	assert.NoError(t, err)
+	// Authorized, so the handler rejects the empty body instead
+	assert.Equal(t, 400, authRequest(r, "POST", "/write", token, types.CardDefinitionRequest{}).Code)
+
+	expired, err := a.SignToken(auth.TokenClaims{Subject: "backend", Scopes: []auth.Scope{auth.SCOPE_ADMIN}, ExpiresAt: time.Now().Add(-time.Hour).Unix()})
+	assert.NoError(t, err)
+	assert.Equal(t, 401, authRequest(r, "POST", "/write", expired, types.CardDefinitionRequest{}).Code)
+
+	// Healthcheck stays public
+	assert.Equal(t, 200, authRequest(r, "GET", "/healthcheck", "", nil).Code)
+}
+
+func TestAuthPairing(t *testing.T) {
+	r, a := setupAuthMock(t)
+	code, err := a.NewPairingCode()
+	assert.NoError(t, err)
+
+	w := authRequest(r, "POST", "/pair", "", types.PairRequest{Code: "not-the-code", Name: "registration"})
+	assert.Equal(t, 403, w.Code)
+
+	w = authRequest(r, "POST", "/pair", "", types.PairRequest{Code: code, Name: "registration", Scopes: []string{"write"}})
+	assert.Equal(t, 200, w.Code)
+	var res types.PairResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+	assert.True(t, res.Success)
+
+	assert.Equal(t, 400, authRequest(r, "POST", "/write", res.Key, types.CardDefinitionRequest{}).Code)
+	assert.Equal(t, 403, authRequest(r, "PUT", "/read", res.Key, types.CardReadSetPasswordRequest{UUID: CARD_UUID}).Code)
+
+	// Codes are single use
+	w = authRequest(r, "POST", "/pair", "", types.PairRequest{Code: code, Name: "registration"})
+	assert.Equal(t, 403, w.Code)
+
+	// The paired key survives a restart
+	reloaded, err := auth.NewAuthenticator(a.CredentialsFile(), "", nil)
+	assert.NoError(t, err)
+	principal, err := reloaded.Authenticate(res.Key)
+	assert.NoError(t, err)
+	assert.Equal(t, "registration", principal.Name)
+}
+
+func TestAuthPairingLockout(t *testing.T) {
+	r, a := setupAuthMock(t)
+	code, err := a.NewPairingCode()
+	assert.NoError(t, err)
+
+	// Admin is never granted by pairing, and asking for it costs no attempt
+	w := authRequest(r, "POST", "/pair", "", types.PairRequest{Code: code, Name: "registration", Scopes: []string{"admin"}})
+	assert.Equal(t, 400, w.Code)
+
+	for range auth.MAX_PAIRING_ATTEMPTS {
+		w = authRequest(r, "POST", "/pair", "", types.PairRequest{Code: "not-the-code", Name: "registration"})
+		assert.Equal(t, 403, w.Code)
+	}
+	// Pairing stays disabled, even with the right code, until the console creates a new one
+	w = authRequest(r, "POST", "/pair", "", types.PairRequest{Code: code, Name: "registration"})
+	assert.Equal(t, 403, w.Code)
+	assert.Contains(t, w.Body.String(), "Pairing is disabled")
+
+	// A new code printed on the console makes guesses count again
+	pairingConsole(a, strings.NewReader("help\npair\n"))
+	_, err = a.Pair("not-the-code", "registration", nil)
+	assert.ErrorIs(t, err, auth.ErrUnauthorized)
+}
+
+func TestEventTicket(t *testing.T) {
+	r, a := setupAuthMock(t)
+	// The stream itself never ends, so the middleware guards a stub here
+	events := gin.New()
+	events.GET("/events", EventsAuthMiddleware(a, auth.SCOPE_READ), func(c *gin.Context) { c.Status(204) })
+
+	assert.Equal(t, 401, authRequest(r, "POST", "/events/ticket", "", nil).Code)
+	w := authRequest(r, "POST", "/events/ticket", READ_KEY, nil)
+	assert.Equal(t, 200, w.Code)
+	var ticket types.EventTicketResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &ticket))
+	assert.True(t, ticket.Success)
+	assert.Equal(t, 30, ticket.ExpiresIn)
+
+	// API keys are only read from the header
+	assert.Equal(t, 401, authRequest(events, "GET", "/events?ticket="+READ_KEY, "", nil).Code)
+	assert.Equal(t, 401, authRequest(events, "GET", "/events?access_token="+READ_KEY, "", nil).Code)
+	assert.Equal(t, 401, authRequest(r, "PUT", "/read?access_token="+READ_KEY, "", types.CardReadSetPasswordRequest{UUID: CARD_UUID}).Code)
+	assert.Equal(t, 204, authRequest(events, "GET", "/events", READ_KEY, nil).Code)
+
+	// A ticket works once
+	assert.Equal(t, 204, authRequest(events, "GET", "/events?ticket="+ticket.Ticket, "", nil).Code)
+	assert.Equal(t, 401, authRequest(events, "GET", "/events?ticket="+ticket.Ticket, "", nil).Code)
+	// and only for GET /events
+	w = authRequest(r, "POST", "/events/ticket", READ_KEY, nil)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &ticket))
+	assert.Equal(t, 401, authRequest(r, "GET", "/uuid", ticket.Ticket, nil).Code)
+}
+
+func TestRedactPath(t *testing.T) {
+	assert.Equal(t, "/events?ticket=REDACTED", redactPath("/events?ticket=abc"))
+	assert.Equal(t, "/events?access_token=REDACTED&x=1", redactPath("/events?x=1&access_token=cnfc_secret"))
+	assert.Equal(t, "/read?x=1", redactPath("/read?x=1"))
+	assert.Equal(t, "/read", redactPath("/read"))
+	assert.Equal(t, "/events?REDACTED", redactPath("/events?ticket=%zz"))
+}
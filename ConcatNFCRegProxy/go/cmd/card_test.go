@@ -11,6 +11,9 @@ import (
 	"testing"
 	"time"
 
+	"ConcatNFCRegProxy/internal/config"
+	"ConcatNFCRegProxy/internal/ndef"
+	"ConcatNFCRegProxy/internal/tags"
 	"ConcatNFCRegProxy/types"
 
 	"github.com/gin-gonic/gin"
@@ -22,12 +25,15 @@ type MockNFC struct {
 	Locked         bool
 	Password       uint32
 	StoredTags     []types.Tag
+	ReadErr        error
+	NDEF           *types.NDEF
 	ConnectionLock sync.Mutex
 }
 
 var CARD_UUID string = "04412a014b3403"
 
 func (m *MockNFC) IsReady() bool            { return true }
+func (m *MockNFC) Reset() error             { return nil }
 func (m *MockNFC) GetUUID() (string, error) { return CARD_UUID, nil }
 
 func (m *MockNFC) SetNTAG21xPassword(password uint32) error {
@@ -53,7 +59,14 @@ func (m *MockNFC) WriteTags(tags []types.Tag) error {
 	return nil
 }
 func (m *MockNFC) ReadTags() ([]types.Tag, error) {
-	return append([]types.Tag{}, m.StoredTags...), nil
+	return append([]types.Tag{}, m.StoredTags...), m.ReadErr
+}
+
+func (m *MockNFC) ReadNDEF() (*types.NDEF, error) {
+	if m.NDEF == nil {
+		return nil, ndef.ErrNoNDEF
+	}
+	return m.NDEF, nil
 }
 
 func (m *MockNFC) Lock() {
@@ -75,17 +88,9 @@ func (m *MockNFC) ClearNTAG21xPassword() error {
 }
 
 func setupMock() *gin.Engine {
-	h := &HandlerContext{env: &MockNFC{}}
+	h := &HandlerContext{env: &MockNFC{}, cfg: config.Default()}
 	r := gin.Default()
-	r.Use(CORSMiddleware())
-	r.GET("/healthcheck", h.healthcheck)
-	r.GET("/uuid", h.getUUID)
-	r.POST("/write", h.writeData)
-	r.PATCH("/write", h.updateData)
-	r.PUT("/read", h.readData)
-	r.PUT("/setpassword", h.setPassword)
-	r.PUT("/clearpassword", h.clearPassword)
-	r.GET("/events", h.sseHandler)
+	h.registerRoutes(r)
 	return r
 }
 
@@ -116,7 +121,7 @@ func TestCardWrite(t *testing.T) {
 		AttendeeId:        123,
 		ConventionId:      32,
 		IssuanceCount:     1,
-		IssuanceTimestamp: fmt.Sprintf("%v", nowIunix),,
+		IssuanceTimestamp: fmt.Sprintf("%v", nowIunix),
 		Expiration:        uint64(nowIunix + uint64(3600*24)),
 		Signature:         "MTIzNDU2Nzg5MDEyMzQ1Njc4OTAxMjM0NTY3ODkwMTIzNDU2Nzg5MDEyMzQ1Njc4OTAxMjM0NTY3ODkwMTIzNDU2Nzg5MDEyMzQ=",
 		Password:          123,
@@ -153,7 +158,7 @@ func TestCardWrite(t *testing.T) {
 	assert.NotNil(t, res.Card)
 	assert.Equal(t, uint32(123), res.Card.AttendeeId)
 	assert.Equal(t, uint32(32), res.Card.ConventionId)
-	assert.Equal(t, uint32(1), res.Card.IssuanceCount)
+	assert.Equal(t, uint64(1), res.Card.IssuanceCount)
 	assert.Equal(t, nowIunix+3600*24, res.Card.Expiration)
 	assert.Equal(t, "MTIzNDU2Nzg5MDEyMzQ1Njc4OTAxMjM0NTY3ODkwMTIzNDU2Nzg5MDEyMzQ1Njc4OTAxMjM0NTY3ODkwMTIzNDU2Nzg5MDEyMzQ=", res.Card.Signature)
 	//Should not return a password
@@ -175,7 +180,7 @@ func TestCardWrite(t *testing.T) {
 		ConventionId:      33,
 		Password:          123,
 		AttendeeId:        124,
-		IssuanceTimestamp: fmt.Sprintf("%v", nowIunix + 3),
+		IssuanceTimestamp: fmt.Sprintf("%v", nowIunix+3),
 		Expiration:        uint64(nowIunix + uint64(3600*22)),
 		Signature:         "MTIzNDU2Nzg5MDEyMzQ1Njc4OTAxMjM0NTY3ODkwMTIzNDU2Nzg5MDEyMzQ1Njc4OTAxMjM0NTY3ODkwMTIzNDU2Nzg5MDEyMzQ=",
 		UUID:              CARD_UUID,
@@ -272,3 +277,127 @@ func TestCardPassword(t *testing.T) {
 	assert.Equal(t, 200, w7.Code)
 
 }
+
+func TestCardPatch(t *testing.T) {
+	mock := &MockNFC{}
+	h := &HandlerContext{env: mock, cfg: config.Default()}
+	r := gin.Default()
+	h.registerRoutes(r)
+
+	card := types.CardDefinitionRequest{
+		AttendeeId:        123,
+		ConventionId:      32,
+		IssuanceCount:     1,
+		IssuanceTimestamp: "1749932218",
+		Tier:              "Sponsor",
+		Signature:         "MTIz",
+		Password:          123,
+		UUID:              CARD_UUID,
+	}
+	assert.Equal(t, 200, authRequest(r, "POST", "/write", "", card).Code)
+
+	// The card had no expiration: add one, drop the tier and set issuance to zero
+	patch := json.RawMessage(`{"expiration":1750000000,"tier":null,"issuance":0,"signature":"NDU2","password":123,"uuid":"` + CARD_UUID + `"}`)
+	w := authRequest(r, "PATCH", "/write", "", patch)
+	assert.Equal(t, 200, w.Code)
+	var res types.Response
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+	assert.True(t, res.Success)
+	assert.Equal(t, "Sponsor", res.Before.Tier)
+	assert.Equal(t, uint64(0), res.Before.Expiration)
+	assert.Equal(t, "", res.After.Tier)
+	assert.Equal(t, uint64(1750000000), res.After.Expiration)
+	assert.Equal(t, "NDU2", res.After.Signature)
+	assert.Equal(t, uint32(123), res.After.AttendeeId)
+	assert.Contains(t, mock.StoredTags, types.Tag{Id: tags.TAG_ISSUANCE, Data: []byte{0, 0, 0, 0}})
+
+	stored := mock.StoredTags
+	w = authRequest(r, "PATCH", "/write", "", json.RawMessage(`{"tier":"","signature":"NDU2","password":123,"uuid":"`+CARD_UUID+`"}`))
+	assert.Equal(t, 400, w.Code)
+	assert.Contains(t, w.Body.String(), "use null to remove it")
+	assert.Equal(t, stored, mock.StoredTags)
+}
+
+func TestMetrics(t *testing.T) {
+
+	r := setupMock()
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/metrics", nil)
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, 200, w.Code)
+	assert.Contains(t, w.Body.String(), "concatnfc_sse_subscribers")
+}
+
+func TestCardReadFormats(t *testing.T) {
+	mock := &MockNFC{StoredTags: []types.Tag{{Id: tags.TAG_ISSUANCE, Data: []byte{0, 0, 0, 1}}}}
+	h := &HandlerContext{env: mock, cfg: config.Default()}
+	r := gin.Default()
+	h.registerRoutes(r)
+	body, _ := json.Marshal(types.CardReadSetPasswordRequest{UUID: CARD_UUID})
+
+	cases := []struct {
+		err    error
+		status int
+	}{
+		{nil, http.StatusOK},
+		{tags.ErrOlderFormat, http.StatusOK},
+		{tags.ErrNotConCat, http.StatusUnprocessableEntity},
+		{fmt.Errorf("%w: CRC is 00000000, expected 12345678", tags.ErrCorrupt), http.StatusUnprocessableEntity},
+		{errors.New("Operation failed"), http.StatusInternalServerError},
+	}
+	for _, c := range cases {
+		mock.ReadErr = c.err
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("PUT", "/read", bytes.NewBuffer(body))
+		r.ServeHTTP(w, req)
+		assert.Equal(t, c.status, w.Code, "%v", c.err)
+
+		var resp types.Response
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.Equal(t, c.err == tags.ErrOlderFormat, resp.OlderFormat)
+		if c.status != http.StatusOK {
+			assert.Equal(t, c.err.Error(), resp.Error)
+		}
+	}
+}
+
+func TestCardNDEF(t *testing.T) {
+	mock := &MockNFC{}
+	h := &HandlerContext{env: mock, cfg: config.Default()}
+	r := gin.Default()
+	h.registerRoutes(r)
+
+	// A card without capability container is not an error
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/ndef", nil)
+	r.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	assert.NotContains(t, w.Body.String(), "ndef")
+
+	mock.NDEF = &types.NDEF{Version: "1.0", Size: 144, Records: []types.NDEFRecord{{TNF: 1, Type: "U", URI: "https://concat.app"}}}
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/ndef", nil)
+	r.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	var response types.Response
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, CARD_UUID, response.UUID)
+	assert.Equal(t, mock.NDEF, response.NDEF)
+
+	// Reads report it next to the ConCat data, even on an empty card
+	w = httptest.NewRecorder()
+	body, _ := json.Marshal(types.CardReadSetPasswordRequest{UUID: CARD_UUID})
+	req, _ = http.NewRequest("PUT", "/read", bytes.NewBuffer(body))
+	r.ServeHTTP(w, req)
+	response = types.Response{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, mock.NDEF, response.NDEF)
+
+	code, _, data := v2Request(r, "GET", "/v2/ndef", "")
+	assert.Equal(t, 200, code)
+	var result types.NDEFResultV2
+	assert.NoError(t, json.Unmarshal(data, &result))
+	assert.Equal(t, mock.NDEF, result.NDEF)
+}
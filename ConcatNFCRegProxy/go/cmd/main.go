@@ -2,13 +2,26 @@ package main
 
 import (
 	"ConcatNFCRegProxy/broker"
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
-	"strconv"
+	"os"
+	"strings"
 	"time"
 
+	"ConcatNFCRegProxy/internal/auth"
+	"ConcatNFCRegProxy/internal/certs"
+	"ConcatNFCRegProxy/internal/config"
+	"ConcatNFCRegProxy/internal/logging"
+	"ConcatNFCRegProxy/internal/metrics"
+	"ConcatNFCRegProxy/internal/ndef"
 	"ConcatNFCRegProxy/internal/nfc"
+	"ConcatNFCRegProxy/internal/password"
+	"ConcatNFCRegProxy/internal/signature"
 	"ConcatNFCRegProxy/internal/tags"
 	"ConcatNFCRegProxy/types"
 
@@ -25,6 +38,7 @@ type NFCInterface interface {
 	BeepReader() error
 	WriteTags(tags []types.Tag) error
 	ReadTags() ([]types.Tag, error)
+	ReadNDEF() (*types.NDEF, error)
 	Lock()
 	Unlock()
 	ClearNTAG21xPassword() error
@@ -33,17 +47,29 @@ type NFCInterface interface {
 type HandlerContext struct {
 	env NFCInterface
 	b   *broker.Broker[string]
+	cfg *config.Config
+	// auth is nil when authentication is disabled
+	auth *auth.Authenticator
+	// keys is nil when no public key is configured
+	keys *signature.KeySet
+	// signer is nil unless offline signing is configured
+	signer    *signature.Signer
+	issuances *signature.IssuanceLog
+	// passwords is nil unless a password provider is configured
+	passwords password.Provider
 }
 
 func (h *HandlerContext) healthcheck(c *gin.Context) {
+	response := gin.H{
+		"ready": h.env.IsReady(),
+	}
+	if _, verbose := c.GetQuery("verbose"); verbose {
+		response["config"] = h.cfg.Redacted()
+	}
 	if h.env.IsReady() {
-		c.JSON(http.StatusOK, gin.H{
-			"ready": true,
-		})
+		c.JSON(http.StatusOK, response)
 	} else {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"ready": false,
-		})
+		c.JSON(http.StatusInternalServerError, response)
 	}
 }
 
@@ -111,6 +137,48 @@ func (h *HandlerContext) getUUID(c *gin.Context) {
 
 }
 
+// getNDEF returns the public NDEF content of the card, without the password
+func (h *HandlerContext) getNDEF(c *gin.Context) {
+	var response types.Response
+
+	success := h.waitForCardReady(c)
+	defer h.releaseCard()
+	if !success {
+		response.Error = "Card not ready"
+		c.JSON(http.StatusInternalServerError, response)
+		return
+	}
+
+	uid, err := h.env.GetUUID()
+	if err != nil {
+		response.Error = err.Error()
+		c.JSON(http.StatusUnsupportedMediaType, response)
+		return
+	}
+	response.UUID = uid
+	response.NDEF, err = h.env.ReadNDEF()
+	if err != nil && !errors.Is(err, ndef.ErrNoNDEF) {
+		response.Error = "Cannot read NDEF data: " + err.Error()
+		c.JSON(http.StatusUnprocessableEntity, response)
+		return
+	}
+	response.Success = true
+	c.JSON(http.StatusOK, response)
+}
+
+// readNDEF returns the NDEF content of the card, or nil when it has none or
+// it cannot be read
+func (h *HandlerContext) readNDEF() *types.NDEF {
+	info, err := h.env.ReadNDEF()
+	if err != nil {
+		if !errors.Is(err, ndef.ErrNoNDEF) {
+			logging.Debugf("Cannot read NDEF data: %s\n", err.Error())
+		}
+		return nil
+	}
+	return info
+}
+
 func (h *HandlerContext) readData(c *gin.Context) {
 	var response types.Response
 	var err error
@@ -127,6 +195,13 @@ func (h *HandlerContext) readData(c *gin.Context) {
 		return
 	}
 
+	resolved, err := h.cardPassword(req.UUID, req.Password)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Cannot resolve the card password: " + err.Error()})
+		return
+	}
+	req.Password = resolved
+
 	nullPassword := false
 	if req.Password == 0 {
 		nullPassword = true
@@ -156,7 +231,7 @@ func (h *HandlerContext) readData(c *gin.Context) {
 	err = env.NTAG21xAuth(req.Password)
 	if err != nil {
 		if err.Error() == "Operation failed to complete. Error code 63 00\n" && nullPassword == false {
-			time.Sleep(1000 * time.Millisecond)
+			time.Sleep(h.cfg.Timeouts.AuthRetryDelay.Std())
 			err = env.NTAG21xAuth(req.Password)
 		}
 		if err != nil {
@@ -166,16 +241,19 @@ func (h *HandlerContext) readData(c *gin.Context) {
 		}
 	}
 
-	readTags, err := env.ReadTags()
-	if err != nil {
+	readTags, encrypted, err := h.readCardTags(uid)
+	olderFormat := errors.Is(err, tags.ErrOlderFormat)
+	if err != nil && !olderFormat {
 		response.Error = err.Error()
-		c.JSON(http.StatusInternalServerError, response)
+		c.JSON(readErrorStatus(err), response)
 		return
 	}
+	// After the ConCat data, a failed NDEF read reconnects and drops the authentication
+	response.NDEF = h.readNDEF()
 
 	if len(readTags) == 0 {
-		response.Error = "Card is empty"
-		c.JSON(http.StatusOK, response)
+		response.Error = "Card is empty!"
+		c.JSON(http.StatusExpectationFailed, response)
 		return
 	}
 
@@ -187,11 +265,59 @@ func (h *HandlerContext) readData(c *gin.Context) {
 	}
 
 	response.Card = &content
+	response.OlderFormat = olderFormat
+	response.Encrypted = encrypted
+	if h.keys != nil && (req.Verify || h.cfg.Signature.VerifyOnRead) {
+		valid, err := h.verifyTags(readTags, uid)
+		if err != nil {
+			response.Error = err.Error()
+		}
+		response.SignatureValid = &valid
+	}
 	response.Success = true
 	c.JSON(http.StatusOK, response)
 
 }
 
+// readCardTags reads the tags of the card uid, opening their envelope when an
+// envelope key is configured. encrypted tells whether the card was sealed.
+func (h *HandlerContext) readCardTags(uid string) (cardTags []types.Tag, encrypted bool, err error) {
+	cardTags, err = h.env.ReadTags()
+	if err != nil && !errors.Is(err, tags.ErrOlderFormat) {
+		return nil, false, err
+	}
+	key := h.cfg.EnvelopeKey()
+	if key == nil || !tags.IsSealed(cardTags) {
+		return cardTags, false, err
+	}
+	opened, openErr := tags.Open(cardTags, key, uid)
+	if openErr != nil {
+		return nil, true, openErr
+	}
+	return opened, true, err
+}
+
+// writeCardTags writes cardTags to the card uid, sealed in an envelope when
+// envelope.encrypt is set
+func (h *HandlerContext) writeCardTags(cardTags []types.Tag, uid string) error {
+	if h.cfg.Envelope.Encrypt {
+		sealed, err := tags.Seal(cardTags, h.cfg.EnvelopeKey(), uid)
+		if err != nil {
+			return err
+		}
+		cardTags = sealed
+	}
+	return h.env.WriteTags(cardTags)
+}
+
+// readErrorStatus tells a card that is not a ConCat badge, or is corrupt, from a reader failure
+func readErrorStatus(err error) int {
+	if errors.Is(err, tags.ErrNotConCat) || errors.Is(err, tags.ErrNewerFormat) || errors.Is(err, tags.ErrCorrupt) || errors.Is(err, tags.ErrEncrypted) {
+		return http.StatusUnprocessableEntity
+	}
+	return http.StatusInternalServerError
+}
+
 func (h *HandlerContext) writeData(c *gin.Context) {
 	var req types.CardDefinitionRequest
 
@@ -200,13 +326,39 @@ func (h *HandlerContext) writeData(c *gin.Context) {
 		return
 	}
 
+	resolved, err := h.cardPassword(req.UUID, req.Password)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Cannot resolve the card password: " + err.Error()})
+		return
+	}
+	req.Password = resolved
+
+	// Without a signature the proxy signs the card itself, if it has a key
+	offline := req.Signature == "" && h.signer != nil
 	if req.AttendeeId == 0 || req.ConventionId == 0 || req.IssuanceCount == 0 ||
-		req.IssuanceTimestamp == "" || req.Signature == "" || req.Password == 0 || req.UUID == "" {
+		req.IssuanceTimestamp == "" || (req.Signature == "" && !offline) || req.Password == 0 || req.UUID == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body, one of the fields are missing"})
 		return
 	}
 	var response types.Response
 
+	insertTags, err := tags.RequestToTags(req)
+	if err == nil {
+		insertTags, err = h.cardFormat(insertTags)
+	}
+	var issuance signature.Issuance
+	if err == nil && offline {
+		insertTags, issuance, err = h.signOffline(insertTags, req.UUID)
+	}
+	if err != nil {
+		response.Error = "Invalid card definition: " + err.Error()
+		c.JSON(http.StatusForbidden, response)
+		return
+	}
+	if !h.checkSignature(c, insertTags, req.UUID) {
+		return
+	}
+
 	env := h.env
 	success := h.waitForCardReady(c)
 	defer h.releaseCard()
@@ -227,35 +379,17 @@ func (h *HandlerContext) writeData(c *gin.Context) {
 		return
 	}
 
-	var insertTags []types.Tag
-	insertTags = append(insertTags, tags.NewAttendeeId(req.AttendeeId, req.ConventionId))
-	insertTags = append(insertTags, tags.NewIssuance(req.IssuanceCount))
-	timestamp, err := strconv.ParseUint(req.IssuanceTimestamp, 10, 64)
-	if err != nil {
-		response.Error = "Invalid timestamp: " + err.Error()
-		c.JSON(http.StatusForbidden, response)
-	}
-	insertTags = append(insertTags, tags.NewTimestamp(timestamp))
-	if req.Expiration != 0 {
-		insertTags = append(insertTags, tags.NewExpiration(req.Expiration))
-	}
-	bytessign, err := tags.ValidateSignatureStructure(req.Signature)
-
+	err = env.NTAG21xAuth(req.Password)
 	if err != nil {
 		response.Error = "Invalid authentication " + err.Error()
 		c.JSON(http.StatusForbidden, response)
 		return
 	}
-	insertTags = append(insertTags, tags.NewSignature(bytessign))
 
-	err = env.NTAG21xAuth(req.Password)
-	if err != nil {
-		response.Error = "Invalid authentication " + err.Error()
-		c.JSON(http.StatusForbidden, response)
+	if offline && !h.recordIssuance(c, issuance, &response) {
 		return
 	}
-
-	err = env.WriteTags(insertTags)
+	err = h.writeCardTags(insertTags, uid)
 
 	if err != nil {
 		response.Error = err.Error()
@@ -267,15 +401,26 @@ func (h *HandlerContext) writeData(c *gin.Context) {
 	c.JSON(http.StatusOK, response)
 }
 
+// updateData applies the body as a JSON merge patch to the card: null removes
+// a tag, other fields are added or replaced and missing ones are kept
 func (h *HandlerContext) updateData(c *gin.Context) {
 	var req types.CardDefinitionRequest
 
-	if err := c.ShouldBindJSON(&req); err != nil {
+	patch, err := c.GetRawData()
+	if err != nil || json.Unmarshal(patch, &req) != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
 		return
 	}
 
-	if req.Signature == "" || req.Password == 0 || req.UUID == "" {
+	resolved, err := h.cardPassword(req.UUID, req.Password)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Cannot resolve the card password: " + err.Error()})
+		return
+	}
+	req.Password = resolved
+
+	offline := req.Signature == "" && h.signer != nil
+	if (req.Signature == "" && !offline) || req.Password == 0 || req.UUID == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body, fields signature, password and uuid are required"})
 		return
 	}
@@ -308,27 +453,244 @@ func (h *HandlerContext) updateData(c *gin.Context) {
 		return
 	}
 
-	readTags, err := env.ReadTags()
+	readTags, _, err := h.readCardTags(uid)
+	if err != nil && !errors.Is(err, tags.ErrOlderFormat) {
+		response.Error = err.Error()
+		c.JSON(readErrorStatus(err), response)
+		return
+	}
+
+	before, err := tags.TagsToRequest(readTags)
 	if err != nil {
 		response.Error = err.Error()
 		c.JSON(http.StatusInternalServerError, response)
 		return
 	}
-
-	newTags, err := tags.UpdateTags(readTags, req)
+	newTags, err := tags.MergePatch(readTags, patch)
+	if err != nil {
+		response.Error = err.Error()
+		c.JSON(http.StatusBadRequest, response)
+		return
+	}
+	newTags, err = h.cardFormat(newTags)
+	if err != nil {
+		response.Error = err.Error()
+		c.JSON(http.StatusBadRequest, response)
+		return
+	}
+	var issuance signature.Issuance
+	if offline {
+		newTags, issuance, err = h.signOffline(newTags, uid)
+		if err != nil {
+			response.Error = err.Error()
+			c.JSON(http.StatusInternalServerError, response)
+			return
+		}
+	}
+	after, err := tags.TagsToRequest(newTags)
 	if err != nil {
 		response.Error = err.Error()
 		c.JSON(http.StatusInternalServerError, response)
 		return
 	}
+	if !h.checkSignature(c, newTags, uid) {
+		return
+	}
+	if offline && !h.recordIssuance(c, issuance, &response) {
+		return
+	}
 
-	err = env.WriteTags(newTags)
+	err = h.writeCardTags(newTags, uid)
 	if err != nil {
 		response.Error = err.Error()
 		c.JSON(http.StatusInternalServerError, response)
 		return
 	}
 
+	response.Before = &before
+	response.After = &after
+	response.Success = true
+	c.JSON(http.StatusOK, response)
+}
+
+// signOffline replaces the signature of cardTags with one made by the local
+// key, in the algorithm the card asks for, and describes the result for the
+// issuance log
+func (h *HandlerContext) signOffline(cardTags []types.Tag, uid string) ([]types.Tag, signature.Issuance, error) {
+	signed := make([]types.Tag, 0, len(cardTags)+1)
+	for _, tag := range cardTags {
+		if tag.Id != tags.TAG_SIGNATURE {
+			signed = append(signed, tag)
+		}
+	}
+	payload, err := tags.SigningPayload(signed, uid)
+	if err != nil {
+		return nil, signature.Issuance{}, err
+	}
+	alg, kid := tags.SignatureKey(signed)
+	if kid != "" && kid != h.signer.KeyId {
+		return nil, signature.Issuance{}, fmt.Errorf("Card names key %q but the offline key is %q", kid, h.signer.KeyId)
+	}
+	sig, err := h.signer.Sign(payload, signature.Algorithm(alg))
+	if err != nil {
+		return nil, signature.Issuance{}, err
+	}
+	signed = append(signed, types.Tag{Id: tags.TAG_SIGNATURE, Data: sig})
+	content, err := tags.TagsToRequest(signed)
+	if err != nil {
+		return nil, signature.Issuance{}, err
+	}
+	return signed, signature.Issuance{
+		Time:         time.Now().UTC(),
+		KeyId:        h.signer.KeyId,
+		UUID:         uid,
+		AttendeeId:   content.AttendeeId,
+		ConventionId: content.ConventionId,
+		Issuance:     content.IssuanceCount,
+		Payload:      payloadText(signed, payload),
+		Signature:    content.Signature,
+	}, nil
+}
+
+// recordIssuance logs an offline signed card before it is written, so no
+// card leaves the station without a record. It answers 500 and returns
+// false when the record cannot be stored.
+func (h *HandlerContext) recordIssuance(c *gin.Context, issuance signature.Issuance, response *types.Response) bool {
+	err := h.issuances.Append(issuance)
+	if err != nil {
+		logging.Errorf("Cannot record offline issuance for card %s: %s\n", issuance.UUID, err.Error())
+		response.Error = "Cannot record offline issuance: " + err.Error()
+		c.JSON(http.StatusInternalServerError, response)
+		return false
+	}
+	logging.Infof("Signed card %s for attendee %d offline with key %s\n", issuance.UUID, issuance.AttendeeId, issuance.KeyId)
+	response.Signature = issuance.Signature
+	response.KeyId = issuance.KeyId
+	return true
+}
+
+// cardFormat converts cardTags to the format of written cards, tags.format
+func (h *HandlerContext) cardFormat(cardTags []types.Tag) ([]types.Tag, error) {
+	if h.cfg.Tags.Format == tags.FORMAT_COSE {
+		return tags.ToCOSE(cardTags)
+	}
+	return cardTags, nil
+}
+
+// payloadText renders a signed payload for responses and the issuance log:
+// JSON payloads as they are, the binary COSE Sig_structure in base64
+func payloadText(cardTags []types.Tag, payload []byte) string {
+	if tags.PayloadVersion(cardTags) == tags.PAYLOAD_COSE {
+		return base64.StdEncoding.EncodeToString(payload)
+	}
+	return string(payload)
+}
+
+// verifyTags checks the signature tag against the configured keys and the
+// card UID, with the algorithm and key id the card names. Payload versions below signature.minPayloadVersion never verify.
+func (h *HandlerContext) verifyTags(cardTags []types.Tag, uid string) (bool, error) {
+	version := tags.PayloadVersion(cardTags)
+	if version < uint64(h.cfg.Signature.MinPayloadVersion) {
+		return false, fmt.Errorf("%w: payload version %d, version %d required", signature.ErrUnboundSignature, version, h.cfg.Signature.MinPayloadVersion)
+	}
+	payload, err := tags.SigningPayload(cardTags, uid)
+	if err != nil {
+		return false, err
+	}
+	var sig []byte
+	for _, tag := range cardTags {
+		if tag.Id == tags.TAG_SIGNATURE {
+			sig = tag.Data
+		}
+	}
+	if sig == nil {
+		return false, nil
+	}
+	alg, kid := tags.SignatureKey(cardTags)
+	err = h.keys.Verify(payload, sig, signature.Algorithm(alg), kid)
+	if errors.Is(err, signature.ErrInvalidSignature) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// checkSignature answers 422 and returns false when writes must be signed
+// and cardTags are not
+func (h *HandlerContext) checkSignature(c *gin.Context, cardTags []types.Tag, uid string) bool {
+	if h.keys == nil || !h.cfg.Signature.RejectInvalid {
+		return true
+	}
+	valid, err := h.verifyTags(cardTags, uid)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, types.Response{Error: "Cannot verify signature: " + err.Error()})
+		return false
+	}
+	if !valid {
+		c.JSON(http.StatusUnprocessableEntity, types.Response{Error: signature.ErrInvalidSignature.Error()})
+		return false
+	}
+	return true
+}
+
+// verify checks the signature of a card definition without touching the card
+func (h *HandlerContext) verify(c *gin.Context) {
+	var req types.CardDefinitionRequest
+	var response types.VerifyResponse
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if h.keys == nil {
+		response.Error = "No public key configured"
+		c.JSON(http.StatusNotImplemented, response)
+		return
+	}
+	cardTags, err := tags.RequestToTags(req)
+	if err == nil {
+		cardTags, err = h.cardFormat(cardTags)
+	}
+	if err == nil {
+		var payload []byte
+		payload, err = tags.SigningPayload(cardTags, req.UUID)
+		response.Payload = payloadText(cardTags, payload)
+	}
+	if err != nil {
+		response.Error = "Invalid card definition: " + err.Error()
+		c.JSON(http.StatusBadRequest, response)
+		return
+	}
+	response.SignatureValid, err = h.verifyTags(cardTags, req.UUID)
+	if err != nil {
+		response.Error = err.Error()
+	}
+	response.Success = true
+	c.JSON(http.StatusOK, response)
+}
+
+// canonical returns the payload a signer has to sign for a card definition
+func (h *HandlerContext) canonical(c *gin.Context) {
+	var req types.CardDefinitionRequest
+	var response types.CanonicalResponse
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	cardTags, err := tags.RequestToTags(req)
+	var payload []byte
+	if err == nil {
+		cardTags, err = h.cardFormat(cardTags)
+	}
+	if err == nil {
+		payload, err = tags.SigningPayload(cardTags, req.UUID)
+	}
+	if err != nil {
+		response.Error = "Invalid card definition: " + err.Error()
+		c.JSON(http.StatusBadRequest, response)
+		return
+	}
+	response.Payload = payloadText(cardTags, payload)
 	response.Success = true
 	c.JSON(http.StatusOK, response)
 }
@@ -347,6 +709,12 @@ func (h *HandlerContext) setPassword(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body, one of the fields are missing"})
 		return
 	}
+	resolved, err := h.cardPassword(req.UUID, req.Password)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Cannot resolve the card password: " + err.Error()})
+		return
+	}
+	req.Password = resolved
 	if req.Password == 0 {
 		response.Error = "missing password parameter"
 		c.JSON(http.StatusBadRequest, response)
@@ -404,6 +772,12 @@ func (h *HandlerContext) clearPassword(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body, one of the fields are missing"})
 		return
 	}
+	resolved, err := h.cardPassword(req.UUID, req.Password)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Cannot resolve the card password: " + err.Error()})
+		return
+	}
+	req.Password = resolved
 	if req.Password == 0 {
 		response.Error = "missing password parameter"
 		c.JSON(http.StatusBadRequest, response)
@@ -458,6 +832,8 @@ func (h *HandlerContext) sseHandler(c *gin.Context) {
 
 	// Create a channel to send events
 	eventChan := h.b.Subscribe()
+	metrics.SSESubscribers.Inc()
+	defer metrics.SSESubscribers.Dec()
 
 	// Write events to client
 	c.Stream(func(w io.Writer) bool {
@@ -469,48 +845,306 @@ func (h *HandlerContext) sseHandler(c *gin.Context) {
 	})
 }
 
-func CORSMiddleware() gin.HandlerFunc {
-	return func(c *gin.Context) {
-		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
-		c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, accept, origin, Cache-Control, X-Requested-With")
-		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT")
+// eventTicket hands out a single use ticket for GET /events, which cannot
+// carry the Authorization header when opened with EventSource
+func (h *HandlerContext) eventTicket(c *gin.Context) {
+	var response types.EventTicketResponse
+	if h.auth == nil {
+		response.Error = "Authentication is disabled"
+		c.JSON(http.StatusNotFound, response)
+		return
+	}
+	principal := c.MustGet("principal").(auth.Principal)
+	ticket, err := h.auth.NewEventTicket(principal)
+	if err != nil {
+		response.Error = err.Error()
+		c.JSON(http.StatusInternalServerError, response)
+		return
+	}
+	response.Ticket = ticket
+	response.ExpiresIn = int(auth.EVENT_TICKET_LIFETIME.Seconds())
+	response.Success = true
+	c.JSON(http.StatusOK, response)
+}
 
-		if c.Request.Method == "OPTIONS" {
-			c.AbortWithStatus(204)
-			return
+// pair exchanges the one time code printed on the console for an API key
+func (h *HandlerContext) pair(c *gin.Context) {
+	var response types.PairResponse
+	var req types.PairRequest
+
+	if h.auth == nil {
+		response.Error = "Authentication is disabled"
+		c.JSON(http.StatusNotFound, response)
+		return
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil || req.Code == "" || req.Name == "" {
+		response.Error = "Invalid request body, fields code and name are required"
+		c.JSON(http.StatusBadRequest, response)
+		return
+	}
+	if len(req.Scopes) == 0 {
+		req.Scopes = []string{string(auth.SCOPE_READ), string(auth.SCOPE_WRITE), string(auth.SCOPE_PASSWORD)}
+	}
+	scopes, err := auth.ParseScopes(req.Scopes)
+	if err != nil {
+		response.Error = err.Error()
+		c.JSON(http.StatusBadRequest, response)
+		return
+	}
+
+	key, err := h.auth.Pair(req.Code, req.Name, scopes)
+	if errors.Is(err, auth.ErrPairingScope) {
+		response.Error = err.Error()
+		c.JSON(http.StatusBadRequest, response)
+		return
+	}
+	if err != nil {
+		response.Error = err.Error()
+		c.JSON(http.StatusForbidden, response)
+		return
+	}
+	fmt.Printf("Paired frontend %q with scopes %v\n", req.Name, req.Scopes)
+	response.Key = key
+	response.Scopes = req.Scopes
+	response.Success = true
+	c.JSON(http.StatusOK, response)
+}
+
+// cardPassword returns the password of a request, or resolves it from the
+// card UID when the request has none and a password provider is configured
+func (h *HandlerContext) cardPassword(uid string, requested uint32) (uint32, error) {
+	if requested != 0 || h.passwords == nil || uid == "" {
+		return requested, nil
+	}
+	resolved, err := h.passwords.Password(uid)
+	if err != nil {
+		logging.Warnf("Cannot resolve the password of card %s: %s\n", uid, err.Error())
+		return 0, err
+	}
+	return resolved, nil
+}
+
+func newPasswordProvider(cfg *config.Config) password.Provider {
+	switch cfg.Passwords.Provider {
+	case password.PROVIDER_STATIC:
+		return password.Static{Value: cfg.Passwords.Static}
+	case password.PROVIDER_DERIVE:
+		return password.NewDerived([]byte(cfg.Passwords.Secret))
+	case password.PROVIDER_HTTP:
+		return password.NewHTTP(cfg.Passwords.URL, cfg.Passwords.Token, cfg.Passwords.Timeout.Std())
+	}
+	return nil
+}
+
+func newAuthenticator(cfg *config.Config) (*auth.Authenticator, error) {
+	if !cfg.Auth.Enabled {
+		return nil, nil
+	}
+	var staticKeys []auth.StoredKey
+	for _, key := range cfg.Auth.Keys {
+		// Already checked by config.Validate
+		scopes, _ := auth.ParseScopes(key.Scopes)
+		staticKeys = append(staticKeys, auth.StoredKey{
+			Name:   key.Name,
+			Hash:   auth.HashKey(key.Key),
+			Scopes: scopes,
+		})
+	}
+	return auth.NewAuthenticator(cfg.Auth.CredentialsFile, cfg.Auth.TokenSecret, staticKeys)
+}
+
+// pairingConsole creates a new pairing code whenever the operator types
+// "pair" on the console, since wrong or expired codes disable pairing
+func pairingConsole(a *auth.Authenticator, in io.Reader) {
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) != "pair" {
+			continue
+		}
+		_, err := a.NewPairingCode()
+		if err != nil {
+			fmt.Printf("Cannot generate pairing code: %s\n", err.Error())
 		}
+	}
+}
+
+func (h *HandlerContext) registerRoutes(r *gin.Engine) {
+	r.Use(HostMiddleware(h.cfg))
+	r.Use(CORSMiddleware(h.cfg))
+
+	r.GET("/healthcheck", h.healthcheck)
+	r.GET("/metrics", gin.WrapH(metrics.Handler()))
+	r.POST("/pair", h.pair)
+
+	r.GET("/uuid", AuthMiddleware(h.auth, auth.SCOPE_READ), h.getUUID)
+	r.GET("/ndef", AuthMiddleware(h.auth, auth.SCOPE_READ), h.getNDEF)
+	r.GET("/reset", AuthMiddleware(h.auth, auth.SCOPE_WRITE), h.resetCard)
+
+	r.POST("/write", AuthMiddleware(h.auth, auth.SCOPE_WRITE), h.writeData)
+	r.PATCH("/write", AuthMiddleware(h.auth, auth.SCOPE_WRITE), h.updateData)
+	r.PUT("/read", AuthMiddleware(h.auth, auth.SCOPE_READ), h.readData)
+	r.POST("/verify", AuthMiddleware(h.auth, auth.SCOPE_READ), h.verify)
+	r.POST("/canonical", AuthMiddleware(h.auth, auth.SCOPE_READ), h.canonical)
+	r.PUT("/setpassword", AuthMiddleware(h.auth, auth.SCOPE_PASSWORD), h.setPassword)
+	r.PUT("/clearpassword", AuthMiddleware(h.auth, auth.SCOPE_PASSWORD), h.clearPassword)
 
-		c.Next()
+	r.POST("/events/ticket", AuthMiddleware(h.auth, auth.SCOPE_READ), h.eventTicket)
+	r.GET("/events", EventsAuthMiddleware(h.auth, auth.SCOPE_READ), h.sseHandler)
+
+	h.registerRoutesV2(r)
+}
+
+// exportCA writes the local CA certificate to a file, or stdout if no path is given
+func exportCA(cfg *config.Config, path string) error {
+	manager, err := certs.NewManager(cfg.TLS.Dir, cfg.CertificateHosts())
+	if err != nil {
+		return err
+	}
+	if path == "" || path == "-" {
+		_, err = os.Stdout.Write(manager.CAPEM())
+		return err
 	}
+	err = os.WriteFile(path, manager.CAPEM(), 0644)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Exported CA certificate to %s. Add it to the system or browser trust store.\n", path)
+	return nil
 }
 
 func main() {
-	b := broker.NewBroker[string]()
-	go b.Start()
+	args := os.Args[1:]
+	command := ""
+	if len(args) > 0 && args[0] == "export-ca" {
+		command = args[0]
+		args = args[1:]
+	}
 
-	handler := HandlerContext{
-		env: nfc.BeginNfc(b),
-		b:   b,
+	// export-ca [path] [flags]
+	exportPath := ""
+	if command == "export-ca" && len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		exportPath = args[0]
+		args = args[1:]
 	}
 
-	gin.SetMode(gin.ReleaseMode)
-	r := gin.Default()
+	cfg, err := config.Load(args)
+	if err != nil {
+		fmt.Printf("Invalid configuration: %s\n", err.Error())
+		os.Exit(1)
+	}
 
-	r.Use(CORSMiddleware())
+	if command == "export-ca" {
+		err = exportCA(cfg, exportPath)
+		if err != nil {
+			fmt.Printf("Cannot export CA: %s\n", err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+	level, _ := logging.ParseLevel(cfg.LogLevel)
+	logging.SetLevel(level)
+
+	tags.RejectUnknownCritical = cfg.Tags.RejectUnknownCritical
+	for _, custom := range cfg.Tags.Custom {
+		def, err := custom.Definition()
+		if err == nil {
+			err = tags.Register(def)
+		}
+		if err != nil {
+			fmt.Printf("Invalid custom tag: %s\n", err.Error())
+			os.Exit(1)
+		}
+	}
 
-	r.GET("/healthcheck", handler.healthcheck)
-	r.GET("/uuid", handler.getUUID)
-	r.GET("/reset", handler.resetCard)
+	b := broker.NewBroker[string]()
+	go b.Start()
 
-	r.POST("/write", handler.writeData)
-	r.PATCH("/write", handler.updateData)
-	r.PUT("/read", handler.readData)
-	r.PUT("/setpassword", handler.setPassword)
-	r.PUT("/clearpassword", handler.clearPassword)
+	authenticator, err := newAuthenticator(cfg)
+	if err != nil {
+		fmt.Printf("Cannot set up authentication: %s\n", err.Error())
+		os.Exit(1)
+	}
+	if authenticator != nil {
+		_, err = authenticator.NewPairingCode()
+		if err != nil {
+			fmt.Printf("Cannot generate pairing code: %s\n", err.Error())
+			os.Exit(1)
+		}
+		fmt.Println("Type pair and Enter to create a new pairing code")
+		go pairingConsole(authenticator, os.Stdin)
+	}
 
-	r.GET("/events", handler.sseHandler)
+	handler := HandlerContext{
+		env:  nfc.BeginNfc(b, cfg),
+		b:    b,
+		cfg:  cfg,
+		auth: authenticator,
+	}
+	handler.passwords = newPasswordProvider(cfg)
+	if handler.passwords != nil {
+		fmt.Printf("Resolving missing card passwords with the %s provider\n", cfg.Passwords.Provider)
+	}
+	if cfg.Envelope.Encrypt {
+		fmt.Println("Sealing written cards in an encrypted envelope")
+	}
+	if cfg.Signature.PublicKeyFile != "" {
+		handler.keys, err = signature.LoadKeySet(cfg.Signature.PublicKeyFile)
+		if err != nil {
+			fmt.Printf("Cannot load the signing keys: %s\n", err.Error())
+			os.Exit(1)
+		}
+		fmt.Printf("Loaded %d signing key(s) from %s\n", len(handler.keys.Keys), cfg.Signature.PublicKeyFile)
+	}
+	if cfg.Signature.PrivateKeyFile != "" {
+		handler.signer, err = signature.LoadSigner(cfg.Signature.PrivateKeyFile, cfg.Signature.PrivateKeyPassphrase, cfg.Signature.KeyId)
+		if err != nil {
+			fmt.Printf("Cannot load the private key: %s\n", err.Error())
+			os.Exit(1)
+		}
+		handler.issuances = signature.NewIssuanceLog(cfg.Signature.IssuanceLog)
+		jwk, _ := json.Marshal(handler.signer.PublicJWK())
+		fmt.Printf("Offline signing with key %s, issuances are recorded in %s. Public key: %s\n", handler.signer.KeyId, cfg.Signature.IssuanceLog, jwk)
+	}
 
-	r.Run(":7070")
+	gin.SetMode(gin.ReleaseMode)
+	r := gin.New()
+	r.Use(LoggerMiddleware(), gin.Recovery())
+	handler.registerRoutes(r)
 
+	errCh := make(chan error, len(cfg.Listen)+len(cfg.TLS.Listen))
+	if cfg.TLS.Enabled {
+		manager, err := certs.NewManager(cfg.TLS.Dir, cfg.CertificateHosts())
+		if err != nil {
+			fmt.Printf("Cannot set up TLS: %s\n", err.Error())
+			os.Exit(1)
+		}
+		go manager.RotateRoutine()
+		for _, addr := range cfg.TLS.Listen {
+			server := &http.Server{
+				Addr:              addr,
+				Handler:           r,
+				ReadHeaderTimeout: cfg.Timeouts.ReadHeader.Std(),
+				TLSConfig:         manager.TLSConfig(),
+			}
+			fmt.Printf("Listening with TLS on %s\n", addr)
+			go func() {
+				errCh <- server.ListenAndServeTLS("", "")
+			}()
+		}
+	}
+	for _, addr := range cfg.Listen {
+		server := &http.Server{
+			Addr:              addr,
+			Handler:           r,
+			ReadHeaderTimeout: cfg.Timeouts.ReadHeader.Std(),
+		}
+		fmt.Printf("Listening on %s\n", addr)
+		go func() {
+			errCh <- server.ListenAndServe()
+		}()
+	}
+	err = <-errCh
+	fmt.Printf("Server stopped: %s\n", err.Error())
+	os.Exit(1)
 }
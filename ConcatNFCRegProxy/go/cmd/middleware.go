@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"ConcatNFCRegProxy/internal/auth"
+	"ConcatNFCRegProxy/internal/config"
+	"ConcatNFCRegProxy/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+// allowedOrigin returns the value for Access-Control-Allow-Origin, or an
+// empty string if the request origin is not in the configured list
+func allowedOrigin(cfg *config.Config, origin string) string {
+	for _, allowed := range cfg.CORS.AllowedOrigins {
+		if allowed == "*" {
+			return "*"
+		}
+		if strings.EqualFold(allowed, origin) {
+			return origin
+		}
+	}
+	return ""
+}
+
+// allowedHost reports whether the Host header names this proxy. Checking it
+// stops DNS rebinding, where an attacker's domain resolves to 127.0.0.1 and
+// the browser treats the proxy as same-origin with the attacker's page.
+func allowedHost(cfg *config.Config, host string) bool {
+	// HTTP/1.0 clients may omit Host, browsers never do
+	if host == "" {
+		return true
+	}
+	hostname, _, err := net.SplitHostPort(host)
+	if err != nil {
+		hostname = host
+	}
+	hostname = strings.Trim(strings.ToLower(hostname), "[]")
+	for _, allowed := range cfg.CORS.AllowedHosts {
+		if allowed == "*" || strings.Trim(strings.ToLower(allowed), "[]") == hostname {
+			return true
+		}
+	}
+	return false
+}
+
+// abortWithError answers in the envelope of the API version the request
+// was sent to: types.ResponseV2 under /v2/, types.Response elsewhere
+func abortWithError(c *gin.Context, status int, code string, message string) {
+	if strings.HasPrefix(c.Request.URL.Path, "/v2/") {
+		failV2(c, status, code, message)
+		return
+	}
+	var response types.Response
+	response.Error = message
+	c.AbortWithStatusJSON(status, response)
+}
+
+// HostMiddleware rejects requests whose Host header is not in the allowlist
+func HostMiddleware(cfg *config.Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !allowedHost(cfg, c.Request.Host) {
+			abortWithError(c, http.StatusMisdirectedRequest, types.ERR_FORBIDDEN, "Host not allowed")
+			return
+		}
+		c.Next()
+	}
+}
+
+// CORSMiddleware rejects requests from origins that are not allowed and
+// answers CORS preflights, including Private Network Access preflights sent
+// by Chrome when a public site calls the proxy on localhost.
+func CORSMiddleware(cfg *config.Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requestOrigin := c.Request.Header.Get("Origin")
+		origin := allowedOrigin(cfg, requestOrigin)
+		if origin != "*" {
+			c.Writer.Header().Add("Vary", "Origin")
+		}
+		if requestOrigin != "" && origin == "" {
+			abortWithError(c, http.StatusForbidden, types.ERR_FORBIDDEN, "Origin not allowed")
+			return
+		}
+		if origin != "" {
+			c.Writer.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+		c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
+		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, accept, origin, Cache-Control, X-Requested-With")
+		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT, PATCH, DELETE")
+
+		if c.Request.Method == "OPTIONS" {
+			if c.Request.Header.Get("Access-Control-Request-Private-Network") == "true" {
+				if !cfg.CORS.AllowPrivateNetwork || requestOrigin == "" {
+					abortWithError(c, http.StatusForbidden, types.ERR_FORBIDDEN, "Private network access not allowed")
+					return
+				}
+				c.Writer.Header().Set("Access-Control-Allow-Private-Network", "true")
+			}
+			c.AbortWithStatus(204)
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// bearerToken extracts the credential from the Authorization header
+func bearerToken(c *gin.Context) string {
+	header := c.GetHeader("Authorization")
+	if token, found := strings.CutPrefix(header, "Bearer "); found {
+		return strings.TrimSpace(token)
+	}
+	return ""
+}
+
+func AuthMiddleware(a *auth.Authenticator, scope auth.Scope) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if a == nil {
+			c.Next()
+			return
+		}
+		principal, err := a.Authenticate(bearerToken(c))
+		authorize(c, principal, err, scope)
+	}
+}
+
+// EventsAuthMiddleware is AuthMiddleware for GET /events. EventSource cannot
+// set headers, so a ticket from POST /events/ticket is also accepted in the
+// ticket query parameter. API keys and tokens are never read from the URL.
+func EventsAuthMiddleware(a *auth.Authenticator, scope auth.Scope) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if a == nil {
+			c.Next()
+			return
+		}
+		var principal auth.Principal
+		var err error
+		if token := bearerToken(c); token != "" {
+			principal, err = a.Authenticate(token)
+		} else {
+			principal, err = a.RedeemEventTicket(c.Query("ticket"))
+		}
+		authorize(c, principal, err, scope)
+	}
+}
+
+func authorize(c *gin.Context, principal auth.Principal, err error, scope auth.Scope) {
+	if err != nil {
+		c.Header("WWW-Authenticate", "Bearer")
+		abortWithError(c, http.StatusUnauthorized, types.ERR_UNAUTHORIZED, err.Error())
+		return
+	}
+	if !principal.HasScope(scope) {
+		abortWithError(c, http.StatusForbidden, types.ERR_FORBIDDEN, auth.ErrForbidden.Error()+": "+string(scope))
+		return
+	}
+	c.Set("principal", principal)
+	c.Next()
+}
+
+// REDACTED_QUERY are query parameters that carry credentials and are never logged
+var REDACTED_QUERY = []string{"ticket", "access_token"}
+
+// LoggerMiddleware logs requests like gin.Logger, with the values of
+// REDACTED_QUERY replaced
+func LoggerMiddleware() gin.HandlerFunc {
+	return gin.LoggerWithFormatter(func(p gin.LogFormatterParams) string {
+		return fmt.Sprintf("[GIN] %v | %3d | %13v | %15s | %-7s %#v\n%s",
+			p.TimeStamp.Format("2006/01/02 - 15:04:05"),
+			p.StatusCode,
+			p.Latency,
+			p.ClientIP,
+			p.Method,
+			redactPath(p.Path),
+			p.ErrorMessage,
+		)
+	})
+}
+
+// redactPath replaces the values of REDACTED_QUERY in a path with its query
+func redactPath(path string) string {
+	base, rawQuery, found := strings.Cut(path, "?")
+	if !found {
+		return path
+	}
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		// Not worth parsing further, the whole query may hold a credential
+		return base + "?REDACTED"
+	}
+	redacted := false
+	for _, key := range REDACTED_QUERY {
+		if query.Has(key) {
+			query.Set(key, "REDACTED")
+			redacted = true
+		}
+	}
+	if !redacted {
+		return path
+	}
+	return base + "?" + query.Encode()
+}
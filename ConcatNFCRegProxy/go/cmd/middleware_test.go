@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"ConcatNFCRegProxy/internal/config"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+const REG_ORIGIN = "https://reg.concat.app"
+
+func setupMiddlewareMock(cfg *config.Config) *gin.Engine {
+	h := &HandlerContext{env: &MockNFC{}, cfg: cfg}
+	r := gin.Default()
+	h.registerRoutes(r)
+	return r
+}
+
+func restrictedConfig() *config.Config {
+	cfg := config.Default()
+	cfg.CORS.AllowedOrigins = []string{REG_ORIGIN}
+	return cfg
+}
+
+func hostRequest(r *gin.Engine, method string, host string, headers map[string]string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, "http://"+host+"/healthcheck", nil)
+	for key, val := range headers {
+		req.Header.Set(key, val)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestHostAllowlist(t *testing.T) {
+	r := setupMiddlewareMock(config.Default())
+
+	assert.Equal(t, 200, hostRequest(r, "GET", "localhost:7070", nil).Code)
+	assert.Equal(t, 200, hostRequest(r, "GET", "127.0.0.1:7070", nil).Code)
+	assert.Equal(t, 200, hostRequest(r, "GET", "[::1]:7070", nil).Code)
+	assert.Equal(t, 200, hostRequest(r, "GET", "LOCALHOST", nil).Code)
+	// DNS rebinding: attacker domain resolving to 127.0.0.1
+	assert.Equal(t, http.StatusMisdirectedRequest, hostRequest(r, "GET", "rebind.attacker.example:7070", nil).Code)
+	assert.Equal(t, http.StatusMisdirectedRequest, hostRequest(r, "OPTIONS", "rebind.attacker.example:7070", nil).Code)
+}
+
+func TestOriginAllowlist(t *testing.T) {
+	r := setupMiddlewareMock(restrictedConfig())
+
+	w := hostRequest(r, "GET", "localhost:7070", map[string]string{"Origin": REG_ORIGIN})
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, REG_ORIGIN, w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Contains(t, w.Header().Values("Vary"), "Origin")
+
+	w = hostRequest(r, "GET", "localhost:7070", map[string]string{"Origin": "https://evil.example"})
+	assert.Equal(t, 403, w.Code)
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+
+	// Requests without an Origin, e.g. curl, are not affected
+	w = hostRequest(r, "GET", "localhost:7070", nil)
+	assert.Equal(t, 200, w.Code)
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+}
+
+func TestPrivateNetworkAccessPreflight(t *testing.T) {
+	pna := map[string]string{
+		"Origin":                                 REG_ORIGIN,
+		"Access-Control-Request-Method":          "PUT",
+		"Access-Control-Request-Private-Network": "true",
+	}
+
+	r := setupMiddlewareMock(restrictedConfig())
+	w := hostRequest(r, "OPTIONS", "localhost:7070", pna)
+	assert.Equal(t, 204, w.Code)
+	assert.Equal(t, "true", w.Header().Get("Access-Control-Allow-Private-Network"))
+	assert.Equal(t, REG_ORIGIN, w.Header().Get("Access-Control-Allow-Origin"))
+
+	// Plain preflight does not advertise PNA
+	w = hostRequest(r, "OPTIONS", "localhost:7070", map[string]string{"Origin": REG_ORIGIN, "Access-Control-Request-Method": "PATCH"})
+	assert.Equal(t, 204, w.Code)
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Private-Network"))
+	assert.Contains(t, w.Header().Get("Access-Control-Allow-Methods"), "PATCH")
+
+	// PNA from a disallowed origin
+	pna["Origin"] = "https://evil.example"
+	w = hostRequest(r, "OPTIONS", "localhost:7070", pna)
+	assert.Equal(t, 403, w.Code)
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Private-Network"))
+
+	// PNA disabled
+	cfg := restrictedConfig()
+	cfg.CORS.AllowPrivateNetwork = false
+	r = setupMiddlewareMock(cfg)
+	pna["Origin"] = REG_ORIGIN
+	w = hostRequest(r, "OPTIONS", "localhost:7070", pna)
+	assert.Equal(t, 403, w.Code)
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Private-Network"))
+}
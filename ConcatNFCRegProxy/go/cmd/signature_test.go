@@ -0,0 +1,472 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"ConcatNFCRegProxy/internal/config"
+	"ConcatNFCRegProxy/internal/signature"
+	"ConcatNFCRegProxy/internal/tags"
+	"ConcatNFCRegProxy/types"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupSignatureMock(t *testing.T, cfg *config.Config) (*gin.Engine, *MockNFC, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	jwk, _ := json.Marshal(signature.JWK{
+		Kty: "EC",
+		Crv: "P-256",
+		X:   base64.RawURLEncoding.EncodeToString(key.PublicKey.X.FillBytes(make([]byte, 32))),
+		Y:   base64.RawURLEncoding.EncodeToString(key.PublicKey.Y.FillBytes(make([]byte, 32))),
+	})
+	keys, err := signature.ParseKeySet(jwk)
+	assert.NoError(t, err)
+
+	mock := &MockNFC{}
+	h := &HandlerContext{env: mock, cfg: cfg, keys: keys}
+	r := gin.Default()
+	h.registerRoutes(r)
+	return r, mock, key
+}
+
+func signedCard(t *testing.T, key *ecdsa.PrivateKey) types.CardDefinitionRequest {
+	card := types.CardDefinitionRequest{
+		AttendeeId:        123,
+		ConventionId:      32,
+		IssuanceCount:     1,
+		IssuanceTimestamp: "1749932218",
+		Expiration:        1750000000,
+		Password:          123,
+		UUID:              CARD_UUID,
+	}
+	return signCard(t, key, card)
+}
+
+// signCard signs card for the card UID in card.UUID
+func signCard(t *testing.T, key *ecdsa.PrivateKey, card types.CardDefinitionRequest) types.CardDefinitionRequest {
+	payload, err := tags.RequestSigningPayload(card)
+	assert.NoError(t, err)
+	digest := sha256.Sum256(payload)
+	sig, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	assert.NoError(t, err)
+	card.Signature = base64.StdEncoding.EncodeToString(sig)
+	return card
+}
+
+func TestVerifyEndpoint(t *testing.T) {
+	r, _, key := setupSignatureMock(t, config.Default())
+	card := signedCard(t, key)
+
+	w := authRequest(r, "POST", "/verify", "", card)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var resp types.VerifyResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.True(t, resp.SignatureValid)
+	assert.Equal(t, `{"conventionId":32,"expiration":1750000000,"issuanceCount":1,"timestamp":"1749932218","userId":123}`, resp.Payload)
+
+	card.IssuanceCount = 2
+	w = authRequest(r, "POST", "/verify", "", card)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.False(t, resp.SignatureValid)
+
+	unconfigured := setupMock()
+	w = authRequest(unconfigured, "POST", "/verify", "", card)
+	assert.Equal(t, http.StatusNotImplemented, w.Code)
+}
+
+func TestSignatureOnReadAndWrite(t *testing.T) {
+	cfg := config.Default()
+	cfg.Signature.RejectInvalid = true
+	r, mock, key := setupSignatureMock(t, cfg)
+	card := signedCard(t, key)
+
+	w := authRequest(r, "POST", "/write", "", card)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	read := types.CardReadSetPasswordRequest{Password: 123, UUID: CARD_UUID, Verify: true}
+	w = authRequest(r, "PUT", "/read", "", read)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var resp types.Response
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.NotNil(t, resp.SignatureValid)
+	assert.True(t, *resp.SignatureValid)
+
+	// Without the option the response does not carry signatureValid
+	read.Verify = false
+	w = authRequest(r, "PUT", "/read", "", read)
+	assert.NotContains(t, w.Body.String(), "signatureValid")
+
+	// Nothing touches the card when the signature does not match
+	stored := mock.StoredTags
+	tampered := card
+	tampered.AttendeeId = 124
+	w = authRequest(r, "POST", "/write", "", tampered)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	assert.Contains(t, w.Body.String(), "Signature does not verify")
+	assert.Equal(t, stored, mock.StoredTags)
+
+	patch := types.CardDefinitionRequest{IssuanceCount: 5, Signature: card.Signature, Password: 123, UUID: CARD_UUID}
+	w = authRequest(r, "PATCH", "/write", "", patch)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	assert.Equal(t, stored, mock.StoredTags)
+}
+
+func TestCanonicalEndpoint(t *testing.T) {
+	r := setupMock()
+	card := types.CardDefinitionRequest{
+		AttendeeId:        12345,
+		ConventionId:      1,
+		IssuanceCount:     1,
+		IssuanceTimestamp: "1672531200",
+		Expiration:        1675123200,
+		BadgeName:         "Zoë Fluffytail",
+		Tier:              "Sponsor",
+		Pronouns:          "they/them",
+	}
+
+	w := authRequest(r, "POST", "/canonical", "", card)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var resp types.CanonicalResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.True(t, resp.Success)
+	assert.Equal(t, `{"badgeName":"Zoë Fluffytail","conventionId":1,"expiration":1675123200,"issuanceCount":1,`+
+		`"pronouns":"they/them","tier":"Sponsor","timestamp":"1672531200","userId":12345}`, resp.Payload)
+
+	card.Tier = "Spon\x07sor"
+	w = authRequest(r, "POST", "/canonical", "", card)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestUIDBoundSignature(t *testing.T) {
+	cfg := config.Default()
+	cfg.Signature.RejectInvalid = true
+	r, mock, key := setupSignatureMock(t, cfg)
+	card := signedCard(t, key)
+	card.PayloadVersion = tags.PAYLOAD_V2
+	card = signCard(t, key, card)
+
+	w := authRequest(r, "POST", "/write", "", card)
+	assert.Equal(t, http.StatusOK, w.Code)
+	read := types.CardReadSetPasswordRequest{Password: 123, UUID: CARD_UUID, Verify: true}
+	w = authRequest(r, "PUT", "/read", "", read)
+	var resp types.Response
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.True(t, *resp.SignatureValid)
+	assert.Equal(t, uint32(2), resp.Card.PayloadVersion)
+
+	// The same tags signed for another card do not verify on this one
+	cloned := card
+	cloned.UUID = "04000000000000"
+	cloned = signCard(t, key, cloned)
+	cloned.UUID = CARD_UUID
+	w = authRequest(r, "POST", "/write", "", cloned)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	w = authRequest(r, "POST", "/verify", "", cloned)
+	var verifyResp types.VerifyResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &verifyResp))
+	assert.False(t, verifyResp.SignatureValid)
+	assert.Contains(t, verifyResp.Payload, `"uid":"04412a014b3403"`)
+
+	clonedTags, err := tags.RequestToTags(cloned)
+	assert.NoError(t, err)
+	mock.StoredTags = clonedTags
+	w = authRequest(r, "PUT", "/read", "", read)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.False(t, *resp.SignatureValid)
+
+	// v1 cards verify until the policy requires v2
+	v1 := signedCard(t, key)
+	w = authRequest(r, "POST", "/write", "", v1)
+	assert.Equal(t, http.StatusOK, w.Code)
+	cfg.Signature.MinPayloadVersion = 2
+	w = authRequest(r, "PUT", "/read", "", read)
+	resp = types.Response{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.False(t, *resp.SignatureValid)
+	assert.Contains(t, resp.Error, "not bound to the card UID")
+	w = authRequest(r, "POST", "/write", "", v1)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+}
+
+func TestKeyRotation(t *testing.T) {
+	old, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	current, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	var jwks signature.JWKS
+	for kid, key := range map[string]*ecdsa.PrivateKey{"2024": old, "2025": current} {
+		jwks.Keys = append(jwks.Keys, signature.JWK{
+			Kty: "EC",
+			Crv: "P-256",
+			X:   base64.RawURLEncoding.EncodeToString(key.PublicKey.X.FillBytes(make([]byte, 32))),
+			Y:   base64.RawURLEncoding.EncodeToString(key.PublicKey.Y.FillBytes(make([]byte, 32))),
+			Kid: kid,
+		})
+	}
+	set, _ := json.Marshal(jwks)
+	keys, err := signature.ParseKeySet(set)
+	assert.NoError(t, err)
+	h := &HandlerContext{env: &MockNFC{}, cfg: config.Default(), keys: keys}
+	r := gin.Default()
+	h.registerRoutes(r)
+
+	// Last year's badge, DER signature without a key id
+	card := signedCard(t, old)
+	w := authRequest(r, "POST", "/verify", "", card)
+	var resp types.VerifyResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.True(t, resp.SignatureValid)
+
+	// This year's badge, raw r||s signature naming its key
+	card.SignatureAlg = uint32(signature.ALG_ES256_RAW)
+	card.KeyId = "2025"
+	payload, err := tags.RequestSigningPayload(card)
+	assert.NoError(t, err)
+	digest := sha256.Sum256(payload)
+	rs, ss, err := ecdsa.Sign(rand.Reader, current, digest[:])
+	assert.NoError(t, err)
+	card.Signature = base64.StdEncoding.EncodeToString(append(rs.FillBytes(make([]byte, 32)), ss.FillBytes(make([]byte, 32))...))
+	w = authRequest(r, "POST", "/verify", "", card)
+	resp = types.VerifyResponse{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.True(t, resp.SignatureValid)
+	assert.Contains(t, resp.Payload, `"keyId":"2025","signatureAlg":2`)
+
+	// The key id is signed, pointing the card at another key breaks it
+	card.KeyId = "2024"
+	w = authRequest(r, "POST", "/verify", "", card)
+	resp = types.VerifyResponse{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.False(t, resp.SignatureValid)
+
+	card.KeyId = "2026"
+	w = authRequest(r, "POST", "/verify", "", card)
+	resp = types.VerifyResponse{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.False(t, resp.SignatureValid)
+	assert.Contains(t, resp.Error, "Unknown signing key")
+}
+
+func TestOfflineSigning(t *testing.T) {
+	signer, err := signature.LoadSigner("../internal/signature/testdata/offline-key.pem", "", "station-1")
+	assert.NoError(t, err)
+	jwk, _ := json.Marshal(signer.PublicJWK())
+	keys, err := signature.ParseKeySet(jwk)
+	assert.NoError(t, err)
+	cfg := config.Default()
+	cfg.Signature.RejectInvalid = true
+	logPath := filepath.Join(t.TempDir(), "offline-issuance.jsonl")
+	mock := &MockNFC{}
+	h := &HandlerContext{env: mock, cfg: cfg, keys: keys, signer: signer, issuances: signature.NewIssuanceLog(logPath)}
+	r := gin.Default()
+	h.registerRoutes(r)
+
+	card := types.CardDefinitionRequest{
+		AttendeeId:        123,
+		ConventionId:      32,
+		IssuanceCount:     1,
+		IssuanceTimestamp: "1749932218",
+		PayloadVersion:    tags.PAYLOAD_V2,
+		Password:          123,
+		UUID:              CARD_UUID,
+	}
+	w := authRequest(r, "POST", "/write", "", card)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var resp types.Response
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, "station-1", resp.KeyId)
+	assert.NotEmpty(t, resp.Signature)
+
+	read := types.CardReadSetPasswordRequest{Password: 123, UUID: CARD_UUID, Verify: true}
+	w = authRequest(r, "PUT", "/read", "", read)
+	resp = types.Response{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.True(t, *resp.SignatureValid)
+
+	// PATCH without a signature signs the updated card again
+	patch := types.CardDefinitionRequest{IssuanceCount: 2, Password: 123, UUID: CARD_UUID}
+	w = authRequest(r, "PATCH", "/write", "", patch)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = authRequest(r, "PUT", "/read", "", read)
+	resp = types.Response{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.True(t, *resp.SignatureValid)
+	assert.Equal(t, uint64(2), resp.Card.IssuanceCount)
+
+	data, err := os.ReadFile(logPath)
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	assert.Len(t, lines, 2)
+	var issuance signature.Issuance
+	assert.NoError(t, json.Unmarshal([]byte(lines[1]), &issuance))
+	assert.Equal(t, "station-1", issuance.KeyId)
+	assert.Equal(t, CARD_UUID, issuance.UUID)
+	assert.Equal(t, uint64(2), issuance.Issuance)
+	assert.Contains(t, issuance.Payload, `"uid":"04412a014b3403"`)
+
+	// No card is written without a record
+	stored := mock.StoredTags
+	h.issuances = signature.NewIssuanceLog(filepath.Join(logPath, "not-a-dir", "log.jsonl"))
+	w = authRequest(r, "POST", "/write", "", card)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Equal(t, stored, mock.StoredTags)
+
+	// Raw signatures on request, the offline key only signs under its own id
+	h.issuances = signature.NewIssuanceLog(logPath)
+	raw := card
+	raw.SignatureAlg = uint32(signature.ALG_ES256_RAW)
+	raw.KeyId = "station-1"
+	w = authRequest(r, "POST", "/write", "", raw)
+	assert.Equal(t, http.StatusOK, w.Code)
+	resp = types.Response{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	sig, _ := base64.StdEncoding.DecodeString(resp.Signature)
+	assert.Len(t, sig, 64)
+	raw.KeyId = "station-2"
+	w = authRequest(r, "POST", "/write", "", raw)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// Without a private key the signature stays required
+	w = authRequest(setupMock(), "POST", "/write", "", card)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestEnvelopeReadWrite(t *testing.T) {
+	cfg := config.Default()
+	cfg.Envelope.Key = strings.Repeat("42", tags.ENVELOPE_KEY_SIZE)
+	cfg.Envelope.Encrypt = true
+	r, mock, key := setupSignatureMock(t, cfg)
+	card := signedCard(t, key)
+
+	w := authRequest(r, "POST", "/write", "", card)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.True(t, tags.IsSealed(mock.StoredTags))
+
+	// The signature verifies once the envelope is opened
+	read := types.CardReadSetPasswordRequest{Password: 123, UUID: CARD_UUID, Verify: true}
+	w = authRequest(r, "PUT", "/read", "", read)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var resp types.Response
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.True(t, resp.Encrypted)
+	assert.Equal(t, uint32(123), resp.Card.AttendeeId)
+	assert.True(t, *resp.SignatureValid)
+
+	code, _, data := v2Request(r, "POST", "/v2/read", `{"uuid":"`+CARD_UUID+`","password":123,"verify":true}`)
+	assert.Equal(t, http.StatusOK, code)
+	var result types.ReadResultV2
+	assert.NoError(t, json.Unmarshal(data, &result))
+	assert.True(t, result.Encrypted)
+	assert.True(t, *result.SignatureValid)
+
+	// Plain cards are still read, and sealed on the next write
+	plain, err := tags.RequestToTags(card)
+	assert.NoError(t, err)
+	mock.StoredTags = plain
+	w = authRequest(r, "PATCH", "/write", "", json.RawMessage(`{"tier":"Sponsor","signature":"`+card.Signature+`","password":123,"uuid":"`+CARD_UUID+`"}`))
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.True(t, tags.IsSealed(mock.StoredTags))
+
+	// Another convention key cannot open the card
+	cfg.Envelope.Key = strings.Repeat("43", tags.ENVELOPE_KEY_SIZE)
+	w = authRequest(r, "PUT", "/read", "", read)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	assert.Contains(t, w.Body.String(), "encrypted")
+
+	// Nor can a proxy without a key
+	cfg.Envelope = config.Envelope{}
+	code, res, _ := v2Request(r, "POST", "/v2/read", `{"uuid":"`+CARD_UUID+`","password":123}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, code)
+	assert.Equal(t, types.ERR_CARD_UNREADABLE, res.Error.Code)
+}
+
+func TestCOSECards(t *testing.T) {
+	cfg := config.Default()
+	cfg.Tags.Format = tags.FORMAT_COSE
+	cfg.Signature.RejectInvalid = true
+	r, mock, key := setupSignatureMock(t, cfg)
+	card := types.CardDefinitionRequest{
+		AttendeeId:        123,
+		ConventionId:      32,
+		IssuanceCount:     1,
+		IssuanceTimestamp: "1749932218",
+		Password:          123,
+		UUID:              CARD_UUID,
+	}
+
+	// The signer signs the COSE Sig_structure /canonical returns, as r||s
+	w := authRequest(r, "POST", "/canonical", "", card)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var canonical types.CanonicalResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &canonical))
+	payload, err := base64.StdEncoding.DecodeString(canonical.Payload)
+	assert.NoError(t, err)
+	digest := sha256.Sum256(payload)
+	sigR, sigS, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	assert.NoError(t, err)
+	card.Signature = base64.StdEncoding.EncodeToString(append(sigR.FillBytes(make([]byte, 32)), sigS.FillBytes(make([]byte, 32))...))
+
+	w = authRequest(r, "POST", "/write", "", card)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, uint64(tags.PAYLOAD_COSE), tags.PayloadVersion(mock.StoredTags))
+	image, err := tags.Encode(mock.StoredTags)
+	assert.NoError(t, err)
+	assert.Equal(t, tags.CARD_FORMAT_COSE, image[2])
+
+	read := types.CardReadSetPasswordRequest{Password: 123, UUID: CARD_UUID, Verify: true}
+	w = authRequest(r, "PUT", "/read", "", read)
+	var resp types.Response
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.True(t, *resp.SignatureValid)
+	assert.Equal(t, uint32(3), resp.Card.PayloadVersion)
+	assert.Equal(t, uint32(2), resp.Card.SignatureAlg)
+
+	// A raw signature of the JSON payload does not verify as a COSE card
+	jsonPayload, err := tags.RequestSigningPayload(card)
+	assert.NoError(t, err)
+	digest = sha256.Sum256(jsonPayload)
+	sigR, sigS, err = ecdsa.Sign(rand.Reader, key, digest[:])
+	assert.NoError(t, err)
+	card.Signature = base64.StdEncoding.EncodeToString(append(sigR.FillBytes(make([]byte, 32)), sigS.FillBytes(make([]byte, 32))...))
+	w = authRequest(r, "POST", "/write", "", card)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+
+	// A DER signature without signatureAlg is not relabelled as raw ECDSA
+	stored := mock.StoredTags
+	w = authRequest(r, "POST", "/write", "", signedCard(t, key))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), "64 byte raw")
+	assert.Equal(t, stored, mock.StoredTags)
+
+	// Nor is one written under the DER algorithm
+	der := signedCard(t, key)
+	der.SignatureAlg = uint32(signature.ALG_ES256_DER)
+	w = authRequest(r, "POST", "/write", "", der)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), "no DER ECDSA")
+	assert.Equal(t, stored, mock.StoredTags)
+	w = authRequest(r, "POST", "/canonical", "", der)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// TLV cards are still read when writing COSE
+	plain, err := tags.RequestToTags(signedCard(t, key))
+	assert.NoError(t, err)
+	mock.StoredTags = plain
+	w = authRequest(r, "PUT", "/read", "", read)
+	resp = types.Response{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.True(t, *resp.SignatureValid)
+}
@@ -0,0 +1,655 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"ConcatNFCRegProxy/internal/auth"
+	"ConcatNFCRegProxy/internal/logging"
+	"ConcatNFCRegProxy/internal/ndef"
+	"ConcatNFCRegProxy/internal/password"
+	"ConcatNFCRegProxy/internal/tags"
+	"ConcatNFCRegProxy/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+// V2_TIME_FIELDS maps the RFC 3339 fields of types.CardV2 to the unix time
+// fields of types.CardDefinitionRequest
+var V2_TIME_FIELDS = []struct{ v2, v1 string }{
+	{"issuedAt", "timestamp"},
+	{"expiresAt", "expiration"},
+}
+
+// v2CardFields are the JSON names of types.CardV2, the fields a v2 PATCH accepts
+var v2CardFields = map[string]bool{}
+
+func init() {
+	t := reflect.TypeOf(types.CardV2{})
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		v2CardFields[name] = true
+	}
+}
+
+func (h *HandlerContext) registerRoutesV2(r *gin.Engine) {
+	v2 := r.Group("/v2")
+	v2.GET("/uuid", AuthMiddleware(h.auth, auth.SCOPE_READ), h.uuidV2)
+	v2.GET("/ndef", AuthMiddleware(h.auth, auth.SCOPE_READ), h.ndefV2)
+	v2.POST("/reset", AuthMiddleware(h.auth, auth.SCOPE_WRITE), h.resetV2)
+	v2.POST("/read", AuthMiddleware(h.auth, auth.SCOPE_READ), h.readV2)
+	v2.POST("/write", AuthMiddleware(h.auth, auth.SCOPE_WRITE), h.writeV2)
+	v2.PATCH("/write", AuthMiddleware(h.auth, auth.SCOPE_WRITE), h.patchV2)
+	v2.POST("/verify", AuthMiddleware(h.auth, auth.SCOPE_READ), h.verifyV2)
+	v2.POST("/canonical", AuthMiddleware(h.auth, auth.SCOPE_READ), h.canonicalV2)
+	v2.PUT("/password", AuthMiddleware(h.auth, auth.SCOPE_PASSWORD), h.setPasswordV2)
+	v2.DELETE("/password", AuthMiddleware(h.auth, auth.SCOPE_PASSWORD), h.clearPasswordV2)
+}
+
+func respondV2(c *gin.Context, data any) {
+	c.JSON(http.StatusOK, types.ResponseV2{Success: true, Data: data})
+}
+
+func failV2(c *gin.Context, status int, code string, message string, fields ...types.FieldError) {
+	c.AbortWithStatusJSON(status, types.ResponseV2{Error: &types.ErrorV2{Code: code, Message: message, Fields: fields}})
+}
+
+// bindV2 decodes the body into req. Unknown fields and values of the wrong
+// type are refused, with the field they were found in.
+func bindV2(c *gin.Context, req any) bool {
+	dec := json.NewDecoder(c.Request.Body)
+	dec.DisallowUnknownFields()
+	err := dec.Decode(req)
+	if err == nil {
+		return true
+	}
+	var fields []types.FieldError
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		fields = append(fields, types.FieldError{Field: typeErr.Field, Message: "Expected " + typeErr.Type.String()})
+	} else if field, unknown := strings.CutPrefix(err.Error(), "json: unknown field "); unknown {
+		fields = append(fields, types.FieldError{Field: strings.Trim(field, `"`), Message: "Unknown field"})
+	}
+	failV2(c, http.StatusBadRequest, types.ERR_INVALID_REQUEST, "Invalid request body", fields...)
+	return false
+}
+
+// checkCardRequestV2 validates the card selection of a request
+func checkCardRequestV2(req types.CardRequestV2, passwordRequired bool) []types.FieldError {
+	var errs []types.FieldError
+	if req.UUID == "" {
+		errs = append(errs, types.FieldError{Field: "uuid", Message: "Required"})
+	} else if _, err := hex.DecodeString(req.UUID); err != nil {
+		errs = append(errs, types.FieldError{Field: "uuid", Message: "Expected the card UID in hex"})
+	}
+	if passwordRequired && req.Password == nil {
+		errs = append(errs, types.FieldError{Field: "password", Message: "Required"})
+	}
+	return errs
+}
+
+// openCardV2 locks the reader, checks that the card on it is uuid and
+// authenticates with requested, or the password provider or factory default
+// when it is nil. It answers and returns false on failure; the caller
+// releases the card either way.
+func (h *HandlerContext) openCardV2(c *gin.Context, uuid string, requested *uint32) bool {
+	if !h.waitForCardReady(c) {
+		failV2(c, http.StatusServiceUnavailable, types.ERR_CARD_NOT_READY, "Card not ready")
+		return false
+	}
+	uid, err := h.env.GetUUID()
+	if err != nil {
+		failV2(c, http.StatusServiceUnavailable, types.ERR_CARD_NOT_READY, err.Error())
+		return false
+	}
+	if !strings.EqualFold(uid, uuid) {
+		failV2(c, http.StatusConflict, types.ERR_CARD_MISMATCH, "Another card is on the reader: "+uid)
+		return false
+	}
+	requested, ok := h.passwordV2(c, uid, requested)
+	if !ok {
+		return false
+	}
+	pwd := password.FACTORY_PASSWORD
+	if requested != nil {
+		pwd = *requested
+	}
+	err = h.env.NTAG21xAuth(pwd)
+	if err != nil && requested != nil && err.Error() == "Operation failed to complete. Error code 63 00\n" {
+		time.Sleep(h.cfg.Timeouts.AuthRetryDelay.Std())
+		err = h.env.NTAG21xAuth(pwd)
+	}
+	if err != nil {
+		failV2(c, http.StatusForbidden, types.ERR_CARD_AUTH, "Invalid authentication "+err.Error())
+		return false
+	}
+	return true
+}
+
+// passwordV2 returns requested, or the password of the provider when it is
+// nil. It answers and returns false when the provider fails.
+func (h *HandlerContext) passwordV2(c *gin.Context, uid string, requested *uint32) (*uint32, bool) {
+	if requested != nil || h.passwords == nil {
+		return requested, true
+	}
+	resolved, err := h.cardPassword(uid, 0)
+	if err != nil {
+		failV2(c, http.StatusBadGateway, types.ERR_PASSWORD_UNAVAILABLE, "Cannot resolve the card password: "+err.Error())
+		return nil, false
+	}
+	return &resolved, true
+}
+
+// cardToDocument converts a v2 card to the document tags.DocumentToTags
+// encodes, and reports the fields that are not valid on a card
+func cardToDocument(card types.CardV2) (map[string]any, []types.FieldError) {
+	data, err := json.Marshal(card)
+	if err != nil {
+		return nil, []types.FieldError{{Field: "card", Message: err.Error()}}
+	}
+	var doc map[string]any
+	err = decodeDocument(data, &doc)
+	if err != nil {
+		return nil, []types.FieldError{{Field: "card", Message: err.Error()}}
+	}
+	errs := convertTimes(doc)
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	for _, fieldErr := range tags.DocumentErrors(doc) {
+		errs = append(errs, types.FieldError{Field: v2FieldPath(fieldErr.Field), Message: fieldErr.Message})
+	}
+	return doc, errs
+}
+
+// patchToDocument converts a v2 merge patch to a tags.MergePatch one
+func patchToDocument(raw json.RawMessage) (map[string]any, []types.FieldError) {
+	var patch map[string]any
+	err := decodeDocument(raw, &patch)
+	if err != nil || patch == nil {
+		return nil, []types.FieldError{{Field: "card", Message: "Expected a JSON merge patch object"}}
+	}
+	var errs []types.FieldError
+	keys := make([]string, 0, len(patch))
+	for key := range patch {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !v2CardFields[key] {
+			errs = append(errs, types.FieldError{Field: "card." + key, Message: "Unknown field"})
+		}
+	}
+	return patch, append(errs, convertTimes(patch)...)
+}
+
+// convertTimes replaces the RFC 3339 fields of doc by unix times, leaving nulls
+func convertTimes(doc map[string]any) []types.FieldError {
+	var errs []types.FieldError
+	for _, field := range V2_TIME_FIELDS {
+		value, set := doc[field.v2]
+		if !set {
+			continue
+		}
+		delete(doc, field.v2)
+		if value == nil {
+			doc[field.v1] = nil
+			continue
+		}
+		str, _ := value.(string)
+		t, err := time.Parse(time.RFC3339, str)
+		if err != nil {
+			errs = append(errs, types.FieldError{Field: "card." + field.v2, Message: "Expected an RFC 3339 time"})
+			continue
+		}
+		if t.Unix() < 0 {
+			errs = append(errs, types.FieldError{Field: "card." + field.v2, Message: "Must not be before 1970"})
+			continue
+		}
+		if field.v1 == "timestamp" {
+			doc[field.v1] = strconv.FormatInt(t.Unix(), 10)
+		} else {
+			doc[field.v1] = t.Unix()
+		}
+	}
+	return errs
+}
+
+// tagsToCardV2 decodes card tags, keeping zero values
+func tagsToCardV2(cardTags []types.Tag) (types.CardV2, error) {
+	var card types.CardV2
+	doc, err := tags.Document(cardTags)
+	if err != nil {
+		return card, err
+	}
+	for _, field := range V2_TIME_FIELDS {
+		value, set := doc[field.v1]
+		if !set {
+			continue
+		}
+		delete(doc, field.v1)
+		unix, err := strconv.ParseInt(fmt.Sprint(value), 10, 64)
+		if err != nil {
+			return card, fmt.Errorf("Invalid %s on the card: %w", field.v1, err)
+		}
+		doc[field.v2] = time.Unix(unix, 0).UTC().Format(time.RFC3339)
+	}
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return card, err
+	}
+	err = json.Unmarshal(data, &card)
+	return card, err
+}
+
+func v2FieldPath(field string) string {
+	for _, timeField := range V2_TIME_FIELDS {
+		if field == timeField.v1 {
+			field = timeField.v2
+		}
+	}
+	if field == "" {
+		return "card"
+	}
+	return "card." + field
+}
+
+func decodeDocument(data []byte, v any) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+// readFailureV2 answers a failed card read
+func readFailureV2(c *gin.Context, err error) {
+	status := readErrorStatus(err)
+	code := types.ERR_INTERNAL
+	if status == http.StatusUnprocessableEntity {
+		code = types.ERR_CARD_UNREADABLE
+	}
+	failV2(c, status, code, err.Error())
+}
+
+// issueV2 signs offline when needed, checks the signature and records the
+// issuance, before cardTags are written. It answers and returns false on failure.
+func (h *HandlerContext) issueV2(c *gin.Context, cardTags []types.Tag, uid string, offline bool, result *types.WriteResultV2) ([]types.Tag, bool) {
+	if offline {
+		signed, issuance, err := h.signOffline(cardTags, uid)
+		if err != nil {
+			failV2(c, http.StatusBadRequest, types.ERR_INVALID_REQUEST, err.Error())
+			return nil, false
+		}
+		err = h.issuances.Append(issuance)
+		if err != nil {
+			logging.Errorf("Cannot record offline issuance for card %s: %s\n", issuance.UUID, err.Error())
+			failV2(c, http.StatusInternalServerError, types.ERR_INTERNAL, "Cannot record offline issuance: "+err.Error())
+			return nil, false
+		}
+		logging.Infof("Signed card %s for attendee %d offline with key %s\n", issuance.UUID, issuance.AttendeeId, issuance.KeyId)
+		result.Signature = signed[len(signed)-1].Data
+		result.KeyId = issuance.KeyId
+		cardTags = signed
+	}
+	if h.keys != nil && h.cfg.Signature.RejectInvalid {
+		valid, err := h.verifyTags(cardTags, uid)
+		if err != nil {
+			failV2(c, http.StatusUnprocessableEntity, types.ERR_INVALID_SIGNATURE, "Cannot verify signature: "+err.Error())
+			return nil, false
+		}
+		if !valid {
+			failV2(c, http.StatusUnprocessableEntity, types.ERR_INVALID_SIGNATURE, "Signature does not verify")
+			return nil, false
+		}
+	}
+	return cardTags, true
+}
+
+func (h *HandlerContext) uuidV2(c *gin.Context) {
+	defer h.releaseCard()
+	if !h.waitForCardReady(c) {
+		failV2(c, http.StatusServiceUnavailable, types.ERR_CARD_NOT_READY, "Card not ready")
+		return
+	}
+	uid, err := h.env.GetUUID()
+	if err != nil {
+		failV2(c, http.StatusServiceUnavailable, types.ERR_CARD_NOT_READY, err.Error())
+		return
+	}
+	respondV2(c, types.UUIDResultV2{UUID: uid})
+}
+
+// ndefV2 returns the public NDEF content of the card, without the password
+func (h *HandlerContext) ndefV2(c *gin.Context) {
+	defer h.releaseCard()
+	if !h.waitForCardReady(c) {
+		failV2(c, http.StatusServiceUnavailable, types.ERR_CARD_NOT_READY, "Card not ready")
+		return
+	}
+	uid, err := h.env.GetUUID()
+	if err != nil {
+		failV2(c, http.StatusServiceUnavailable, types.ERR_CARD_NOT_READY, err.Error())
+		return
+	}
+	info, err := h.env.ReadNDEF()
+	if err != nil && !errors.Is(err, ndef.ErrNoNDEF) {
+		failV2(c, http.StatusUnprocessableEntity, types.ERR_CARD_UNREADABLE, "Cannot read NDEF data: "+err.Error())
+		return
+	}
+	respondV2(c, types.NDEFResultV2{UUID: uid, NDEF: info})
+}
+
+func (h *HandlerContext) resetV2(c *gin.Context) {
+	defer h.releaseCard()
+	if !h.waitForCardReady(c) {
+		failV2(c, http.StatusServiceUnavailable, types.ERR_CARD_NOT_READY, "Card not ready")
+		return
+	}
+	err := h.env.Reset()
+	if err != nil {
+		failV2(c, http.StatusInternalServerError, types.ERR_INTERNAL, err.Error())
+		return
+	}
+	respondV2(c, nil)
+}
+
+func (h *HandlerContext) readV2(c *gin.Context) {
+	var req types.ReadRequestV2
+	if !bindV2(c, &req) {
+		return
+	}
+	if errs := checkCardRequestV2(req.CardRequestV2, false); len(errs) > 0 {
+		failV2(c, http.StatusBadRequest, types.ERR_INVALID_REQUEST, "Invalid request", errs...)
+		return
+	}
+
+	defer h.releaseCard()
+	if !h.openCardV2(c, req.UUID, req.Password) {
+		return
+	}
+	readTags, encrypted, err := h.readCardTags(req.UUID)
+	olderFormat := errors.Is(err, tags.ErrOlderFormat)
+	if err != nil && !olderFormat {
+		readFailureV2(c, err)
+		return
+	}
+	result := types.ReadResultV2{UUID: req.UUID, OlderFormat: olderFormat, Encrypted: encrypted, NDEF: h.readNDEF()}
+	if len(readTags) == 0 {
+		respondV2(c, result)
+		return
+	}
+	card, err := tagsToCardV2(readTags)
+	if err != nil {
+		failV2(c, http.StatusUnprocessableEntity, types.ERR_CARD_UNREADABLE, err.Error())
+		return
+	}
+	result.Card = &card
+	if h.keys != nil && (req.Verify || h.cfg.Signature.VerifyOnRead) {
+		valid, err := h.verifyTags(readTags, req.UUID)
+		if err != nil {
+			result.SignatureError = err.Error()
+		}
+		result.SignatureValid = &valid
+	}
+	respondV2(c, result)
+}
+
+func (h *HandlerContext) writeV2(c *gin.Context) {
+	var req types.WriteRequestV2
+	if !bindV2(c, &req) {
+		return
+	}
+	errs := checkCardRequestV2(req.CardRequestV2, h.passwords == nil)
+	offline := req.Card.Signature == nil && h.signer != nil
+	required := map[string]bool{
+		"attendeeId":   req.Card.AttendeeId != nil,
+		"conventionId": req.Card.ConventionId != nil,
+		"issuance":     req.Card.Issuance != nil,
+		"issuedAt":     req.Card.IssuedAt != nil,
+		"signature":    req.Card.Signature != nil || offline,
+	}
+	for _, field := range []string{"attendeeId", "conventionId", "issuance", "issuedAt", "signature"} {
+		if !required[field] {
+			errs = append(errs, types.FieldError{Field: "card." + field, Message: "Required"})
+		}
+	}
+	doc, docErrs := cardToDocument(req.Card)
+	errs = append(errs, docErrs...)
+	if len(errs) > 0 {
+		failV2(c, http.StatusBadRequest, types.ERR_INVALID_REQUEST, "Invalid request", errs...)
+		return
+	}
+	cardTags, err := tags.DocumentToTags(doc)
+	if err == nil {
+		cardTags, err = h.cardFormat(cardTags)
+	}
+	if err != nil {
+		failV2(c, http.StatusBadRequest, types.ERR_INVALID_REQUEST, err.Error())
+		return
+	}
+
+	var result types.WriteResultV2
+	defer h.releaseCard()
+	if !h.openCardV2(c, req.UUID, req.Password) {
+		return
+	}
+	cardTags, ok := h.issueV2(c, cardTags, req.UUID, offline, &result)
+	if !ok {
+		return
+	}
+	err = h.writeCardTags(cardTags, req.UUID)
+	if err != nil {
+		failV2(c, http.StatusInternalServerError, types.ERR_INTERNAL, err.Error())
+		return
+	}
+	_ = h.env.BeepReader()
+	result.UUID = req.UUID
+	result.After, err = tagsToCardV2(cardTags)
+	if err != nil {
+		failV2(c, http.StatusInternalServerError, types.ERR_INTERNAL, err.Error())
+		return
+	}
+	respondV2(c, result)
+}
+
+// patchV2 applies card as a JSON merge patch: null removes a tag, other
+// fields are added or replaced and missing ones are kept
+func (h *HandlerContext) patchV2(c *gin.Context) {
+	var req struct {
+		types.CardRequestV2
+		Card json.RawMessage `json:"card"`
+	}
+	if !bindV2(c, &req) {
+		return
+	}
+	errs := checkCardRequestV2(req.CardRequestV2, h.passwords == nil)
+	patch, patchErrs := patchToDocument(req.Card)
+	errs = append(errs, patchErrs...)
+	offline := h.signer != nil && patch != nil && patch["signature"] == nil
+	if patch != nil && patch["signature"] == nil && !offline {
+		errs = append(errs, types.FieldError{Field: "card.signature", Message: "Required"})
+	}
+	if len(errs) > 0 {
+		failV2(c, http.StatusBadRequest, types.ERR_INVALID_REQUEST, "Invalid request", errs...)
+		return
+	}
+	patchData, err := json.Marshal(patch)
+	if err != nil {
+		failV2(c, http.StatusBadRequest, types.ERR_INVALID_REQUEST, err.Error())
+		return
+	}
+
+	var result types.WriteResultV2
+	defer h.releaseCard()
+	if !h.openCardV2(c, req.UUID, req.Password) {
+		return
+	}
+	readTags, _, err := h.readCardTags(req.UUID)
+	if err != nil && !errors.Is(err, tags.ErrOlderFormat) {
+		readFailureV2(c, err)
+		return
+	}
+	before, err := tagsToCardV2(readTags)
+	if err != nil {
+		failV2(c, http.StatusUnprocessableEntity, types.ERR_CARD_UNREADABLE, err.Error())
+		return
+	}
+	cardTags, err := tags.MergePatch(readTags, patchData)
+	if err == nil {
+		cardTags, err = h.cardFormat(cardTags)
+	}
+	if err != nil {
+		failV2(c, http.StatusBadRequest, types.ERR_INVALID_REQUEST, err.Error())
+		return
+	}
+	cardTags, ok := h.issueV2(c, cardTags, req.UUID, offline, &result)
+	if !ok {
+		return
+	}
+	err = h.writeCardTags(cardTags, req.UUID)
+	if err != nil {
+		failV2(c, http.StatusInternalServerError, types.ERR_INTERNAL, err.Error())
+		return
+	}
+	result.UUID = req.UUID
+	result.Before = &before
+	result.After, err = tagsToCardV2(cardTags)
+	if err != nil {
+		failV2(c, http.StatusInternalServerError, types.ERR_INTERNAL, err.Error())
+		return
+	}
+	respondV2(c, result)
+}
+
+// definitionTagsV2 encodes the card of a /v2/verify or /v2/canonical request
+func definitionTagsV2(c *gin.Context) (types.CardDefinitionV2, []types.Tag, bool) {
+	var req types.CardDefinitionV2
+	if !bindV2(c, &req) {
+		return req, nil, false
+	}
+	doc, errs := cardToDocument(req.Card)
+	if req.UUID != "" {
+		if _, err := hex.DecodeString(req.UUID); err != nil {
+			errs = append(errs, types.FieldError{Field: "uuid", Message: "Expected the card UID in hex"})
+		}
+	}
+	if len(errs) > 0 {
+		failV2(c, http.StatusBadRequest, types.ERR_INVALID_REQUEST, "Invalid request", errs...)
+		return req, nil, false
+	}
+	cardTags, err := tags.DocumentToTags(doc)
+	if err != nil {
+		failV2(c, http.StatusBadRequest, types.ERR_INVALID_REQUEST, err.Error())
+		return req, nil, false
+	}
+	return req, cardTags, true
+}
+
+func (h *HandlerContext) verifyV2(c *gin.Context) {
+	req, cardTags, ok := definitionTagsV2(c)
+	if !ok {
+		return
+	}
+	if h.keys == nil {
+		failV2(c, http.StatusNotImplemented, types.ERR_NOT_CONFIGURED, "No public key configured")
+		return
+	}
+	cardTags, err := h.cardFormat(cardTags)
+	var payload []byte
+	if err == nil {
+		payload, err = tags.SigningPayload(cardTags, req.UUID)
+	}
+	if err != nil {
+		failV2(c, http.StatusBadRequest, types.ERR_INVALID_REQUEST, err.Error())
+		return
+	}
+	result := types.VerifyResultV2{Payload: payloadText(cardTags, payload)}
+	result.SignatureValid, err = h.verifyTags(cardTags, req.UUID)
+	if err != nil {
+		result.SignatureError = err.Error()
+	}
+	respondV2(c, result)
+}
+
+func (h *HandlerContext) canonicalV2(c *gin.Context) {
+	req, cardTags, ok := definitionTagsV2(c)
+	if !ok {
+		return
+	}
+	cardTags, err := h.cardFormat(cardTags)
+	var payload []byte
+	if err == nil {
+		payload, err = tags.SigningPayload(cardTags, req.UUID)
+	}
+	if err != nil {
+		failV2(c, http.StatusBadRequest, types.ERR_INVALID_REQUEST, err.Error())
+		return
+	}
+	respondV2(c, types.CanonicalResultV2{Payload: payloadText(cardTags, payload)})
+}
+
+// setPasswordV2 protects the card with password
+func (h *HandlerContext) setPasswordV2(c *gin.Context) {
+	var req types.CardRequestV2
+	if !bindV2(c, &req) {
+		return
+	}
+	if errs := checkCardRequestV2(req, h.passwords == nil); len(errs) > 0 {
+		failV2(c, http.StatusBadRequest, types.ERR_INVALID_REQUEST, "Invalid request", errs...)
+		return
+	}
+	defer h.releaseCard()
+	if !h.waitForCardReady(c) {
+		failV2(c, http.StatusServiceUnavailable, types.ERR_CARD_NOT_READY, "Card not ready")
+		return
+	}
+	uid, err := h.env.GetUUID()
+	if err != nil {
+		failV2(c, http.StatusServiceUnavailable, types.ERR_CARD_NOT_READY, err.Error())
+		return
+	}
+	if !strings.EqualFold(uid, req.UUID) {
+		failV2(c, http.StatusConflict, types.ERR_CARD_MISMATCH, "Another card is on the reader: "+uid)
+		return
+	}
+	requested, ok := h.passwordV2(c, uid, req.Password)
+	if !ok {
+		return
+	}
+	err = h.env.SetNTAG21xPassword(*requested)
+	if err != nil {
+		failV2(c, http.StatusInternalServerError, types.ERR_INTERNAL, err.Error())
+		return
+	}
+	respondV2(c, nil)
+}
+
+// clearPasswordV2 removes the password protection, password is the current one
+func (h *HandlerContext) clearPasswordV2(c *gin.Context) {
+	var req types.CardRequestV2
+	if !bindV2(c, &req) {
+		return
+	}
+	if errs := checkCardRequestV2(req, h.passwords == nil); len(errs) > 0 {
+		failV2(c, http.StatusBadRequest, types.ERR_INVALID_REQUEST, "Invalid request", errs...)
+		return
+	}
+	defer h.releaseCard()
+	if !h.openCardV2(c, req.UUID, req.Password) {
+		return
+	}
+	err := h.env.ClearNTAG21xPassword()
+	if err != nil {
+		failV2(c, http.StatusInternalServerError, types.ERR_INTERNAL, err.Error())
+		return
+	}
+	respondV2(c, nil)
+}
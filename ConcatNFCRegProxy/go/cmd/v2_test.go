@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"ConcatNFCRegProxy/internal/config"
+	"ConcatNFCRegProxy/internal/password"
+	"ConcatNFCRegProxy/internal/tags"
+	"ConcatNFCRegProxy/types"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupV2Mock() (*gin.Engine, *MockNFC) {
+	mock := &MockNFC{}
+	h := &HandlerContext{env: mock, cfg: config.Default()}
+	r := gin.Default()
+	h.registerRoutes(r)
+	return r, mock
+}
+
+func v2Request(r *gin.Engine, method string, path string, body string) (int, types.ResponseV2, json.RawMessage) {
+	req, _ := http.NewRequest(method, path, strings.NewReader(body))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	var res struct {
+		types.ResponseV2
+		Data json.RawMessage `json:"data"`
+	}
+	_ = json.Unmarshal(w.Body.Bytes(), &res)
+	return w.Code, res.ResponseV2, res.Data
+}
+
+const V2_CARD = `{"attendeeId":123,"conventionId":32,"issuance":0,"issuedAt":"2025-06-14T20:16:58Z","expiresAt":"2025-06-15T17:06:40+02:00","tier":"Sponsor","signature":"MTIzNDU2Nzg5MA=="}`
+
+func TestV2WriteRead(t *testing.T) {
+	r, mock := setupV2Mock()
+
+	code, res, data := v2Request(r, "POST", "/v2/write", `{"uuid":"`+CARD_UUID+`","password":123,"card":`+V2_CARD+`}`)
+	assert.Equal(t, 200, code)
+	assert.True(t, res.Success)
+	var written types.WriteResultV2
+	assert.NoError(t, json.Unmarshal(data, &written))
+	assert.Equal(t, "2025-06-15T15:06:40Z", *written.After.ExpiresAt)
+
+	// A zero issuance is written, not dropped
+	assert.Contains(t, mock.StoredTags, types.Tag{Id: tags.TAG_ISSUANCE, Data: []byte{0, 0, 0, 0}})
+	decoded, err := tags.TagsToRequest(mock.StoredTags)
+	assert.NoError(t, err)
+	assert.Equal(t, "1749932218", decoded.IssuanceTimestamp)
+	assert.Equal(t, uint64(1750000000), decoded.Expiration)
+
+	code, res, data = v2Request(r, "POST", "/v2/read", `{"uuid":"`+CARD_UUID+`"}`)
+	assert.Equal(t, 200, code)
+	var read types.ReadResultV2
+	assert.NoError(t, json.Unmarshal(data, &read))
+	assert.NotNil(t, read.Card)
+	assert.Equal(t, uint64(0), *read.Card.Issuance)
+	assert.Equal(t, "2025-06-14T20:16:58Z", *read.Card.IssuedAt)
+	assert.Equal(t, "Sponsor", *read.Card.Tier)
+	assert.Nil(t, read.Card.BadgeName)
+
+	// An empty card is a success with a null card
+	mock.StoredTags = nil
+	code, res, data = v2Request(r, "POST", "/v2/read", `{"uuid":"`+CARD_UUID+`"}`)
+	assert.Equal(t, 200, code)
+	assert.True(t, res.Success)
+	assert.JSONEq(t, `{"uuid":"`+CARD_UUID+`","card":null,"olderFormat":false}`, string(data))
+}
+
+func TestV2Validation(t *testing.T) {
+	r, _ := setupV2Mock()
+
+	// Every invalid field is reported at once
+	code, res, _ := v2Request(r, "POST", "/v2/write", `{"uuid":"not-hex","card":{"conventionId":32,"issuedAt":"yesterday","tier":""}}`)
+	assert.Equal(t, 400, code)
+	assert.False(t, res.Success)
+	assert.Equal(t, types.ERR_INVALID_REQUEST, res.Error.Code)
+	fields := map[string]string{}
+	for _, field := range res.Error.Fields {
+		fields[field.Field] = field.Message
+	}
+	assert.Contains(t, fields, "uuid")
+	assert.Contains(t, fields, "password")
+	assert.Contains(t, fields, "card.attendeeId")
+	assert.Contains(t, fields, "card.issuance")
+	assert.Contains(t, fields, "card.signature")
+	assert.Equal(t, "Expected an RFC 3339 time", fields["card.issuedAt"])
+
+	code, res, _ = v2Request(r, "POST", "/v2/write", `{"uuid":"`+CARD_UUID+`","password":123,"card":{"attendeeId":"123"}}`)
+	assert.Equal(t, 400, code)
+	assert.Equal(t, []types.FieldError{{Field: "card.attendeeId", Message: "Expected uint32"}}, res.Error.Fields)
+
+	code, res, _ = v2Request(r, "POST", "/v2/write", `{"uuid":"`+CARD_UUID+`","password":123,"card":{"timestamp":"1000"}}`)
+	assert.Equal(t, 400, code)
+	assert.Equal(t, []types.FieldError{{Field: "timestamp", Message: "Unknown field"}}, res.Error.Fields)
+
+	code, res, _ = v2Request(r, "POST", "/v2/write", `{"uuid":"`+CARD_UUID+`","password":123,"card":{"attendeeId":1,"conventionId":2,"issuance":1,"issuedAt":"1969-12-31T23:59:59Z","signature":"AA=="}}`)
+	assert.Equal(t, 400, code)
+	assert.Equal(t, []types.FieldError{{Field: "card.issuedAt", Message: "Must not be before 1970"}}, res.Error.Fields)
+
+	code, res, _ = v2Request(r, "POST", "/v2/read", `{"uuid":"04ffffffffffff"}`)
+	assert.Equal(t, 409, code)
+	assert.Equal(t, types.ERR_CARD_MISMATCH, res.Error.Code)
+}
+
+func TestV2Patch(t *testing.T) {
+	r, mock := setupV2Mock()
+	code, _, _ := v2Request(r, "POST", "/v2/write", `{"uuid":"`+CARD_UUID+`","password":123,"card":`+V2_CARD+`}`)
+	assert.Equal(t, 200, code)
+
+	code, res, data := v2Request(r, "PATCH", "/v2/write", `{"uuid":"`+CARD_UUID+`","password":123,"card":{"tier":null,"expiresAt":null,"issuance":2,"signature":"MDk4NzY1NDMyMQ=="}}`)
+	assert.Equal(t, 200, code)
+	assert.True(t, res.Success)
+	var patched types.WriteResultV2
+	assert.NoError(t, json.Unmarshal(data, &patched))
+	assert.Equal(t, "Sponsor", *patched.Before.Tier)
+	assert.Equal(t, uint64(0), *patched.Before.Issuance)
+	assert.Nil(t, patched.After.Tier)
+	assert.Nil(t, patched.After.ExpiresAt)
+	assert.Equal(t, uint64(2), *patched.After.Issuance)
+	assert.Equal(t, "2025-06-14T20:16:58Z", *patched.After.IssuedAt)
+
+	decoded, err := tags.TagsToRequest(mock.StoredTags)
+	assert.NoError(t, err)
+	assert.Equal(t, "", decoded.Tier)
+	assert.Equal(t, uint64(0), decoded.Expiration)
+
+	code, res, _ = v2Request(r, "PATCH", "/v2/write", `{"uuid":"`+CARD_UUID+`","password":123,"card":{"seat":1,"signature":"AA=="}}`)
+	assert.Equal(t, 400, code)
+	assert.Equal(t, []types.FieldError{{Field: "card.seat", Message: "Unknown field"}}, res.Error.Fields)
+}
+
+func TestV2Envelope(t *testing.T) {
+	r, _ := setupAuthMock(t)
+
+	// Middleware errors use the envelope of the API version
+	code, res, _ := v2Request(r, "POST", "/v2/read", `{"uuid":"`+CARD_UUID+`"}`)
+	assert.Equal(t, 401, code)
+	assert.False(t, res.Success)
+	assert.Equal(t, types.ERR_UNAUTHORIZED, res.Error.Code)
+
+	w := authRequest(r, "PUT", "/read", "", types.CardReadSetPasswordRequest{UUID: CARD_UUID})
+	assert.Equal(t, 401, w.Code)
+	var v1 types.Response
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &v1))
+	assert.NotEmpty(t, v1.Error)
+}
+
+type failingProvider struct{}
+
+func (failingProvider) Password(uid string) (uint32, error) {
+	return 0, errors.New("Backend unreachable")
+}
+
+func TestPasswordProvider(t *testing.T) {
+	mock := &MockNFC{}
+	h := &HandlerContext{env: mock, cfg: config.Default(), passwords: password.Static{Value: 4242}}
+	r := gin.Default()
+	h.registerRoutes(r)
+
+	// Requests without a password use the provider
+	code, res, _ := v2Request(r, "PUT", "/v2/password", `{"uuid":"`+CARD_UUID+`"}`)
+	assert.Equal(t, 200, code, res.Error)
+	assert.Equal(t, uint32(4242), mock.Password)
+
+	code, res, _ = v2Request(r, "POST", "/v2/write", `{"uuid":"`+CARD_UUID+`","card":`+V2_CARD+`}`)
+	assert.Equal(t, 200, code, res.Error)
+
+	w := authRequest(r, "PUT", "/read", "", json.RawMessage(`{"uuid":"`+CARD_UUID+`"}`))
+	assert.Equal(t, 200, w.Code, w.Body.String())
+
+	// An explicit password still wins
+	code, res, _ = v2Request(r, "POST", "/v2/read", `{"uuid":"`+CARD_UUID+`","password":1}`)
+	assert.Equal(t, 403, code)
+	assert.Equal(t, types.ERR_CARD_AUTH, res.Error.Code)
+
+	h.passwords = failingProvider{}
+	code, res, _ = v2Request(r, "POST", "/v2/read", `{"uuid":"`+CARD_UUID+`"}`)
+	assert.Equal(t, 502, code)
+	assert.Equal(t, types.ERR_PASSWORD_UNAVAILABLE, res.Error.Code)
+}
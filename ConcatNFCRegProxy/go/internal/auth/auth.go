@@ -0,0 +1,353 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Scope string
+
+const (
+	SCOPE_READ     Scope = "read"
+	SCOPE_WRITE    Scope = "write"
+	SCOPE_PASSWORD Scope = "password"
+	// SCOPE_ADMIN grants every other scope
+	SCOPE_ADMIN Scope = "admin"
+)
+
+var ALL_SCOPES = []Scope{SCOPE_READ, SCOPE_WRITE, SCOPE_PASSWORD, SCOPE_ADMIN}
+
+const API_KEY_PREFIX = "cnfc_"
+
+// PAIRING_CODE_LIFETIME is how long a pairing code printed on the console stays valid
+const PAIRING_CODE_LIFETIME = 10 * time.Minute
+
+// MAX_PAIRING_ATTEMPTS is the number of wrong codes accepted before pairing is
+// disabled until a new code is created on the console
+const MAX_PAIRING_ATTEMPTS = 5
+
+// PAIRING_ATTEMPT_DELAY slows down every pairing attempt. Attempts are handled
+// one at a time, so it bounds the guessing rate.
+var PAIRING_ATTEMPT_DELAY = 1 * time.Second
+
+// EVENT_TICKET_LIFETIME is how long a ticket for GET /events can be redeemed
+const EVENT_TICKET_LIFETIME = 30 * time.Second
+
+// PAIRING_SCOPES can be granted by pairing, admin needs a static key or a token
+var PAIRING_SCOPES = []Scope{SCOPE_READ, SCOPE_WRITE, SCOPE_PASSWORD}
+
+var ErrUnauthorized = fmt.Errorf("Missing or invalid credentials")
+var ErrForbidden = fmt.Errorf("Credentials do not grant the required scope")
+var ErrPairingScope = fmt.Errorf("Pairing only grants the read, write and password scopes")
+
+type Principal struct {
+	Name   string  `json:"name"`
+	Scopes []Scope `json:"scopes"`
+}
+
+func (p Principal) HasScope(scope Scope) bool {
+	return slices.Contains(p.Scopes, scope) || slices.Contains(p.Scopes, SCOPE_ADMIN)
+}
+
+// StoredKey is an API key as persisted in the credentials file. Only the
+// SHA-256 of the key is kept.
+type StoredKey struct {
+	Name      string    `json:"name"`
+	Hash      string    `json:"hash"`
+	Scopes    []Scope   `json:"scopes"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// TokenClaims is the payload of a signed bearer token
+type TokenClaims struct {
+	Subject   string  `json:"sub"`
+	Scopes    []Scope `json:"scopes"`
+	ExpiresAt int64   `json:"exp"`
+}
+
+type Authenticator struct {
+	mtx             sync.Mutex
+	pairingMtx      sync.Mutex
+	keys            []StoredKey
+	tokenSecret     []byte
+	credentialsFile string
+	pairingCode     string
+	pairingExpires  time.Time
+	pairingAttempts int
+	eventTickets    map[string]eventTicket
+}
+
+// eventTicket stands in for a credential in the query string of GET /events,
+// where EventSource cannot send headers. It is single use and short lived so
+// a URL that ends up in a log or the browser history is worthless.
+type eventTicket struct {
+	principal Principal
+	expires   time.Time
+}
+
+// NewAuthenticator loads the paired keys from credentialsFile (if any) and
+// adds the keys configured statically
+func NewAuthenticator(credentialsFile string, tokenSecret string, staticKeys []StoredKey) (*Authenticator, error) {
+	a := &Authenticator{
+		tokenSecret:     []byte(tokenSecret),
+		credentialsFile: credentialsFile,
+	}
+	if credentialsFile != "" {
+		data, err := os.ReadFile(credentialsFile)
+		if err == nil {
+			err = json.Unmarshal(data, &a.keys)
+			if err != nil {
+				return nil, fmt.Errorf("Cannot parse credentials file %s: %w", credentialsFile, err)
+			}
+		} else if !os.IsNotExist(err) {
+			return nil, fmt.Errorf("Cannot read credentials file: %w", err)
+		}
+	}
+	a.keys = append(a.keys, staticKeys...)
+	return a, nil
+}
+
+func (a *Authenticator) CredentialsFile() string {
+	return a.credentialsFile
+}
+
+func HashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func ParseScopes(names []string) ([]Scope, error) {
+	var scopes []Scope
+	for _, name := range names {
+		scope := Scope(strings.ToLower(strings.TrimSpace(name)))
+		if !slices.Contains(ALL_SCOPES, scope) {
+			return nil, fmt.Errorf("Unknown scope %q", name)
+		}
+		scopes = append(scopes, scope)
+	}
+	return scopes, nil
+}
+
+// Authenticate resolves an API key or a signed bearer token to a principal
+func (a *Authenticator) Authenticate(credential string) (Principal, error) {
+	if credential == "" {
+		return Principal{}, ErrUnauthorized
+	}
+	if strings.HasPrefix(credential, API_KEY_PREFIX) {
+		hash := HashKey(credential)
+		a.mtx.Lock()
+		defer a.mtx.Unlock()
+		for _, key := range a.keys {
+			if subtle.ConstantTimeCompare([]byte(key.Hash), []byte(hash)) == 1 {
+				return Principal{Name: key.Name, Scopes: key.Scopes}, nil
+			}
+		}
+		return Principal{}, ErrUnauthorized
+	}
+	claims, err := a.VerifyToken(credential)
+	if err != nil {
+		return Principal{}, err
+	}
+	return Principal{Name: claims.Subject, Scopes: claims.Scopes}, nil
+}
+
+// SignToken creates a bearer token of the form base64url(claims).base64url(HMAC-SHA256)
+func (a *Authenticator) SignToken(claims TokenClaims) (string, error) {
+	if len(a.tokenSecret) == 0 {
+		return "", fmt.Errorf("No token secret configured")
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(a.mac(encoded)), nil
+}
+
+func (a *Authenticator) VerifyToken(token string) (TokenClaims, error) {
+	var claims TokenClaims
+	if len(a.tokenSecret) == 0 {
+		return claims, ErrUnauthorized
+	}
+	encoded, signature, found := strings.Cut(token, ".")
+	if !found {
+		return claims, ErrUnauthorized
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(mac, a.mac(encoded)) {
+		return claims, ErrUnauthorized
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return claims, ErrUnauthorized
+	}
+	err = json.Unmarshal(payload, &claims)
+	if err != nil {
+		return claims, ErrUnauthorized
+	}
+	if claims.ExpiresAt != 0 && time.Now().Unix() > claims.ExpiresAt {
+		return claims, fmt.Errorf("Token expired")
+	}
+	return claims, nil
+}
+
+func (a *Authenticator) mac(data string) []byte {
+	m := hmac.New(sha256.New, a.tokenSecret)
+	m.Write([]byte(data))
+	return m.Sum(nil)
+}
+
+// NewEventTicket returns a ticket that authenticates one GET /events request
+// as principal. Expired tickets are dropped here.
+func (a *Authenticator) NewEventTicket(principal Principal) (string, error) {
+	raw := make([]byte, 32)
+	_, err := rand.Read(raw)
+	if err != nil {
+		return "", err
+	}
+	ticket := base64.RawURLEncoding.EncodeToString(raw)
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	now := time.Now()
+	for key, t := range a.eventTickets {
+		if now.After(t.expires) {
+			delete(a.eventTickets, key)
+		}
+	}
+	if a.eventTickets == nil {
+		a.eventTickets = map[string]eventTicket{}
+	}
+	a.eventTickets[HashKey(ticket)] = eventTicket{principal: principal, expires: now.Add(EVENT_TICKET_LIFETIME)}
+	return ticket, nil
+}
+
+// RedeemEventTicket resolves a ticket created by NewEventTicket. A ticket
+// works once, whether or not it has expired.
+func (a *Authenticator) RedeemEventTicket(ticket string) (Principal, error) {
+	if ticket == "" {
+		return Principal{}, ErrUnauthorized
+	}
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	hash := HashKey(ticket)
+	t, ok := a.eventTickets[hash]
+	if !ok {
+		return Principal{}, ErrUnauthorized
+	}
+	delete(a.eventTickets, hash)
+	if time.Now().After(t.expires) {
+		return Principal{}, fmt.Errorf("Ticket expired")
+	}
+	return t.principal, nil
+}
+
+// NewPairingCode generates a new one time code that a frontend can exchange
+// for an API key. The previous code stops working.
+func (a *Authenticator) NewPairingCode() (string, error) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	return a.newPairingCodeLocked()
+}
+
+func (a *Authenticator) newPairingCodeLocked() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", err
+	}
+	a.pairingCode = fmt.Sprintf("%06d", n.Int64())
+	a.pairingExpires = time.Now().Add(PAIRING_CODE_LIFETIME)
+	a.pairingAttempts = 0
+	fmt.Printf("Pairing code: %s (valid for %s)\n", a.pairingCode, PAIRING_CODE_LIFETIME)
+	return a.pairingCode, nil
+}
+
+// Pair checks the pairing code and on success creates, stores and returns a
+// new API key. The key is only ever returned here. An expired code, or
+// MAX_PAIRING_ATTEMPTS wrong ones, disable pairing until NewPairingCode is
+// called from the console.
+func (a *Authenticator) Pair(code string, name string, scopes []Scope) (string, error) {
+	for _, scope := range scopes {
+		if !slices.Contains(PAIRING_SCOPES, scope) {
+			return "", ErrPairingScope
+		}
+	}
+
+	a.pairingMtx.Lock()
+	defer a.pairingMtx.Unlock()
+	time.Sleep(PAIRING_ATTEMPT_DELAY)
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	if a.pairingCode == "" {
+		return "", fmt.Errorf("Pairing is disabled, create a new code on the proxy console")
+	}
+	if time.Now().After(a.pairingExpires) {
+		a.pairingCode = ""
+		return "", fmt.Errorf("Pairing code expired, create a new one on the proxy console")
+	}
+	if subtle.ConstantTimeCompare([]byte(code), []byte(a.pairingCode)) != 1 {
+		a.pairingAttempts++
+		if a.pairingAttempts >= MAX_PAIRING_ATTEMPTS {
+			a.pairingCode = ""
+			fmt.Printf("Pairing disabled after %d wrong codes, create a new code on the console\n", a.pairingAttempts)
+		}
+		return "", ErrUnauthorized
+	}
+	// Codes are single use
+	a.pairingCode = ""
+
+	raw := make([]byte, 32)
+	_, err := rand.Read(raw)
+	if err != nil {
+		return "", err
+	}
+	key := API_KEY_PREFIX + base64.RawURLEncoding.EncodeToString(raw)
+	a.keys = append(a.keys, StoredKey{
+		Name:      name,
+		Hash:      HashKey(key),
+		Scopes:    scopes,
+		CreatedAt: time.Now().UTC(),
+	})
+	err = a.saveLocked()
+	if err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+func (a *Authenticator) saveLocked() error {
+	if a.credentialsFile == "" {
+		return nil
+	}
+	var paired []StoredKey
+	for _, key := range a.keys {
+		// Static keys come from the config and are not persisted
+		if !key.CreatedAt.IsZero() {
+			paired = append(paired, key)
+		}
+	}
+	data, err := json.MarshalIndent(paired, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(a.credentialsFile), 0700)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(a.credentialsFile, data, 0600)
+}
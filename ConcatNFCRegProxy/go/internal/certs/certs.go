@@ -0,0 +1,305 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const CA_CERT_FILE = "ca.pem"
+const CA_KEY_FILE = "ca-key.pem"
+const LEAF_CERT_FILE = "localhost.pem"
+const LEAF_KEY_FILE = "localhost-key.pem"
+
+const CA_VALIDITY = 10 * 365 * 24 * time.Hour
+
+// LEAF_VALIDITY stays under the 398 day limit browsers enforce on server certificates
+const LEAF_VALIDITY = 90 * 24 * time.Hour
+
+// RENEW_BEFORE is how long before expiry a certificate is replaced
+const RENEW_BEFORE = 30 * 24 * time.Hour
+
+// CHECK_INTERVAL is how often the manager checks whether rotation is due
+const CHECK_INTERVAL = 12 * time.Hour
+
+// Manager keeps a local CA and a leaf certificate for the proxy hosts on disk
+// and rotates them before they expire
+type Manager struct {
+	mtx    sync.RWMutex
+	dir    string
+	hosts  []string
+	ca     *x509.Certificate
+	caKey  *ecdsa.PrivateKey
+	leaf   *tls.Certificate
+	expiry time.Time
+}
+
+// NewManager loads the CA and leaf from dir, generating whatever is missing or due for renewal
+func NewManager(dir string, hosts []string) (*Manager, error) {
+	m := &Manager{
+		dir:   dir,
+		hosts: hosts,
+	}
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	err = m.Rotate(time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Rotate regenerates the CA and the leaf if they expire within RENEW_BEFORE of now
+func (m *Manager) Rotate(now time.Time) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	if m.ca == nil {
+		ca, caKey, err := loadPair(filepath.Join(m.dir, CA_CERT_FILE), filepath.Join(m.dir, CA_KEY_FILE))
+		if err == nil {
+			m.ca = ca
+			m.caKey = caKey
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+	newCA := false
+	replaced := ""
+	if m.ca != nil && now.Add(RENEW_BEFORE).After(m.ca.NotAfter) {
+		replaced = "expires on " + m.ca.NotAfter.Format(time.RFC3339)
+	} else if m.ca != nil && !m.constrainedTo(m.ca) {
+		replaced = fmt.Sprintf("is not restricted to the hosts %v", m.hosts)
+	}
+	if m.ca == nil || replaced != "" {
+		err := m.generateCA(now)
+		if err != nil {
+			return err
+		}
+		newCA = true
+		if replaced == "" {
+			fmt.Printf("Generated a new local CA in %s. Install it with the export-ca command\n", m.dir)
+		} else {
+			fmt.Printf("\n*** WARNING: the local CA in %s %s and was replaced ***\n"+
+				"*** Clients reject the proxy until the new CA is installed with the export-ca command ***\n"+
+				"*** Remove the old CA from every trust store it was added to ***\n\n", m.dir, replaced)
+		}
+	}
+
+	if m.leaf == nil && !newCA {
+		leaf, err := tls.LoadX509KeyPair(filepath.Join(m.dir, LEAF_CERT_FILE), filepath.Join(m.dir, LEAF_KEY_FILE))
+		if err == nil && leaf.Leaf != nil && leaf.Leaf.CheckSignatureFrom(m.ca) == nil {
+			m.leaf = &leaf
+			m.expiry = leaf.Leaf.NotAfter
+		}
+	}
+	if newCA || m.leaf == nil || now.Add(RENEW_BEFORE).After(m.expiry) {
+		err := m.generateLeaf(now)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Generated a new TLS certificate for %v valid until %s\n", m.hosts, m.expiry.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// RotateRoutine periodically calls Rotate. It never returns.
+func (m *Manager) RotateRoutine() {
+	for {
+		time.Sleep(CHECK_INTERVAL)
+		err := m.Rotate(time.Now())
+		if err != nil {
+			fmt.Printf("Failed to rotate TLS certificates: %s\n", err.Error())
+		}
+	}
+}
+
+// GetCertificate is meant for tls.Config so rotated certificates are picked up without a restart
+func (m *Manager) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	return m.leaf, nil
+}
+
+func (m *Manager) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: m.GetCertificate,
+	}
+}
+
+// CAPEM returns the CA certificate so it can be installed in the trust store
+func (m *Manager) CAPEM() []byte {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: m.ca.Raw})
+}
+
+func (m *Manager) generateCA(now time.Time) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	template := &x509.Certificate{
+		SerialNumber: randomSerial(),
+		Subject: pkix.Name{
+			Organization: []string{"ConCat"},
+			CommonName:   "ConcatNFCRegProxy local CA",
+		},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(CA_VALIDITY),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+		// Installed in trust stores, so the key must not be able to vouch
+		// for any site other than the proxy
+		PermittedDNSDomainsCritical: true,
+	}
+	template.PermittedDNSDomains, template.PermittedIPRanges = m.permittedNames()
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		return err
+	}
+	err = writePair(filepath.Join(m.dir, CA_CERT_FILE), filepath.Join(m.dir, CA_KEY_FILE), der, key)
+	if err != nil {
+		return err
+	}
+	m.ca = ca
+	m.caKey = key
+	return nil
+}
+
+// permittedNames splits the hosts into the name constraints of the CA
+func (m *Manager) permittedNames() ([]string, []*net.IPNet) {
+	var domains []string
+	var ranges []*net.IPNet
+	for _, host := range m.hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			bits := 8 * len(ip)
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 32
+			}
+			ranges = append(ranges, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		} else {
+			domains = append(domains, host)
+		}
+	}
+	return domains, ranges
+}
+
+// constrainedTo reports whether ca carries the name constraints of the
+// current hosts, so a CA without them or made for other hosts is replaced
+func (m *Manager) constrainedTo(ca *x509.Certificate) bool {
+	domains, ranges := m.permittedNames()
+	if !ca.PermittedDNSDomainsCritical || len(ca.PermittedDNSDomains) != len(domains) || len(ca.PermittedIPRanges) != len(ranges) {
+		return false
+	}
+	for idx, domain := range domains {
+		if !strings.EqualFold(ca.PermittedDNSDomains[idx], domain) {
+			return false
+		}
+	}
+	for idx, r := range ranges {
+		if ca.PermittedIPRanges[idx].String() != r.String() {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *Manager) generateLeaf(now time.Time) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	template := &x509.Certificate{
+		SerialNumber: randomSerial(),
+		Subject: pkix.Name{
+			Organization: []string{"ConCat"},
+			CommonName:   m.hosts[0],
+		},
+		NotBefore:   now.Add(-time.Hour),
+		NotAfter:    now.Add(LEAF_VALIDITY),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, host := range m.hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, m.ca, &key.PublicKey, m.caKey)
+	if err != nil {
+		return err
+	}
+	err = writePair(filepath.Join(m.dir, LEAF_CERT_FILE), filepath.Join(m.dir, LEAF_KEY_FILE), der, key)
+	if err != nil {
+		return err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return err
+	}
+	m.leaf = &tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}
+	m.expiry = leaf.NotAfter
+	return nil
+}
+
+func randomSerial() *big.Int {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return big.NewInt(time.Now().UnixNano())
+	}
+	return serial
+}
+
+func writePair(certFile string, keyFile string, der []byte, key *ecdsa.PrivateKey) error {
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer}), 0600)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+func loadPair(certFile string, keyFile string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		if _, statErr := os.Stat(certFile); os.IsNotExist(statErr) {
+			return nil, nil, statErr
+		}
+		return nil, nil, err
+	}
+	key, ok := pair.PrivateKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, nil, fmt.Errorf("%s is not an ECDSA key", keyFile)
+	}
+	return pair.Leaf, key, nil
+}
@@ -0,0 +1,75 @@
+package certs
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGenerateAndRotate(t *testing.T) {
+	dir := t.TempDir()
+	m, err := NewManager(dir, []string{"localhost", "127.0.0.1", "::1"})
+	assert.NoError(t, err)
+
+	leaf, err := m.GetCertificate(nil)
+	assert.NoError(t, err)
+	pool := x509.NewCertPool()
+	assert.True(t, pool.AppendCertsFromPEM(m.CAPEM()))
+	for _, host := range []string{"localhost", "127.0.0.1", "::1"} {
+		_, err = leaf.Leaf.Verify(x509.VerifyOptions{DNSName: host, Roots: pool})
+		assert.NoError(t, err, host)
+	}
+
+	// A restart reuses the files on disk
+	reloaded, err := NewManager(dir, []string{"localhost", "127.0.0.1", "::1"})
+	assert.NoError(t, err)
+	reloadedLeaf, _ := reloaded.GetCertificate(nil)
+	assert.Equal(t, leaf.Leaf.SerialNumber, reloadedLeaf.Leaf.SerialNumber)
+	assert.Equal(t, m.CAPEM(), reloaded.CAPEM())
+
+	// Nothing to do while the leaf is far from expiring
+	assert.NoError(t, m.Rotate(time.Now().Add(LEAF_VALIDITY-RENEW_BEFORE-24*time.Hour)))
+	current, _ := m.GetCertificate(nil)
+	assert.Equal(t, leaf.Leaf.SerialNumber, current.Leaf.SerialNumber)
+
+	// The leaf is renewed before it expires, under the same CA
+	assert.NoError(t, m.Rotate(time.Now().Add(LEAF_VALIDITY-RENEW_BEFORE+24*time.Hour)))
+	rotated, _ := m.GetCertificate(nil)
+	assert.NotEqual(t, leaf.Leaf.SerialNumber, rotated.Leaf.SerialNumber)
+	assert.Equal(t, reloaded.CAPEM(), m.CAPEM())
+}
+
+func TestNameConstraints(t *testing.T) {
+	dir := t.TempDir()
+	hosts := []string{"localhost", "127.0.0.1", "::1"}
+	m, err := NewManager(dir, hosts)
+	assert.NoError(t, err)
+	assert.True(t, m.ca.PermittedDNSDomainsCritical)
+	assert.Equal(t, []string{"localhost"}, m.ca.PermittedDNSDomains)
+	assert.Len(t, m.ca.PermittedIPRanges, 2)
+
+	// A certificate the CA key signs for any other site is refused
+	pool := x509.NewCertPool()
+	assert.True(t, pool.AppendCertsFromPEM(m.CAPEM()))
+	m.hosts = []string{"bank.example", "10.0.0.1"}
+	assert.NoError(t, m.generateLeaf(time.Now()))
+	for _, host := range m.hosts {
+		_, err = m.leaf.Leaf.Verify(x509.VerifyOptions{DNSName: host, Roots: pool})
+		assert.Error(t, err, host)
+	}
+
+	// A CA that does not match the hosts is replaced, along with its leaf
+	caPEM := m.CAPEM()
+	assert.NoError(t, m.Rotate(time.Now()))
+	assert.NotEqual(t, caPEM, m.CAPEM())
+	assert.Equal(t, []string{"bank.example"}, m.ca.PermittedDNSDomains)
+
+	// and so is one about to expire
+	reloaded, err := NewManager(dir, m.hosts)
+	assert.NoError(t, err)
+	assert.Equal(t, m.CAPEM(), reloaded.CAPEM())
+	assert.NoError(t, reloaded.Rotate(time.Now().Add(CA_VALIDITY-RENEW_BEFORE+24*time.Hour)))
+	assert.NotEqual(t, m.CAPEM(), reloaded.CAPEM())
+}
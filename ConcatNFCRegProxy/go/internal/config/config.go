@@ -0,0 +1,694 @@
+package config
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"ConcatNFCRegProxy/internal/auth"
+	"ConcatNFCRegProxy/internal/logging"
+	"ConcatNFCRegProxy/internal/ndef"
+	"ConcatNFCRegProxy/internal/password"
+	"ConcatNFCRegProxy/internal/tags"
+
+	"gopkg.in/yaml.v3"
+)
+
+const ENV_PREFIX = "CONCATNFC_"
+
+const REDACTED = "REDACTED"
+
+// DEFAULT_START_PAGE is the first page of the password protected ConCat data
+const DEFAULT_START_PAGE byte = 0x10
+
+// Duration wraps time.Duration so it can be written as "1s" or "500ms" in the
+// config file, environment and in the verbose healthcheck output
+type Duration time.Duration
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	parsed, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) Std() time.Duration {
+	return time.Duration(d)
+}
+
+type Readers struct {
+	// Include and Exclude are case insensitive. A pattern without glob
+	// characters matches any reader name containing it.
+	Include []string `yaml:"include" json:"include"`
+	Exclude []string `yaml:"exclude" json:"exclude"`
+}
+
+type CORS struct {
+	AllowedOrigins []string `yaml:"allowedOrigins" json:"allowedOrigins"`
+	// AllowedHosts lists the accepted Host header values, without port
+	AllowedHosts []string `yaml:"allowedHosts" json:"allowedHosts"`
+	// AllowPrivateNetwork answers Private Network Access preflights
+	AllowPrivateNetwork bool `yaml:"allowPrivateNetwork" json:"allowPrivateNetwork"`
+}
+
+type Layout struct {
+	StartPage byte `yaml:"startPage" json:"startPage"`
+	// NDEFURL is written as an NDEF URI record on the pages below StartPage,
+	// which phones read without the password. Empty leaves them untouched.
+	NDEFURL string `yaml:"ndefUrl" json:"ndefUrl"`
+}
+
+type Timeouts struct {
+	ReadHeader     Duration `yaml:"readHeader" json:"readHeader"`
+	AuthRetryDelay Duration `yaml:"authRetryDelay" json:"authRetryDelay"`
+	ReaderPoll     Duration `yaml:"readerPoll" json:"readerPoll"`
+	ConnectRetries int      `yaml:"connectRetries" json:"connectRetries"`
+}
+
+type APIKey struct {
+	Name   string   `yaml:"name" json:"name"`
+	Key    string   `yaml:"key" json:"key" redact:"true"`
+	Scopes []string `yaml:"scopes" json:"scopes"`
+}
+
+type Auth struct {
+	// Enabled makes every card endpoint require an API key or bearer token
+	Enabled bool     `yaml:"enabled" json:"enabled"`
+	Keys    []APIKey `yaml:"keys" json:"keys"`
+	// TokenSecret is the HMAC-SHA256 secret used to verify signed bearer tokens
+	TokenSecret string `yaml:"tokenSecret" json:"tokenSecret" redact:"true"`
+	// CredentialsFile stores the keys created by pairing a frontend
+	CredentialsFile string `yaml:"credentialsFile" json:"credentialsFile"`
+}
+
+type TLS struct {
+	// Enabled serves HTTPS on Listen, using a leaf certificate for the
+	// allowed hosts issued by a locally generated CA
+	Enabled bool     `yaml:"enabled" json:"enabled"`
+	Listen  []string `yaml:"listen" json:"listen"`
+	// Dir holds the CA and leaf certificates and keys
+	Dir string `yaml:"dir" json:"dir"`
+}
+
+type Signature struct {
+	// PublicKeyFile is a JWK or JWKS with the keys cards are signed with
+	PublicKeyFile string `yaml:"publicKeyFile" json:"publicKeyFile"`
+	// VerifyOnRead adds signatureValid to every /read response
+	VerifyOnRead bool `yaml:"verifyOnRead" json:"verifyOnRead"`
+	// RejectInvalid refuses writes whose signature does not verify
+	RejectInvalid bool `yaml:"rejectInvalid" json:"rejectInvalid"`
+	// MinPayloadVersion is the oldest signed payload accepted. 2 refuses
+	// signatures that do not cover the card UID.
+	MinPayloadVersion int `yaml:"minPayloadVersion" json:"minPayloadVersion"`
+	// PrivateKeyFile is a PEM P-256 key used to sign writes that carry no
+	// signature, when the registration backend is unreachable
+	PrivateKeyFile string `yaml:"privateKeyFile" json:"privateKeyFile"`
+	// PrivateKeyPassphrase decrypts an ENCRYPTED PRIVATE KEY file
+	PrivateKeyPassphrase string `yaml:"privateKeyPassphrase" json:"privateKeyPassphrase" redact:"true"`
+	// KeyId names the private key, defaults to its JWK thumbprint
+	KeyId string `yaml:"keyId" json:"keyId"`
+	// IssuanceLog records every card signed with the private key, one JSON
+	// object per line
+	IssuanceLog string `yaml:"issuanceLog" json:"issuanceLog"`
+}
+
+type Passwords struct {
+	// Provider resolves the card password of requests without one: static,
+	// derive or http. Empty requires the password in every request.
+	Provider string `yaml:"provider" json:"provider"`
+	// Static is the password of every card, for testing
+	Static uint32 `yaml:"static" json:"static" redact:"true"`
+	// Secret is the master secret passwords are derived from with HKDF-SHA256
+	Secret string `yaml:"secret" json:"secret" redact:"true"`
+	// URL is the lookup endpoint, {uuid} is replaced by the card UID
+	URL string `yaml:"url" json:"url"`
+	// Token is sent to URL as a bearer token
+	Token   string   `yaml:"token" json:"token" redact:"true"`
+	Timeout Duration `yaml:"timeout" json:"timeout"`
+}
+
+// CustomTag declares an extra tag stored on the card. Its value is exposed
+// in the "custom" object of the card definition under Field.
+type CustomTag struct {
+	Id      byte   `yaml:"id" json:"id"`
+	Name    string `yaml:"name" json:"name"`
+	Type    string `yaml:"type" json:"type"`
+	Field   string `yaml:"field" json:"field"`
+	Sizes   []int  `yaml:"sizes" json:"sizes"`
+	MaxSize int    `yaml:"maxSize" json:"maxSize"`
+}
+
+func (custom CustomTag) Definition() (tags.TagDefinition, error) {
+	valueType, err := tags.ParseValueType(custom.Type)
+	if err != nil {
+		return tags.TagDefinition{}, err
+	}
+	return tags.TagDefinition{
+		Id:      custom.Id,
+		Name:    custom.Name,
+		Type:    valueType,
+		Fields:  []string{custom.Field},
+		Sizes:   custom.Sizes,
+		MaxSize: custom.MaxSize,
+	}, nil
+}
+
+type Tags struct {
+	Custom []CustomTag `yaml:"custom" json:"custom"`
+	// Format of written cards: tlv, or cose for a COSE_Sign1 message over a
+	// CBOR map. Both formats are read.
+	Format string `yaml:"format" json:"format"`
+	// RejectUnknownCritical refuses cards carrying unknown tags with the
+	// critical bit (0x80) set instead of returning them as unknown tags
+	RejectUnknownCritical bool `yaml:"rejectUnknownCritical" json:"rejectUnknownCritical"`
+}
+
+type Envelope struct {
+	// Key is the convention master key, 32 bytes in hex. Cards sealed in an
+	// envelope are opened on read whenever it is set.
+	Key string `yaml:"key" json:"key" redact:"true"`
+	// Encrypt seals the tags of every write in an envelope
+	Encrypt bool `yaml:"encrypt" json:"encrypt"`
+}
+
+type Config struct {
+	Listen    []string  `yaml:"listen" json:"listen"`
+	Readers   Readers   `yaml:"readers" json:"readers"`
+	CORS      CORS      `yaml:"cors" json:"cors"`
+	Layout    Layout    `yaml:"layout" json:"layout"`
+	Timeouts  Timeouts  `yaml:"timeouts" json:"timeouts"`
+	LogLevel  string    `yaml:"logLevel" json:"logLevel"`
+	Auth      Auth      `yaml:"auth" json:"auth"`
+	TLS       TLS       `yaml:"tls" json:"tls"`
+	Tags      Tags      `yaml:"tags" json:"tags"`
+	Signature Signature `yaml:"signature" json:"signature"`
+	Passwords Passwords `yaml:"passwords" json:"passwords"`
+	Envelope  Envelope  `yaml:"envelope" json:"envelope"`
+}
+
+func Default() *Config {
+	return &Config{
+		Listen: []string{":7070"},
+		Readers: Readers{
+			Exclude: []string{"yubico"},
+		},
+		CORS: CORS{
+			AllowedOrigins:      []string{"*"},
+			AllowedHosts:        []string{"localhost", "127.0.0.1", "::1"},
+			AllowPrivateNetwork: true,
+		},
+		Layout: Layout{
+			StartPage: DEFAULT_START_PAGE,
+		},
+		Timeouts: Timeouts{
+			ReadHeader:     Duration(10 * time.Second),
+			AuthRetryDelay: Duration(1000 * time.Millisecond),
+			ReaderPoll:     Duration(1 * time.Second),
+			ConnectRetries: 4,
+		},
+		LogLevel: "info",
+		Auth: Auth{
+			Enabled:         true,
+			CredentialsFile: defaultPath("credentials.json"),
+		},
+		TLS: TLS{
+			Listen: []string{":7443"},
+			Dir:    defaultPath("tls"),
+		},
+		Tags: Tags{
+			Format:                tags.FORMAT_TLV,
+			RejectUnknownCritical: true,
+		},
+		Signature: Signature{
+			MinPayloadVersion: 1,
+			IssuanceLog:       defaultPath("offline-issuance.jsonl"),
+		},
+		Passwords: Passwords{
+			Timeout: Duration(5 * time.Second),
+		},
+	}
+}
+
+// defaultPath places a file in the user's config directory, falling back to
+// the working directory
+func defaultPath(name string) string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return name
+	}
+	return filepath.Join(dir, "ConcatNFCRegProxy", name)
+}
+
+// Load builds the configuration from the defaults, the config file, the
+// environment and the command line flags, in increasing order of priority
+func Load(args []string) (*Config, error) {
+	cfg := Default()
+
+	fs := flag.NewFlagSet("ConcatNFCRegProxy", flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv(ENV_PREFIX+"CONFIG"), "Path to a YAML or JSON configuration file")
+	listen := fs.String("listen", "", "Comma separated list of addresses to listen on")
+	readerInclude := fs.String("reader-include", "", "Comma separated list of reader name patterns to use")
+	readerExclude := fs.String("reader-exclude", "", "Comma separated list of reader name patterns to ignore")
+	corsOrigins := fs.String("cors-origins", "", "Comma separated list of allowed CORS origins")
+	allowedHosts := fs.String("allowed-hosts", "", "Comma separated list of allowed Host header values")
+	startPage := fs.Uint("start-page", 0, "First page of the card used for ConCat data")
+	ndefURL := fs.String("ndef-url", "", "URL written as an NDEF record below the ConCat data")
+	connectRetries := fs.Int("connect-retries", 0, "Number of attempts to connect to a card")
+	authRetryDelay := fs.Duration("auth-retry-delay", 0, "Delay before retrying a failed card authentication")
+	logLevel := fs.String("log-level", "", "Log level: debug, info, warn or error")
+	authEnabled := fs.Bool("auth", true, "Require an API key or bearer token on card endpoints")
+	tlsEnabled := fs.Bool("tls", false, "Also serve HTTPS with a locally generated CA")
+	tlsListen := fs.String("tls-listen", "", "Comma separated list of addresses to serve HTTPS on")
+	publicKey := fs.String("public-key", "", "JWK or JWKS file with the card signing keys")
+	rejectInvalid := fs.Bool("reject-invalid-signatures", false, "Refuse writes whose signature does not verify")
+	privateKey := fs.String("private-key", "", "PEM private key used to sign writes that carry no signature")
+	passwordProvider := fs.String("password-provider", "", "Resolve missing card passwords: static, derive or http")
+	encrypt := fs.Bool("encrypt", false, "Seal the card tags in an encrypted envelope on write")
+	cardFormat := fs.String("card-format", "", "Format of written cards: tlv or cose")
+	minPayloadVersion := fs.Int("min-payload-version", 0, "Oldest signed payload version accepted, 2 requires UID-bound signatures")
+	err := fs.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+
+	if *configFile != "" {
+		err = cfg.loadFile(*configFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = cfg.loadEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "listen":
+			cfg.Listen = splitList(*listen)
+		case "reader-include":
+			cfg.Readers.Include = splitList(*readerInclude)
+		case "reader-exclude":
+			cfg.Readers.Exclude = splitList(*readerExclude)
+		case "cors-origins":
+			cfg.CORS.AllowedOrigins = splitList(*corsOrigins)
+		case "allowed-hosts":
+			cfg.CORS.AllowedHosts = splitList(*allowedHosts)
+		case "start-page":
+			cfg.Layout.StartPage = byte(*startPage)
+			if *startPage > 0xff {
+				err = fmt.Errorf("start-page must fit in a byte")
+			}
+		case "ndef-url":
+			cfg.Layout.NDEFURL = *ndefURL
+		case "connect-retries":
+			cfg.Timeouts.ConnectRetries = *connectRetries
+		case "auth-retry-delay":
+			cfg.Timeouts.AuthRetryDelay = Duration(*authRetryDelay)
+		case "log-level":
+			cfg.LogLevel = *logLevel
+		case "auth":
+			cfg.Auth.Enabled = *authEnabled
+		case "tls":
+			cfg.TLS.Enabled = *tlsEnabled
+		case "tls-listen":
+			cfg.TLS.Listen = splitList(*tlsListen)
+		case "public-key":
+			cfg.Signature.PublicKeyFile = *publicKey
+		case "reject-invalid-signatures":
+			cfg.Signature.RejectInvalid = *rejectInvalid
+		case "private-key":
+			cfg.Signature.PrivateKeyFile = *privateKey
+		case "min-payload-version":
+			cfg.Signature.MinPayloadVersion = *minPayloadVersion
+		case "password-provider":
+			cfg.Passwords.Provider = *passwordProvider
+		case "encrypt":
+			cfg.Envelope.Encrypt = *encrypt
+		case "card-format":
+			cfg.Tags.Format = *cardFormat
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = cfg.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (cfg *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Cannot read config file: %w", err)
+	}
+	err = yaml.Unmarshal(data, cfg)
+	if err != nil {
+		return fmt.Errorf("Cannot parse config file %s: %w", path, err)
+	}
+	return nil
+}
+
+func (cfg *Config) loadEnv() error {
+	var err error
+	if val, ok := os.LookupEnv(ENV_PREFIX + "LISTEN"); ok {
+		cfg.Listen = splitList(val)
+	}
+	if val, ok := os.LookupEnv(ENV_PREFIX + "READER_INCLUDE"); ok {
+		cfg.Readers.Include = splitList(val)
+	}
+	if val, ok := os.LookupEnv(ENV_PREFIX + "READER_EXCLUDE"); ok {
+		cfg.Readers.Exclude = splitList(val)
+	}
+	if val, ok := os.LookupEnv(ENV_PREFIX + "CORS_ORIGINS"); ok {
+		cfg.CORS.AllowedOrigins = splitList(val)
+	}
+	if val, ok := os.LookupEnv(ENV_PREFIX + "ALLOWED_HOSTS"); ok {
+		cfg.CORS.AllowedHosts = splitList(val)
+	}
+	if val, ok := os.LookupEnv(ENV_PREFIX + "START_PAGE"); ok {
+		page, err := strconv.ParseUint(val, 0, 8)
+		if err != nil {
+			return fmt.Errorf("Invalid %sSTART_PAGE: %w", ENV_PREFIX, err)
+		}
+		cfg.Layout.StartPage = byte(page)
+	}
+	if val, ok := os.LookupEnv(ENV_PREFIX + "NDEF_URL"); ok {
+		cfg.Layout.NDEFURL = val
+	}
+	if val, ok := os.LookupEnv(ENV_PREFIX + "CONNECT_RETRIES"); ok {
+		cfg.Timeouts.ConnectRetries, err = strconv.Atoi(val)
+		if err != nil {
+			return fmt.Errorf("Invalid %sCONNECT_RETRIES: %w", ENV_PREFIX, err)
+		}
+	}
+	if val, ok := os.LookupEnv(ENV_PREFIX + "AUTH_RETRY_DELAY"); ok {
+		err = cfg.Timeouts.AuthRetryDelay.UnmarshalText([]byte(val))
+		if err != nil {
+			return fmt.Errorf("Invalid %sAUTH_RETRY_DELAY: %w", ENV_PREFIX, err)
+		}
+	}
+	if val, ok := os.LookupEnv(ENV_PREFIX + "LOG_LEVEL"); ok {
+		cfg.LogLevel = val
+	}
+	if val, ok := os.LookupEnv(ENV_PREFIX + "AUTH_ENABLED"); ok {
+		cfg.Auth.Enabled, err = strconv.ParseBool(val)
+		if err != nil {
+			return fmt.Errorf("Invalid %sAUTH_ENABLED: %w", ENV_PREFIX, err)
+		}
+	}
+	if val, ok := os.LookupEnv(ENV_PREFIX + "AUTH_TOKEN_SECRET"); ok {
+		cfg.Auth.TokenSecret = val
+	}
+	if val, ok := os.LookupEnv(ENV_PREFIX + "TLS_ENABLED"); ok {
+		cfg.TLS.Enabled, err = strconv.ParseBool(val)
+		if err != nil {
+			return fmt.Errorf("Invalid %sTLS_ENABLED: %w", ENV_PREFIX, err)
+		}
+	}
+	if val, ok := os.LookupEnv(ENV_PREFIX + "TLS_LISTEN"); ok {
+		cfg.TLS.Listen = splitList(val)
+	}
+	if val, ok := os.LookupEnv(ENV_PREFIX + "REJECT_UNKNOWN_CRITICAL"); ok {
+		cfg.Tags.RejectUnknownCritical, err = strconv.ParseBool(val)
+		if err != nil {
+			return fmt.Errorf("Invalid %sREJECT_UNKNOWN_CRITICAL: %w", ENV_PREFIX, err)
+		}
+	}
+	if val, ok := os.LookupEnv(ENV_PREFIX + "PUBLIC_KEY_FILE"); ok {
+		cfg.Signature.PublicKeyFile = val
+	}
+	if val, ok := os.LookupEnv(ENV_PREFIX + "REJECT_INVALID_SIGNATURES"); ok {
+		cfg.Signature.RejectInvalid, err = strconv.ParseBool(val)
+		if err != nil {
+			return fmt.Errorf("Invalid %sREJECT_INVALID_SIGNATURES: %w", ENV_PREFIX, err)
+		}
+	}
+	if val, ok := os.LookupEnv(ENV_PREFIX + "PRIVATE_KEY_FILE"); ok {
+		cfg.Signature.PrivateKeyFile = val
+	}
+	if val, ok := os.LookupEnv(ENV_PREFIX + "PRIVATE_KEY_PASSPHRASE"); ok {
+		cfg.Signature.PrivateKeyPassphrase = val
+	}
+	if val, ok := os.LookupEnv(ENV_PREFIX + "MIN_PAYLOAD_VERSION"); ok {
+		cfg.Signature.MinPayloadVersion, err = strconv.Atoi(val)
+		if err != nil {
+			return fmt.Errorf("Invalid %sMIN_PAYLOAD_VERSION: %w", ENV_PREFIX, err)
+		}
+	}
+	if val, ok := os.LookupEnv(ENV_PREFIX + "PASSWORD_PROVIDER"); ok {
+		cfg.Passwords.Provider = val
+	}
+	if val, ok := os.LookupEnv(ENV_PREFIX + "PASSWORD_SECRET"); ok {
+		cfg.Passwords.Secret = val
+	}
+	if val, ok := os.LookupEnv(ENV_PREFIX + "PASSWORD_URL"); ok {
+		cfg.Passwords.URL = val
+	}
+	if val, ok := os.LookupEnv(ENV_PREFIX + "PASSWORD_TOKEN"); ok {
+		cfg.Passwords.Token = val
+	}
+	if val, ok := os.LookupEnv(ENV_PREFIX + "CARD_FORMAT"); ok {
+		cfg.Tags.Format = val
+	}
+	if val, ok := os.LookupEnv(ENV_PREFIX + "ENVELOPE_KEY"); ok {
+		cfg.Envelope.Key = val
+	}
+	if val, ok := os.LookupEnv(ENV_PREFIX + "ENVELOPE_ENCRYPT"); ok {
+		cfg.Envelope.Encrypt, err = strconv.ParseBool(val)
+		if err != nil {
+			return fmt.Errorf("Invalid %sENVELOPE_ENCRYPT: %w", ENV_PREFIX, err)
+		}
+	}
+	return nil
+}
+
+func (cfg *Config) Validate() error {
+	if len(cfg.Listen) == 0 {
+		return fmt.Errorf("At least one listen address is required")
+	}
+	for _, pattern := range append(append([]string{}, cfg.Readers.Include...), cfg.Readers.Exclude...) {
+		_, err := filepath.Match(strings.ToLower(pattern), "")
+		if err != nil {
+			return fmt.Errorf("Invalid reader pattern %q: %w", pattern, err)
+		}
+	}
+	if len(cfg.CORS.AllowedOrigins) == 0 {
+		return fmt.Errorf("At least one CORS origin is required")
+	}
+	// Any web page could drive the card endpoints otherwise
+	if !cfg.Auth.Enabled && slices.Contains(cfg.CORS.AllowedOrigins, "*") {
+		return fmt.Errorf("Authentication can only be disabled when the CORS origins are listed explicitly")
+	}
+	if len(cfg.CORS.AllowedHosts) == 0 {
+		return fmt.Errorf("At least one allowed host is required")
+	}
+	// Pages 0-3 hold the UID, lock bytes and capability container
+	if cfg.Layout.StartPage < 0x04 {
+		return fmt.Errorf("Layout start page must be at least 0x04, got 0x%x", cfg.Layout.StartPage)
+	}
+	if cfg.Layout.NDEFURL != "" {
+		_, err := ndef.Area(cfg.Layout.NDEFURL, ndef.AreaSize(cfg.Layout.StartPage))
+		if err != nil {
+			return err
+		}
+	}
+	if cfg.Timeouts.ConnectRetries < 1 {
+		return fmt.Errorf("Connect retries must be at least 1")
+	}
+	if cfg.Timeouts.AuthRetryDelay < 0 || cfg.Timeouts.ReadHeader < 0 || cfg.Timeouts.ReaderPoll <= 0 {
+		return fmt.Errorf("Timeouts must be positive")
+	}
+	_, err := logging.ParseLevel(cfg.LogLevel)
+	if err != nil {
+		return err
+	}
+	for _, key := range cfg.Auth.Keys {
+		if !strings.HasPrefix(key.Key, auth.API_KEY_PREFIX) {
+			return fmt.Errorf("API key %q must start with %s", key.Name, auth.API_KEY_PREFIX)
+		}
+		_, err = auth.ParseScopes(key.Scopes)
+		if err != nil {
+			return fmt.Errorf("API key %q: %w", key.Name, err)
+		}
+	}
+	if cfg.Auth.TokenSecret != "" && len(cfg.Auth.TokenSecret) < 32 {
+		return fmt.Errorf("Auth token secret must be at least 32 characters")
+	}
+	if cfg.TLS.Enabled {
+		if len(cfg.TLS.Listen) == 0 || cfg.TLS.Dir == "" {
+			return fmt.Errorf("TLS needs at least one listen address and a certificate directory")
+		}
+		if len(cfg.CertificateHosts()) == 0 {
+			return fmt.Errorf("TLS needs at least one allowed host that is not a wildcard")
+		}
+	}
+	if (cfg.Signature.VerifyOnRead || cfg.Signature.RejectInvalid) && cfg.Signature.PublicKeyFile == "" {
+		return fmt.Errorf("Signature verification needs a public key file")
+	}
+	if cfg.Signature.MinPayloadVersion < 1 || cfg.Signature.MinPayloadVersion > 2 {
+		return fmt.Errorf("Minimum payload version must be 1 or 2")
+	}
+	if cfg.Signature.PrivateKeyFile != "" && cfg.Signature.IssuanceLog == "" {
+		return fmt.Errorf("Offline signing needs an issuance log")
+	}
+	switch cfg.Passwords.Provider {
+	case "":
+	case password.PROVIDER_STATIC:
+		if cfg.Passwords.Static == 0 || cfg.Passwords.Static == password.FACTORY_PASSWORD {
+			return fmt.Errorf("The static password provider needs a password other than 0 and 0xffffffff")
+		}
+	case password.PROVIDER_DERIVE:
+		if len(cfg.Passwords.Secret) < 32 {
+			return fmt.Errorf("Password secret must be at least 32 characters")
+		}
+	case password.PROVIDER_HTTP:
+		if !strings.Contains(cfg.Passwords.URL, password.PLACEHOLDER_UUID) {
+			return fmt.Errorf("Password lookup URL must contain %s", password.PLACEHOLDER_UUID)
+		}
+		if cfg.Passwords.Timeout <= 0 {
+			return fmt.Errorf("Timeouts must be positive")
+		}
+	default:
+		return fmt.Errorf("Unknown password provider %q, use static, derive or http", cfg.Passwords.Provider)
+	}
+	if cfg.Tags.Format != tags.FORMAT_TLV && cfg.Tags.Format != tags.FORMAT_COSE {
+		return fmt.Errorf("Unknown card format %q, use tlv or cose", cfg.Tags.Format)
+	}
+	if cfg.Envelope.Key != "" {
+		key, err := hex.DecodeString(cfg.Envelope.Key)
+		if err != nil || len(key) != tags.ENVELOPE_KEY_SIZE {
+			return fmt.Errorf("Envelope key must be %d bytes in hex", tags.ENVELOPE_KEY_SIZE)
+		}
+	}
+	if cfg.Envelope.Encrypt && cfg.Envelope.Key == "" {
+		return fmt.Errorf("Encrypting cards needs an envelope key")
+	}
+	return nil
+}
+
+// EnvelopeKey returns the convention master key, nil when none is set
+func (cfg *Config) EnvelopeKey() []byte {
+	key, err := hex.DecodeString(cfg.Envelope.Key)
+	if err != nil || len(key) == 0 {
+		return nil
+	}
+	return key
+}
+
+// CertificateHosts lists the names the TLS certificate is issued for
+func (cfg *Config) CertificateHosts() []string {
+	var hosts []string
+	for _, host := range cfg.CORS.AllowedHosts {
+		if host != "*" {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+// MatchReader reports whether a reader should be used according to the
+// include and exclude patterns
+func (cfg *Config) MatchReader(name string) bool {
+	for _, pattern := range cfg.Readers.Exclude {
+		if matchPattern(pattern, name) {
+			return false
+		}
+	}
+	if len(cfg.Readers.Include) == 0 {
+		return true
+	}
+	for _, pattern := range cfg.Readers.Include {
+		if matchPattern(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchPattern(pattern string, name string) bool {
+	pattern = strings.ToLower(pattern)
+	name = strings.ToLower(name)
+	if !strings.ContainsAny(pattern, "*?[") {
+		return strings.Contains(name, pattern)
+	}
+	matched, _ := filepath.Match(pattern, name)
+	return matched
+}
+
+// Redacted returns a copy of the config where every field tagged with
+// `redact:"true"` is replaced, or zeroed when it is a number, so it can be
+// shown on /healthcheck
+func (cfg *Config) Redacted() *Config {
+	copied := *cfg
+	redactValue(reflect.ValueOf(&copied).Elem())
+	return &copied
+}
+
+func redactValue(v reflect.Value) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := v.Field(i)
+		if t.Field(i).Tag.Get("redact") == "true" {
+			switch field.Kind() {
+			case reflect.String:
+				if field.String() != "" {
+					field.SetString(REDACTED)
+				}
+			case reflect.Slice:
+				if field.Type().Elem().Kind() == reflect.String {
+					redacted := make([]string, field.Len())
+					for j := range redacted {
+						redacted[j] = REDACTED
+					}
+					field.Set(reflect.ValueOf(redacted))
+				}
+			case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+				reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+				field.SetZero()
+			}
+			continue
+		}
+		switch field.Kind() {
+		case reflect.Struct:
+			redactValue(field)
+		case reflect.Slice:
+			if field.Type().Elem().Kind() == reflect.Struct {
+				copied := reflect.MakeSlice(field.Type(), field.Len(), field.Len())
+				reflect.Copy(copied, field)
+				for j := 0; j < copied.Len(); j++ {
+					redactValue(copied.Index(j))
+				}
+				field.Set(copied)
+			}
+		}
+	}
+}
+
+func splitList(val string) []string {
+	var items []string
+	for _, item := range strings.Split(val, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,122 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(path, []byte(`
+listen: [":8080"]
+logLevel: debug
+timeouts:
+  authRetryDelay: 250ms
+`), 0600)
+	assert.NoError(t, err)
+
+	t.Setenv(ENV_PREFIX+"LOG_LEVEL", "warn")
+	t.Setenv(ENV_PREFIX+"START_PAGE", "0x12")
+
+	cfg, err := Load([]string{"-config", path, "-listen", "127.0.0.1:7070,[::1]:7070"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"127.0.0.1:7070", "[::1]:7070"}, cfg.Listen)
+	assert.Equal(t, "warn", cfg.LogLevel)
+	assert.Equal(t, byte(0x12), cfg.Layout.StartPage)
+	assert.Equal(t, 250*time.Millisecond, cfg.Timeouts.AuthRetryDelay.Std())
+	assert.Equal(t, 4, cfg.Timeouts.ConnectRetries)
+}
+
+func TestValidate(t *testing.T) {
+	cfg := Default()
+	assert.NoError(t, cfg.Validate())
+
+	cfg.Layout.StartPage = 0x02
+	assert.Error(t, cfg.Validate())
+
+	cfg = Default()
+	cfg.Layout.NDEFURL = "https://concat.app/schedule"
+	assert.NoError(t, cfg.Validate())
+	// The NDEF message has to fit in pages 0x04-0x05
+	cfg.Layout.StartPage = 0x06
+	assert.ErrorContains(t, cfg.Validate(), "only 8 fit")
+	cfg.Layout.StartPage = DEFAULT_START_PAGE
+	cfg.Layout.NDEFURL = "https://concat.app/t/{uid}x{counter}"
+	assert.NoError(t, cfg.Validate())
+	cfg.Layout.NDEFURL = "https://concat.app/t/{counter}/{uid}"
+	assert.Error(t, cfg.Validate())
+
+	// Authentication can only be turned off with explicit CORS origins
+	cfg = Default()
+	cfg.Auth.Enabled = false
+	assert.ErrorContains(t, cfg.Validate(), "CORS origins")
+	cfg.CORS.AllowedOrigins = []string{"https://reg.example.org"}
+	assert.NoError(t, cfg.Validate())
+
+	cfg = Default()
+	cfg.Passwords.Provider = "derive"
+	cfg.Passwords.Secret = "short"
+	assert.Error(t, cfg.Validate())
+	cfg.Passwords.Secret = "0123456789abcdef0123456789abcdef"
+	assert.NoError(t, cfg.Validate())
+	cfg.Passwords.Provider = "http"
+	cfg.Passwords.URL = "https://reg.example.org/api/badge/nfc/password"
+	assert.ErrorContains(t, cfg.Validate(), "{uuid}")
+	cfg.Passwords.Provider = "ldap"
+	assert.Error(t, cfg.Validate())
+
+	cfg = Default()
+	cfg.Envelope.Encrypt = true
+	assert.ErrorContains(t, cfg.Validate(), "envelope key")
+	cfg.Envelope.Key = "00112233"
+	assert.Error(t, cfg.Validate())
+	cfg.Envelope.Key = strings.Repeat("42", 32)
+	assert.NoError(t, cfg.Validate())
+	assert.Len(t, cfg.EnvelopeKey(), 32)
+	assert.Nil(t, Default().EnvelopeKey())
+
+	cfg = Default()
+	cfg.Tags.Format = "cose"
+	assert.NoError(t, cfg.Validate())
+	cfg.Tags.Format = "cbor"
+	assert.ErrorContains(t, cfg.Validate(), "card format")
+
+	cfg = Default()
+	cfg.LogLevel = "loud"
+	assert.Error(t, cfg.Validate())
+
+	cfg = Default()
+	cfg.Listen = nil
+	assert.Error(t, cfg.Validate())
+}
+
+func TestRedacted(t *testing.T) {
+	cfg := Default()
+	cfg.Passwords.Static = 0x12345678
+	cfg.Passwords.Token = "lookup-token"
+	cfg.Auth.Keys = []APIKey{{Name: "reg-desk-1", Key: "cnfc_secret", Scopes: []string{"read"}}}
+
+	redacted := cfg.Redacted()
+	assert.Zero(t, redacted.Passwords.Static)
+	assert.Equal(t, REDACTED, redacted.Passwords.Token)
+	assert.Equal(t, REDACTED, redacted.Auth.Keys[0].Key)
+	assert.Equal(t, "reg-desk-1", redacted.Auth.Keys[0].Name)
+	// The running config keeps its secrets
+	assert.Equal(t, uint32(0x12345678), cfg.Passwords.Static)
+	assert.Equal(t, "cnfc_secret", cfg.Auth.Keys[0].Key)
+}
+
+func TestMatchReader(t *testing.T) {
+	cfg := Default()
+	assert.True(t, cfg.MatchReader("ACS ACR122U PICC Interface 00 00"))
+	assert.False(t, cfg.MatchReader("Yubico YubiKey OTP+FIDO+CCID 00 00"))
+
+	cfg.Readers.Include = []string{"acs acr122u*"}
+	assert.True(t, cfg.MatchReader("ACS ACR122U PICC Interface 00 00"))
+	assert.False(t, cfg.MatchReader("Identiv uTrust 3700 F"))
+}
@@ -0,0 +1,59 @@
+package logging
+
+import (
+	"fmt"
+	"strings"
+)
+
+type Level int
+
+const (
+	LEVEL_DEBUG Level = iota
+	LEVEL_INFO
+	LEVEL_WARN
+	LEVEL_ERROR
+)
+
+var levelNames = map[string]Level{
+	"debug": LEVEL_DEBUG,
+	"info":  LEVEL_INFO,
+	"warn":  LEVEL_WARN,
+	"error": LEVEL_ERROR,
+}
+
+var currentLevel = LEVEL_INFO
+
+func ParseLevel(name string) (Level, error) {
+	level, ok := levelNames[strings.ToLower(name)]
+	if !ok {
+		return LEVEL_INFO, fmt.Errorf("Unknown log level %q", name)
+	}
+	return level, nil
+}
+
+func SetLevel(level Level) {
+	currentLevel = level
+}
+
+func logf(level Level, prefix string, format string, args ...any) {
+	if level < currentLevel {
+		return
+	}
+	fmt.Printf(prefix+format, args...)
+}
+
+func Debugf(format string, args ...any) {
+	logf(LEVEL_DEBUG, "[DEBUG] ", format, args...)
+}
+
+func Infof(format string, args ...any) {
+	logf(LEVEL_INFO, "", format, args...)
+}
+
+func Warnf(format string, args ...any) {
+	logf(LEVEL_WARN, "[WARN] ", format, args...)
+}
+
+func Errorf(format string, args ...any) {
+	logf(LEVEL_ERROR, "[ERROR] ", format, args...)
+}
@@ -0,0 +1,68 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "concatnfc"
+
+// NO_READER is used as the reader label when no reader is connected yet
+const NO_READER = "none"
+
+var CardReads = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "card_reads_total",
+	Help:      "Number of tag reads from a card, by result",
+}, []string{"reader", "result"})
+
+var CardWrites = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "card_writes_total",
+	Help:      "Number of tag writes to a card, by result",
+}, []string{"reader", "result"})
+
+var AuthFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "auth_failures_total",
+	Help:      "Number of failed PWD_AUTH attempts, by reason",
+}, []string{"reader", "reason"})
+
+var APDULatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: namespace,
+	Name:      "apdu_duration_seconds",
+	Help:      "Time taken by the reader to answer an APDU",
+	Buckets:   []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5},
+}, []string{"reader", "command"})
+
+var ConnectRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "connect_retries_total",
+	Help:      "Number of retries while connecting to and validating a card",
+}, []string{"reader"})
+
+var ReaderReconnects = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "reader_reconnects_total",
+	Help:      "Number of times the scard context was re-established after losing the reader",
+}, []string{"reader"})
+
+var SSESubscribers = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Name:      "sse_subscribers",
+	Help:      "Number of clients currently subscribed to /events",
+})
+
+var LockWait = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: namespace,
+	Name:      "lock_wait_seconds",
+	Help:      "Time spent waiting to acquire the reader lock",
+	Buckets:   []float64{0.001, 0.01, 0.1, 0.5, 1, 2.5, 5, 10, 30},
+}, []string{"reader"})
+
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
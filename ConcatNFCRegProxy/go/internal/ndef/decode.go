@@ -0,0 +1,229 @@
+package ndef
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"unicode/utf16"
+
+	"ConcatNFCRegProxy/types"
+)
+
+// ErrNoNDEF is returned for cards without an NDEF capability container
+var ErrNoNDEF = errors.New("No NDEF capability container")
+
+// ErrTruncated is returned when a TLV or record runs past the data
+var ErrTruncated = errors.New("NDEF data is truncated")
+
+// TLVs that can come before the NDEF message
+const TLV_LOCK_CONTROL byte = 0x01
+const TLV_MEMORY_CONTROL byte = 0x02
+const TLV_PROPRIETARY byte = 0xFD
+
+const (
+	FLAG_CF  byte = 0x20
+	FLAG_IL  byte = 0x08
+	TNF_MASK byte = 0x07
+)
+
+// Type name formats
+const (
+	TNF_EMPTY        byte = 0x00
+	TNF_MIME         byte = 0x02
+	TNF_ABSOLUTE_URI byte = 0x03
+	TNF_EXTERNAL     byte = 0x04
+)
+
+// RTD_TEXT is the record type of a Text record
+const RTD_TEXT = "T"
+
+// ParseCC decodes the capability container of page 3. The result has no
+// records yet.
+func ParseCC(cc []byte) (*types.NDEF, error) {
+	if len(cc) < 4 || cc[0] != CC_MAGIC {
+		return nil, ErrNoNDEF
+	}
+	return &types.NDEF{
+		Version:  fmt.Sprintf("%d.%d", cc[1]>>4, cc[1]&0x0f),
+		Size:     int(cc[2]) * 8,
+		ReadOnly: cc[3]&0x0f != 0,
+		Records:  []types.NDEFRecord{},
+	}, nil
+}
+
+// TLVLength returns the number of bytes of the data area up to the end of
+// the first NDEF message or the terminator. done is false while more data
+// is needed to tell.
+func TLVLength(data []byte) (length int, done bool) {
+	pos := 0
+	for pos < len(data) {
+		tlvType, _, next, err := readTLV(data, pos)
+		if err != nil {
+			return len(data), false
+		}
+		if tlvType == TLV_TERMINATOR || tlvType == TLV_NDEF {
+			return next, true
+		}
+		pos = next
+	}
+	return pos, false
+}
+
+// Decode returns the capability container cc and the records of the first
+// NDEF message of the data area
+func Decode(cc []byte, area []byte) (*types.NDEF, error) {
+	info, err := ParseCC(cc)
+	if err != nil {
+		return nil, err
+	}
+	pos := 0
+	for pos < len(area) {
+		tlvType, value, next, err := readTLV(area, pos)
+		if err != nil {
+			return nil, err
+		}
+		if tlvType == TLV_TERMINATOR {
+			break
+		}
+		if tlvType == TLV_NDEF {
+			info.Records, err = DecodeMessage(value)
+			if err != nil {
+				return nil, err
+			}
+			break
+		}
+		pos = next
+	}
+	return info, nil
+}
+
+// readTLV returns the TLV at pos and the position of the next one. NULL and
+// terminator TLVs have no length.
+func readTLV(data []byte, pos int) (byte, []byte, int, error) {
+	tlvType := data[pos]
+	if tlvType == TLV_NULL || tlvType == TLV_TERMINATOR {
+		return tlvType, nil, pos + 1, nil
+	}
+	if pos+1 >= len(data) {
+		return tlvType, nil, 0, ErrTruncated
+	}
+	length, header := int(data[pos+1]), 2
+	if length == 0xff {
+		if pos+3 >= len(data) {
+			return tlvType, nil, 0, ErrTruncated
+		}
+		length, header = int(binary.BigEndian.Uint16(data[pos+2:])), 4
+	}
+	end := pos + header + length
+	if end > len(data) {
+		return tlvType, nil, 0, ErrTruncated
+	}
+	return tlvType, data[pos+header : end], end, nil
+}
+
+// DecodeMessage decodes the records of an NDEF message
+func DecodeMessage(message []byte) ([]types.NDEFRecord, error) {
+	records := []types.NDEFRecord{}
+	pos := 0
+	take := func(n int) ([]byte, error) {
+		if n < 0 || pos+n > len(message) {
+			return nil, ErrTruncated
+		}
+		pos += n
+		return message[pos-n : pos], nil
+	}
+	for pos < len(message) {
+		header := message[pos]
+		pos++
+		if header&FLAG_CF != 0 {
+			return nil, fmt.Errorf("Chunked NDEF records are not supported")
+		}
+		lengths, err := take(1)
+		if err != nil {
+			return nil, err
+		}
+		typeLength := int(lengths[0])
+		var payloadLength int
+		if header&FLAG_SR != 0 {
+			lengths, err = take(1)
+			if err != nil {
+				return nil, err
+			}
+			payloadLength = int(lengths[0])
+		} else {
+			lengths, err = take(4)
+			if err != nil {
+				return nil, err
+			}
+			payloadLength = int(binary.BigEndian.Uint32(lengths))
+		}
+		idLength := 0
+		if header&FLAG_IL != 0 {
+			lengths, err = take(1)
+			if err != nil {
+				return nil, err
+			}
+			idLength = int(lengths[0])
+		}
+		recordType, err := take(typeLength)
+		if err != nil {
+			return nil, err
+		}
+		id, err := take(idLength)
+		if err != nil {
+			return nil, err
+		}
+		payload, err := take(payloadLength)
+		if err != nil {
+			return nil, err
+		}
+		record := types.NDEFRecord{TNF: header & TNF_MASK, Type: string(recordType), Id: string(id)}
+		decodeRecord(&record, payload)
+		records = append(records, record)
+		if header&FLAG_ME != 0 {
+			break
+		}
+	}
+	return records, nil
+}
+
+// decodeRecord fills the fields of URI, Text and MIME records, and keeps
+// the payload of the others
+func decodeRecord(record *types.NDEFRecord, payload []byte) {
+	switch {
+	case record.TNF == TNF_WELL_KNOWN && record.Type == RTD_URI && len(payload) > 0 && int(payload[0]) < len(URI_PREFIXES):
+		record.URI = URI_PREFIXES[payload[0]] + string(payload[1:])
+	case record.TNF == TNF_WELL_KNOWN && record.Type == RTD_TEXT && len(payload) > 0 && 1+int(payload[0]&0x3f) <= len(payload):
+		status := payload[0]
+		langEnd := 1 + int(status&0x3f)
+		record.Lang = string(payload[1:langEnd])
+		if status&0x80 != 0 {
+			record.Text = decodeUTF16(payload[langEnd:])
+		} else {
+			record.Text = string(payload[langEnd:])
+		}
+	case record.TNF == TNF_MIME:
+		record.MimeType = record.Type
+		record.Payload = payload
+	case record.TNF == TNF_ABSOLUTE_URI:
+		record.URI = record.Type
+	default:
+		record.Payload = payload
+	}
+}
+
+// decodeUTF16 decodes big endian UTF-16 text, or little endian with a BOM
+func decodeUTF16(data []byte) string {
+	order := binary.ByteOrder(binary.BigEndian)
+	if len(data) >= 2 && data[0] == 0xff && data[1] == 0xfe {
+		order = binary.LittleEndian
+		data = data[2:]
+	} else if len(data) >= 2 && data[0] == 0xfe && data[1] == 0xff {
+		data = data[2:]
+	}
+	units := make([]uint16, len(data)/2)
+	for idx := range units {
+		units[idx] = order.Uint16(data[idx*2:])
+	}
+	return string(utf16.Decode(units))
+}
@@ -0,0 +1,73 @@
+package ndef
+
+import (
+	"testing"
+
+	"ConcatNFCRegProxy/types"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeOwnArea(t *testing.T) {
+	area, err := Area("https://concat.app", AreaSize(0x10))
+	assert.NoError(t, err)
+	// The data area is followed by the ConCat header, which must be ignored
+	area = append(area, 0x43, 0x43, 0x01, 0x00)
+
+	length, done := TLVLength(area)
+	assert.True(t, done)
+	assert.Equal(t, 17, length)
+
+	info, err := Decode(CapabilityContainer(144), area)
+	assert.NoError(t, err)
+	assert.Equal(t, &types.NDEF{
+		Version: "1.0",
+		Size:    144,
+		Records: []types.NDEFRecord{{TNF: TNF_WELL_KNOWN, Type: "U", URI: "https://concat.app"}},
+	}, info)
+}
+
+func TestDecodeRecords(t *testing.T) {
+	message := []byte{
+		// Text, UTF-8, "en"
+		0x91, 0x01, 0x08, 'T', 0x02, 'e', 'n', 'h', 'e', 'l', 'l', 'o',
+		// Text, UTF-16 with a little endian BOM, "de"
+		0x11, 0x01, 0x09, 'T', 0x82, 'd', 'e', 0xff, 0xfe, 'h', 0x00, 'i', 0x00,
+		// MIME with an id
+		0x1a, 0x0a, 0x02, 0x01, 't', 'e', 'x', 't', '/', 'v', 'c', 'a', 'r', 'd', '7', 'B', 'E',
+		// External type, last record
+		0x54, 0x0f, 0x01, 'c', 'o', 'n', 'c', 'a', 't', '.', 'a', 'p', 'p', ':', 'b', 'a', 'd', 'g', 0x2a,
+	}
+	// Lock control TLV and NULL padding before the message
+	area := append([]byte{0x01, 0x03, 0xa0, 0x10, 0x44, 0x00, 0x03, byte(len(message))}, message...)
+	area = append(area, 0xfe)
+
+	info, err := Decode([]byte{0xe1, 0x10, 0x3e, 0x0f}, area)
+	assert.NoError(t, err)
+	assert.True(t, info.ReadOnly)
+	assert.Equal(t, 496, info.Size)
+	assert.Equal(t, []types.NDEFRecord{
+		{TNF: TNF_WELL_KNOWN, Type: "T", Lang: "en", Text: "hello"},
+		{TNF: TNF_WELL_KNOWN, Type: "T", Lang: "de", Text: "hi"},
+		{TNF: TNF_MIME, Type: "text/vcard", Id: "7", MimeType: "text/vcard", Payload: []byte("BE")},
+		{TNF: TNF_EXTERNAL, Type: "concat.app:badg", Payload: []byte{0x2a}},
+	}, info.Records)
+}
+
+func TestDecodeErrors(t *testing.T) {
+	_, err := Decode([]byte{0x00, 0x00, 0x00, 0x00}, nil)
+	assert.ErrorIs(t, err, ErrNoNDEF)
+
+	_, err = Decode(CapabilityContainer(144), []byte{0x03, 0x10, 0xd1, 0x01})
+	assert.ErrorIs(t, err, ErrTruncated)
+	_, done := TLVLength([]byte{0x03, 0x10, 0xd1, 0x01})
+	assert.False(t, done)
+
+	_, err = Decode(CapabilityContainer(144), []byte{0x03, 0x04, 0xd1, 0x01, 0x09, 'U', 0xfe})
+	assert.ErrorIs(t, err, ErrTruncated)
+
+	// An empty data area has no records
+	info, err := Decode(CapabilityContainer(144), []byte{0x03, 0x00, 0xfe})
+	assert.NoError(t, err)
+	assert.Empty(t, info.Records)
+}
@@ -0,0 +1,110 @@
+package ndef
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"ConcatNFCRegProxy/types"
+)
+
+// Placeholders of an NDEF URL template, replaced by the card on every read
+const PLACEHOLDER_UID = "{uid}"
+const PLACEHOLDER_COUNTER = "{counter}"
+
+// MIRROR_CONF values of NTAG21x
+const (
+	MIRROR_NONE    byte = 0x00
+	MIRROR_UID     byte = 0x01
+	MIRROR_COUNTER byte = 0x02
+	MIRROR_BOTH    byte = 0x03
+)
+
+// Lengths of the ASCII mirrors: the 7 byte UID and the 3 byte NFC counter
+// in hex, separated by 'x' when both are mirrored
+const MIRROR_UID_LENGTH = 14
+const MIRROR_COUNTER_LENGTH = 6
+
+// Mirror is where NTAG21x writes the ASCII mirror, as programmed in
+// MIRROR_CONF, MIRROR_PAGE and MIRROR_BYTE
+type Mirror struct {
+	Conf byte
+	Page byte
+	Byte byte
+}
+
+// Render replaces the placeholders of a URL template by the zeros the card
+// overwrites, and returns the mirror configuration and its offset in url.
+// Both placeholders can only be used together as "{uid}x{counter}".
+func Render(template string) (url string, conf byte, offset int, err error) {
+	uidAt := strings.Index(template, PLACEHOLDER_UID)
+	counterAt := strings.Index(template, PLACEHOLDER_COUNTER)
+	if strings.Count(template, PLACEHOLDER_UID) > 1 || strings.Count(template, PLACEHOLDER_COUNTER) > 1 {
+		return "", MIRROR_NONE, 0, fmt.Errorf("NDEF URL %s can use each placeholder once", template)
+	}
+	switch {
+	case uidAt >= 0 && counterAt >= 0:
+		both := PLACEHOLDER_UID + "x" + PLACEHOLDER_COUNTER
+		if !strings.Contains(template, both) {
+			return "", MIRROR_NONE, 0, fmt.Errorf("NDEF URL %s must use %s to mirror both the UID and the counter", template, both)
+		}
+		mirrored := strings.Repeat("0", MIRROR_UID_LENGTH) + "x" + strings.Repeat("0", MIRROR_COUNTER_LENGTH)
+		return strings.Replace(template, both, mirrored, 1), MIRROR_BOTH, uidAt, nil
+	case uidAt >= 0:
+		return strings.Replace(template, PLACEHOLDER_UID, strings.Repeat("0", MIRROR_UID_LENGTH), 1), MIRROR_UID, uidAt, nil
+	case counterAt >= 0:
+		return strings.Replace(template, PLACEHOLDER_COUNTER, strings.Repeat("0", MIRROR_COUNTER_LENGTH), 1), MIRROR_COUNTER, counterAt, nil
+	}
+	return template, MIRROR_NONE, 0, nil
+}
+
+// MirrorOf returns where the card has to mirror into the NDEF message of a
+// URL template written by Area
+func MirrorOf(template string) (Mirror, error) {
+	url, conf, offset, err := Render(template)
+	if err != nil || conf == MIRROR_NONE {
+		return Mirror{}, err
+	}
+	// The URL after its abbreviated prefix ends the record, just before the terminator
+	tlv := TLV(URIRecord(url))
+	position := len(tlv) - 1 - (len(url) - offset)
+	return Mirror{
+		Conf: conf,
+		Page: DATA_PAGE + byte(position/PAGE_SIZE),
+		Byte: byte(position % PAGE_SIZE),
+	}, nil
+}
+
+// ParseMirror extracts the mirrored UID and counter from a URI read from a
+// card written with template. ok is false when uri does not match it.
+func ParseMirror(template string, uri string) (mirror *types.NDEFMirror, ok bool) {
+	url, conf, offset, err := Render(template)
+	if err != nil || conf == MIRROR_NONE || len(uri) != len(url) {
+		return nil, false
+	}
+	length := MIRROR_UID_LENGTH
+	switch conf {
+	case MIRROR_COUNTER:
+		length = MIRROR_COUNTER_LENGTH
+	case MIRROR_BOTH:
+		length = MIRROR_UID_LENGTH + 1 + MIRROR_COUNTER_LENGTH
+	}
+	if uri[:offset] != url[:offset] || uri[offset+length:] != url[offset+length:] {
+		return nil, false
+	}
+	value := uri[offset : offset+length]
+	mirror = &types.NDEFMirror{}
+	if conf == MIRROR_UID || conf == MIRROR_BOTH {
+		mirror.UID = strings.ToLower(value[:MIRROR_UID_LENGTH])
+		value = strings.TrimPrefix(value[MIRROR_UID_LENGTH:], "x")
+	}
+	if conf == MIRROR_COUNTER || conf == MIRROR_BOTH {
+		counter, err := strconv.ParseUint(value, 16, 32)
+		if err != nil {
+			return nil, false
+		}
+		value32 := uint32(counter)
+		mirror.Counter = &value32
+	}
+	return mirror, true
+}
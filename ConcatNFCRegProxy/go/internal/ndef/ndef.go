@@ -0,0 +1,156 @@
+// Package ndef builds the NFC Forum Type 2 Tag NDEF message written to the
+// pages below the password protected ConCat data, so a phone tapping a badge
+// opens the convention's URL.
+package ndef
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// CC_PAGE holds the capability container
+const CC_PAGE byte = 0x03
+
+// DATA_PAGE is the first page of the NDEF data area
+const DATA_PAGE byte = 0x04
+
+// PAGE_SIZE is the page size of every Type 2 Tag
+const PAGE_SIZE = 4
+
+const CC_MAGIC byte = 0xE1
+
+// CC_VERSION is mapping version 1.0
+const CC_VERSION byte = 0x10
+
+// CC_ACCESS_OPEN grants read and write access without security
+const CC_ACCESS_OPEN byte = 0x00
+
+const TLV_NULL byte = 0x00
+const TLV_NDEF byte = 0x03
+const TLV_TERMINATOR byte = 0xFE
+
+// Record header flags
+const (
+	FLAG_MB        byte = 0x80
+	FLAG_ME        byte = 0x40
+	FLAG_SR        byte = 0x10
+	TNF_WELL_KNOWN byte = 0x01
+)
+
+// RTD_URI is the record type of a URI record
+const RTD_URI = "U"
+
+// URI_PREFIXES are the abbreviations of the URI record type definition,
+// indexed by their identifier code
+var URI_PREFIXES = []string{
+	"",
+	"http://www.",
+	"https://www.",
+	"http://",
+	"https://",
+	"tel:",
+	"mailto:",
+	"ftp://anonymous:anonymous@",
+	"ftp://ftp.",
+	"ftps://",
+	"sftp://",
+	"smb://",
+	"nfs://",
+	"ftp://",
+	"dav://",
+	"news:",
+	"telnet://",
+	"imap:",
+	"rtsp://",
+	"urn:",
+	"pop:",
+	"sip:",
+	"sips:",
+	"tftp:",
+	"btspp://",
+	"btl2cap://",
+	"btgoep://",
+	"tcpobex://",
+	"irdaobex://",
+	"file://",
+	"urn:epc:id:",
+	"urn:epc:tag:",
+	"urn:epc:pat:",
+	"urn:epc:raw:",
+	"urn:epc:",
+	"urn:nfc:",
+}
+
+// URIRecord encodes uri as a single well known URI record, abbreviating the
+// longest matching prefix
+func URIRecord(uri string) []byte {
+	code := 0
+	for idx, prefix := range URI_PREFIXES {
+		if strings.HasPrefix(uri, prefix) && len(prefix) > len(URI_PREFIXES[code]) {
+			code = idx
+		}
+	}
+	payload := append([]byte{byte(code)}, uri[len(URI_PREFIXES[code]):]...)
+
+	header := FLAG_MB | FLAG_ME | TNF_WELL_KNOWN
+	record := []byte{header, byte(len(RTD_URI))}
+	if len(payload) <= 0xff {
+		record[0] |= FLAG_SR
+		record = append(record, byte(len(payload)))
+	} else {
+		record = binary.BigEndian.AppendUint32(record, uint32(len(payload)))
+	}
+	record = append(record, RTD_URI...)
+	return append(record, payload...)
+}
+
+// TLV wraps an NDEF message in an NDEF Message TLV followed by a terminator
+func TLV(message []byte) []byte {
+	tlv := []byte{TLV_NDEF}
+	if len(message) < 0xff {
+		tlv = append(tlv, byte(len(message)))
+	} else {
+		tlv = append(tlv, 0xff)
+		tlv = binary.BigEndian.AppendUint16(tlv, uint16(len(message)))
+	}
+	tlv = append(tlv, message...)
+	return append(tlv, TLV_TERMINATOR)
+}
+
+// Area returns the data area content for a URL template, failing when it
+// does not fit in size bytes. Placeholders are written as zeros, see Render.
+func Area(template string, size int) ([]byte, error) {
+	url, _, _, err := Render(template)
+	if err != nil {
+		return nil, err
+	}
+	data := TLV(URIRecord(url))
+	if len(data) > size {
+		return nil, fmt.Errorf("NDEF message for %s is %d bytes but only %d fit below the ConCat data", template, len(data), size)
+	}
+	return data, nil
+}
+
+// AreaSize is the number of bytes of the NDEF data area below startPage.
+// The capability container counts in units of 8 bytes, so it is rounded
+// down to a multiple of 8 and never reaches the ConCat data.
+func AreaSize(startPage byte) int {
+	return (int(startPage) - int(DATA_PAGE)) * PAGE_SIZE / 8 * 8
+}
+
+// CapabilityContainer announces an NDEF data area of size bytes, see AreaSize
+func CapabilityContainer(size int) []byte {
+	return []byte{CC_MAGIC, CC_VERSION, byte(size / 8), CC_ACCESS_OPEN}
+}
+
+// CanProgram reports whether current can be turned into cc. The capability
+// container is one time programmable: written bits are ORed and never cleared.
+func CanProgram(current []byte, cc []byte) bool {
+	for idx := range cc {
+		if current[idx]&^cc[idx] != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,98 @@
+package ndef
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestURIRecord(t *testing.T) {
+	assert.Equal(t, append([]byte{0xd1, 0x01, 0x0b, 'U', 0x04}, "concat.app"...), URIRecord("https://concat.app"))
+	// The longest prefix wins
+	assert.Equal(t, append([]byte{0xd1, 0x01, 0x0b, 'U', 0x02}, "concat.app"...), URIRecord("https://www.concat.app"))
+	// Unknown schemes are kept whole
+	assert.Equal(t, append([]byte{0xd1, 0x01, 0x0c, 'U', 0x00}, "concat:1234"...), URIRecord("concat:1234"))
+
+	long := URIRecord("https://" + strings.Repeat("a", 300))
+	assert.Equal(t, []byte{0xc1, 0x01, 0x00, 0x00, 0x01, 0x2d, 'U', 0x04}, long[:8])
+}
+
+func TestArea(t *testing.T) {
+	area, err := Area("https://concat.app", 48)
+	assert.NoError(t, err)
+	assert.Equal(t, append(append([]byte{0x03, 0x0f, 0xd1, 0x01, 0x0b, 'U', 0x04}, "concat.app"...), 0xfe), area)
+
+	_, err = Area("https://concat.app/schedule/"+strings.Repeat("x", 30), AreaSize(0x10))
+	assert.ErrorContains(t, err, "only 48 fit")
+
+	assert.Equal(t, []byte{0x03, 0xff, 0x01, 0x2c}, TLV(make([]byte, 300))[:4])
+}
+
+func TestCapabilityContainer(t *testing.T) {
+	assert.Equal(t, []byte{0xe1, 0x10, 0x12, 0x00}, CapabilityContainer(144))
+	assert.Equal(t, []byte{0xe1, 0x10, 0x3e, 0x00}, CapabilityContainer(496))
+	assert.Equal(t, []byte{0xe1, 0x10, 0x6d, 0x00}, CapabilityContainer(872))
+
+	// The announced area never reaches the ConCat data at the start page
+	assert.Equal(t, []byte{0xe1, 0x10, 0x06, 0x00}, CapabilityContainer(AreaSize(0x10)))
+	for page := int(DATA_PAGE); page <= 0xff; page++ {
+		info, err := ParseCC(CapabilityContainer(AreaSize(byte(page))))
+		assert.NoError(t, err)
+		assert.LessOrEqual(t, int(DATA_PAGE)*PAGE_SIZE+info.Size, page*PAGE_SIZE, page)
+		assert.Zero(t, info.Size%8, page)
+	}
+	assert.Equal(t, 40, AreaSize(0x0f))
+
+	cc := CapabilityContainer(144)
+	assert.True(t, CanProgram([]byte{0, 0, 0, 0}, cc))
+	assert.True(t, CanProgram(cc, cc))
+	assert.False(t, CanProgram([]byte{0xe1, 0x10, 0x6d, 0x00}, cc))
+}
+
+func TestMirror(t *testing.T) {
+	url, conf, offset, err := Render("https://concat.app/t/{uid}x{counter}")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://concat.app/t/00000000000000x000000", url)
+	assert.Equal(t, MIRROR_BOTH, conf)
+	assert.Equal(t, 21, offset)
+
+	// 03 len d1 01 len 55 04 then "concat.app/t/" puts the mirror at byte 20 of the data area
+	mirror, err := MirrorOf("https://concat.app/t/{uid}x{counter}")
+	assert.NoError(t, err)
+	assert.Equal(t, Mirror{Conf: MIRROR_BOTH, Page: 0x09, Byte: 0}, mirror)
+	area, err := Area("https://concat.app/t/{uid}x{counter}", AreaSize(0x10))
+	assert.NoError(t, err)
+	assert.Equal(t, byte('0'), area[20])
+	assert.Equal(t, byte('/'), area[19])
+
+	mirror, err = MirrorOf("https://concat.app/?c={counter}")
+	assert.NoError(t, err)
+	assert.Equal(t, Mirror{Conf: MIRROR_COUNTER, Page: 0x09, Byte: 1}, mirror)
+
+	mirror, err = MirrorOf("https://concat.app/")
+	assert.NoError(t, err)
+	assert.Equal(t, MIRROR_NONE, mirror.Conf)
+
+	_, _, _, err = Render("https://concat.app/{uid}/{counter}")
+	assert.ErrorContains(t, err, "{uid}x{counter}")
+	_, _, _, err = Render("https://concat.app/{uid}/{uid}")
+	assert.Error(t, err)
+}
+
+func TestParseMirror(t *testing.T) {
+	mirror, ok := ParseMirror("https://concat.app/t/{uid}x{counter}", "https://concat.app/t/04412A014B3403x00002A")
+	assert.True(t, ok)
+	assert.Equal(t, "04412a014b3403", mirror.UID)
+	assert.Equal(t, uint32(42), *mirror.Counter)
+
+	mirror, ok = ParseMirror("https://concat.app/?u={uid}&v=1", "https://concat.app/?u=04412A014B3403&v=1")
+	assert.True(t, ok)
+	assert.Equal(t, "04412a014b3403", mirror.UID)
+	assert.Nil(t, mirror.Counter)
+
+	_, ok = ParseMirror("https://concat.app/?u={uid}&v=1", "https://other.app/?u=04412A014B3403&v=1")
+	assert.False(t, ok)
+	_, ok = ParseMirror("https://concat.app/?c={counter}", "https://concat.app/?c=zzzzzz")
+	assert.False(t, ok)
+}
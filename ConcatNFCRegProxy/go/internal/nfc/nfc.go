@@ -2,6 +2,11 @@ package nfc
 
 import (
 	"ConcatNFCRegProxy/broker"
+	"ConcatNFCRegProxy/internal/config"
+	"ConcatNFCRegProxy/internal/logging"
+	"ConcatNFCRegProxy/internal/metrics"
+	"ConcatNFCRegProxy/internal/ndef"
+	tagsdef "ConcatNFCRegProxy/internal/tags"
 	"bytes"
 	"encoding/binary"
 	"encoding/json"
@@ -17,9 +22,14 @@ import (
 	"github.com/ebfe/scard"
 )
 
-var STARTING_REGION byte = 0x10
 var PAGE_SIZE byte = 0x04
 
+// USER_MEMORY_PAGE is the first page of user memory on NTAG21x
+var USER_MEMORY_PAGE byte = 0x04
+
+// NFC_CNT_EN enables the NFC counter in the ACCESS byte of NTAG21x
+const NFC_CNT_EN byte = 0x10
+
 // Opcodes can be found in API-ACR122U-2.04.pdf
 var OPERATION_GET_SUPPORTED_CARD_SIGNATURE = []byte{0x3B, 0x8F, 0x80, 0x1, 0x80, 0x4F, 0xC, 0xA0, 0x0, 0x0, 0x3, 0x6, 0x3, 0x0, 0x3}
 var SUPPORTED_CARD = []byte{0x00, 0x04, 0x04, 0x02, 0x01, 0x00}
@@ -40,6 +50,7 @@ type NFCEnvoriment struct {
 	lastTimeReadersChanged time.Time
 	connectedReaderIndex   int
 	cardStatus             string
+	cfg                    *config.Config
 }
 
 type CardInfo struct {
@@ -48,10 +59,11 @@ type CardInfo struct {
 	Memory       int
 }
 
-func BeginNfc(eventBroker *broker.Broker[string]) *NFCEnvoriment {
+func BeginNfc(eventBroker *broker.Broker[string], cfg *config.Config) *NFCEnvoriment {
 	var env NFCEnvoriment
 	var err error
 	env.eventBroker = eventBroker
+	env.cfg = cfg
 	env.context, err = scard.EstablishContext()
 	if err != nil {
 		fmt.Printf("Cannot establish connection to scard: %u", err)
@@ -65,10 +77,17 @@ func BeginNfc(eventBroker *broker.Broker[string]) *NFCEnvoriment {
 }
 
 func (env *NFCEnvoriment) sendEvent(event string) {
+	env.sendCardEvent(event, nil)
+}
+
+// sendCardEvent publishes an event with the public NDEF content of the card
+func (env *NFCEnvoriment) sendCardEvent(event string, ndefInfo *types.NDEF) {
 	message := struct {
-		Event string `json:"Event"`
+		Event string      `json:"Event"`
+		NDEF  *types.NDEF `json:"ndef,omitempty"`
 	}{
 		Event: event,
+		NDEF:  ndefInfo,
 	}
 	jsonData, err := json.Marshal(message)
 	if err == nil {
@@ -129,8 +148,12 @@ func (env *NFCEnvoriment) eventHandler() {
 						env.cardConnection = card
 						env.buffer = []byte{}
 						env.connectedReaderIndex = i
+						ndefInfo, err := env.ReadNDEF()
+						if err != nil {
+							logging.Debugf("No NDEF data on the card: %s\n", err.Error())
+						}
 						env.Unlock()
-						env.sendEvent("Card present")
+						env.sendCardEvent("Card present", ndefInfo)
 					}
 				}
 				if rs[i].EventState&scard.StateEmpty != 0 {
@@ -171,13 +194,26 @@ func (env *NFCEnvoriment) ResetCard() error {
 }
 
 func (env *NFCEnvoriment) Lock() {
+	started := time.Now()
 	env.Mtx.Lock()
+	metrics.LockWait.WithLabelValues(env.readerName()).Observe(time.Since(started).Seconds())
 }
 
 func (env *NFCEnvoriment) Unlock() {
 	env.Mtx.Unlock()
 }
 
+// readerName returns the name of the reader used for metric labels
+func (env *NFCEnvoriment) readerName() string {
+	if env.connectedReaderIndex >= 0 && env.connectedReaderIndex < len(env.readers) {
+		return env.readers[env.connectedReaderIndex]
+	}
+	if len(env.readers) > 0 {
+		return env.readers[0]
+	}
+	return metrics.NO_READER
+}
+
 func (env *NFCEnvoriment) IsReady() bool {
 	if !env.ready {
 		return false
@@ -204,15 +240,15 @@ func (env *NFCEnvoriment) lookForDevicesRoutine() {
 			readers, err := env.context.ListReaders()
 			if err != nil {
 				fmt.Printf("No device found %s!\n", err.Error())
-				time.Sleep(1 * time.Second)
+				time.Sleep(env.cfg.Timeouts.ReaderPoll.Std())
 				continue
 			}
 			var found bool
 			if len(readers) > 0 {
 				fmt.Printf("Found a device, those are our readers: %v\n", readers)
 				for _, reader := range readers {
-					if strings.Contains(strings.ToLower(reader), "yubico") {
-						fmt.Printf("Ignoring yubico device %s\n", reader)
+					if !env.cfg.MatchReader(reader) {
+						fmt.Printf("Ignoring device %s\n", reader)
 						continue
 					}
 					fmt.Printf("Using device %s\n", reader)
@@ -225,7 +261,7 @@ func (env *NFCEnvoriment) lookForDevicesRoutine() {
 					break
 				}
 			}
-			time.Sleep(1 * time.Second)
+			time.Sleep(env.cfg.Timeouts.ReaderPoll.Std())
 			env.lastTimeReadersChanged = time.Now()
 		}
 		env.Mtx.Unlock()
@@ -235,6 +271,7 @@ func (env *NFCEnvoriment) lookForDevicesRoutine() {
 				fmt.Println("Context might be broken, restarting")
 				env.ready = false
 				env.Mtx.Lock()
+				metrics.ReaderReconnects.WithLabelValues(env.readerName()).Inc()
 				env.lastTimeReadersChanged = time.Now()
 				env.readers = []string{}
 
@@ -242,7 +279,7 @@ func (env *NFCEnvoriment) lookForDevicesRoutine() {
 					env.context, err = scard.EstablishContext()
 					if err != nil {
 						fmt.Printf("Cannot establish connection to scard: %s\n", err.Error())
-						time.Sleep(1 * time.Second)
+						time.Sleep(env.cfg.Timeouts.ReaderPoll.Std())
 						continue
 					}
 					break
@@ -250,7 +287,7 @@ func (env *NFCEnvoriment) lookForDevicesRoutine() {
 				env.Mtx.Unlock()
 				break
 			}
-			time.Sleep(1 * time.Second)
+			time.Sleep(env.cfg.Timeouts.ReaderPoll.Std())
 		}
 	}
 }
@@ -294,9 +331,11 @@ func (env *NFCEnvoriment) transmitAndValidate(card *scard.Card, message []byte)
 		return false, nil, fmt.Errorf("card not ready")
 	}
 	if card == nil {
-		return false, nil, fmt.Errorf(env.cardStatus)
+		return false, nil, errors.New(env.cardStatus)
 	}
+	started := time.Now()
 	rsp, err := card.Transmit(message)
+	metrics.APDULatency.WithLabelValues(env.readerName(), apduCommandName(message)).Observe(time.Since(started).Seconds())
 	if err != nil {
 		return false, []byte{}, err
 	}
@@ -315,6 +354,35 @@ func (env *NFCEnvoriment) transmitAndValidate(card *scard.Card, message []byte)
 	return true, rsp[0 : len(rsp)-2], nil
 }
 
+// apduCommandName maps an APDU to a short name used to label latency metrics
+func apduCommandName(message []byte) string {
+	if len(message) < 2 || message[0] != 0xFF {
+		return "other"
+	}
+	switch message[1] {
+	case 0xB0:
+		return "read"
+	case 0xD6:
+		return "write"
+	case 0xCA:
+		return "get_uid"
+	case 0x00:
+		if len(message) > 2 && message[2] == 0x40 {
+			return "led"
+		}
+		if len(message) > 7 && message[5] == 0xd4 && message[6] == 0x42 {
+			switch message[7] {
+			case 0x60:
+				return "get_version"
+			case 0x1b:
+				return "pwd_auth"
+			}
+			return "vendor"
+		}
+	}
+	return "other"
+}
+
 // transmitVendorCommand implements inCommunicateThru command according to NXP App note 157830_PN533 section 8.4.9
 func (env *NFCEnvoriment) transmitVendorCommand(card *scard.Card, vendorCommand []byte) (bool, []byte, error) {
 	length := 2 + len(vendorCommand)
@@ -374,7 +442,7 @@ func (env *NFCEnvoriment) controlLEDAndBuzzer(red bool, green bool, buzzerDurati
 
 func (env *NFCEnvoriment) connectAndValidateCard(index int) (*scard.Card, error) {
 	var finalError error
-	for retry := 0; retry < 4; retry++ {
+	for retry := 0; retry < env.cfg.Timeouts.ConnectRetries; retry++ {
 		card, err := env.context.Connect(env.readers[index], scard.ShareShared, scard.ProtocolAny)
 		if err != nil {
 			fmt.Printf("Failed to connect to card: %s\n", err.Error())
@@ -404,8 +472,9 @@ func (env *NFCEnvoriment) connectAndValidateCard(index int) (*scard.Card, error)
 		}
 		if version[0] != 0x0 {
 			finalError = fmt.Errorf("Vendor command failed with error code %x\n", version[0])
-			fmt.Printf(finalError.Error())
+			fmt.Print(finalError.Error())
 			card.Disconnect(scard.ResetCard)
+			metrics.ConnectRetries.WithLabelValues(env.readers[index]).Inc()
 			time.Sleep(200 * time.Millisecond)
 			continue
 		}
@@ -417,7 +486,8 @@ func (env *NFCEnvoriment) connectAndValidateCard(index int) (*scard.Card, error)
 		if len(version) < 9 {
 			card.Disconnect(scard.ResetCard)
 			finalError = fmt.Errorf("Got short response from GET_VERISON")
-			fmt.Printf(finalError.Error())
+			fmt.Print(finalError.Error())
+			metrics.ConnectRetries.WithLabelValues(env.readers[index]).Inc()
 			time.Sleep(100 * time.Millisecond)
 			continue
 		}
@@ -518,28 +588,11 @@ func (env *NFCEnvoriment) SetNTAG21xPassword(password uint32) error {
 	passwordBytes := make([]byte, 4)
 	binary.BigEndian.PutUint32(passwordBytes, password)
 	var cfgBytes []byte
-	var cfgStartPage byte
-	switch ci.ProductName {
-	case "NTAG213":
-		{
-			err = env.writePage(0x2b, passwordBytes)
-			cfgStartPage = 0x29
-		}
-	case "NTAG215":
-		{
-			err = env.writePage(0x85, passwordBytes)
-			cfgStartPage = 0x83
-		}
-	case "NTAG216":
-		{
-			err = env.writePage(0xe5, passwordBytes)
-			cfgStartPage = 0xe3
-		}
-	default:
-		{
-			return fmt.Errorf("Unsupported %s", ci.ProductName)
-		}
+	cfgStartPage, pwdPage, err := configPages(ci)
+	if err != nil {
+		return err
 	}
+	err = env.writePage(pwdPage, passwordBytes)
 	if err != nil {
 		return err
 	}
@@ -562,7 +615,7 @@ func (env *NFCEnvoriment) SetNTAG21xPassword(password uint32) error {
 		return err
 	}
 	// Set starting page for protection
-	cfgBytes[3] = STARTING_REGION
+	cfgBytes[3] = env.cfg.Layout.StartPage
 	// Set PROT bit to 1 for read and write protection
 	cfgBytes[4] = cfgBytes[4] | (0x1 << 7)
 	err = env.writePage(cfgStartPage, cfgBytes[0:4])
@@ -574,7 +627,7 @@ func (env *NFCEnvoriment) SetNTAG21xPassword(password uint32) error {
 		return err
 	}
 
-	fmt.Printf("cfg bytes: % x", cfgBytes)
+	logging.Debugf("cfg bytes: % x\n", cfgBytes)
 
 	return nil
 }
@@ -592,28 +645,11 @@ func (env *NFCEnvoriment) ClearNTAG21xPassword() error {
 
 	passwordBytes := []byte{0xff, 0xff, 0xff, 0xff}
 	var cfgBytes []byte
-	var cfgStartPage byte
-	switch ci.ProductName {
-	case "NTAG213":
-		{
-			err = env.writePage(0x2b, passwordBytes)
-			cfgStartPage = 0x29
-		}
-	case "NTAG215":
-		{
-			err = env.writePage(0x85, passwordBytes)
-			cfgStartPage = 0x83
-		}
-	case "NTAG216":
-		{
-			err = env.writePage(0xe5, passwordBytes)
-			cfgStartPage = 0xe3
-		}
-	default:
-		{
-			return fmt.Errorf("Unsupported %s", ci.ProductName)
-		}
+	cfgStartPage, pwdPage, err := configPages(ci)
+	if err != nil {
+		return err
 	}
+	err = env.writePage(pwdPage, passwordBytes)
 	if err != nil {
 		return err
 	}
@@ -635,11 +671,60 @@ func (env *NFCEnvoriment) ClearNTAG21xPassword() error {
 		return err
 	}
 
-	fmt.Printf("cfg bytes: % x", cfgBytes)
+	logging.Debugf("cfg bytes: % x\n", cfgBytes)
 
 	return nil
 }
 
+// configPages returns the first configuration page, CFG0, and the PWD page
+// of an NTAG21x
+func configPages(ci *CardInfo) (cfgStartPage byte, pwdPage byte, err error) {
+	switch ci.ProductName {
+	case "NTAG213":
+		return 0x29, 0x2b, nil
+	case "NTAG215":
+		return 0x83, 0x85, nil
+	case "NTAG216":
+		return 0xe3, 0xe5, nil
+	}
+	return 0, 0, fmt.Errorf("Unsupported %s", ci.ProductName)
+}
+
+// configureMirror programs MIRROR_CONF, MIRROR_BYTE and MIRROR_PAGE in CFG0,
+// and enables the NFC counter in ACCESS when it is mirrored. MIRROR_NONE
+// turns the mirror off, so it cannot overwrite a URL without placeholders.
+func (env *NFCEnvoriment) configureMirror(mirror ndef.Mirror) error {
+	ci, err := env.getCardInfo()
+	if err != nil {
+		return err
+	}
+	cfgStartPage, _, err := configPages(ci)
+	if err != nil {
+		return err
+	}
+	env.setPage(cfgStartPage)
+	cfgBytes, err := env.readBytes(8)
+	if err != nil {
+		return err
+	}
+	// MIRROR_CONF in bits 7-6 and MIRROR_BYTE in bits 5-4, keeping STRG_MOD_EN
+	cfgBytes[0] = mirror.Conf<<6 | mirror.Byte<<4 | cfgBytes[0]&0x0f
+	cfgBytes[2] = mirror.Page
+	err = env.writePage(cfgStartPage, cfgBytes[0:4])
+	if err != nil {
+		return err
+	}
+	if mirror.Conf&ndef.MIRROR_COUNTER != 0 && cfgBytes[4]&NFC_CNT_EN == 0 {
+		cfgBytes[4] |= NFC_CNT_EN
+		err = env.writePage(cfgStartPage+1, cfgBytes[4:8])
+		if err != nil {
+			return err
+		}
+	}
+	logging.Debugf("cfg bytes: % x\n", cfgBytes)
+	return nil
+}
+
 func (env *NFCEnvoriment) IsAuthRequired() bool {
 	authRequiredStatusCode := []byte{0x63, 0x00}
 	if bytes.Equal(env.lastErrorCode, authRequiredStatusCode) {
@@ -663,18 +748,26 @@ func (env *NFCEnvoriment) NTAG21xAuth(password uint32) error {
 	payload = binary.BigEndian.AppendUint32(payload, password)
 	success, response, err := env.transmitVendorCommand(env.cardConnection, payload)
 	if err != nil {
+		if env.IsAuthRequired() {
+			metrics.AuthFailures.WithLabelValues(env.readerName(), "wrong_password").Inc()
+		} else {
+			metrics.AuthFailures.WithLabelValues(env.readerName(), "transmit").Inc()
+		}
 		return err
 	}
 	if !success {
+		metrics.AuthFailures.WithLabelValues(env.readerName(), "transmit").Inc()
 		return fmt.Errorf("Operation failed")
 	}
 	if len(response) < 1 {
+		metrics.AuthFailures.WithLabelValues(env.readerName(), "short_response").Inc()
 		return fmt.Errorf("response too short")
 	}
 	if response[0] != 0 {
+		metrics.AuthFailures.WithLabelValues(env.readerName(), "wrong_password").Inc()
 		return fmt.Errorf("Authentication failed")
 	}
-	fmt.Printf("response: % x\n", response)
+	logging.Debugf("response: % x\n", response)
 	return nil
 
 }
@@ -701,7 +794,7 @@ func (env *NFCEnvoriment) writePage(pageNumber byte, data []byte) error {
 	opwrite = append(opwrite, OPERATION_WRITE...)
 	opwrite[3] = pageNumber
 
-	fmt.Printf("[DEBUG] Writing page=%x data=%v\n", pageNumber, data)
+	logging.Debugf("Writing page=%x data=%v\n", pageNumber, data)
 	opwrite = append(opwrite, data...) // Append the data to write
 	success, _, err := env.transmitAndValidate(env.cardConnection, opwrite)
 	if err != nil {
@@ -732,7 +825,7 @@ func (env *NFCEnvoriment) readByte() (byte, error) {
 		if len(env.buffer) > int(PAGE_SIZE) {
 			env.buffer = env.buffer[:PAGE_SIZE]
 		}
-		fmt.Printf("[DEBUG] page read 0x%x data=%v\n", env.currentPage, env.buffer)
+		logging.Debugf("page read 0x%x data=%v\n", env.currentPage, env.buffer)
 		env.currentPage++
 	}
 	readElement := env.buffer[0]
@@ -752,106 +845,224 @@ func (env *NFCEnvoriment) readBytes(nBytes int) ([]byte, error) {
 	return buf, nil
 }
 
-func (env *NFCEnvoriment) checkAndTransmit(accumulatedBytes []byte) ([]byte, bool, error) {
-	if len(accumulatedBytes) != int(PAGE_SIZE) {
-		return accumulatedBytes, false, nil
-	}
-	err := env.writePage(env.currentPage, accumulatedBytes)
+// resultLabel converts an operation error into a metric label
+func resultLabel(err error) string {
 	if err != nil {
-		return []byte{}, false, err
+		return "error"
 	}
-	env.currentPage++
-	return []byte{}, true, err
+	return "success"
 }
 
-func (env *NFCEnvoriment) WriteTags(tags []types.Tag) error {
-	var err error
-	env.setPage(STARTING_REGION)
+func (env *NFCEnvoriment) WriteTags(tags []types.Tag) (err error) {
+	defer func() {
+		metrics.CardWrites.WithLabelValues(env.readerName(), resultLabel(err)).Inc()
+	}()
+	data, err := tagsdef.Encode(tags)
+	if err != nil {
+		return err
+	}
+	capacity, err := env.capacity()
+	if err != nil {
+		return err
+	}
+	if len(data) > capacity {
+		return fmt.Errorf("Card data is %d bytes but the card holds %d from page 0x%02x", len(data), capacity, env.cfg.Layout.StartPage)
+	}
 	env.cardConnection.BeginTransaction()
-	//Transmissions must be done in blocks of 16, so here we make sure we're transmitting 16 bytes at the time
-	var accumulatedBytes []byte
-	for _, tag := range tags {
-		fmt.Printf("[DEBUG] Writing tag 0x%x\n", tag.Id)
-		accumulatedBytes = append(accumulatedBytes, tag.Id)
-		accumulatedBytes, _, err = env.checkAndTransmit(accumulatedBytes)
+	if env.cfg.Layout.NDEFURL != "" {
+		err = env.writeNDEF()
 		if err != nil {
 			return err
 		}
-		fmt.Printf("[DEBUG] Writing tag length=%d\n", byte(len(tag.Data)))
-		accumulatedBytes = append(accumulatedBytes, byte(len(tag.Data)))
-		accumulatedBytes, _, err = env.checkAndTransmit(accumulatedBytes)
+	}
+	env.setPage(env.cfg.Layout.StartPage)
+	err = env.writeBytes(data)
+	if err != nil {
+		return err
+	}
+	return env.cardConnection.EndTransaction(0)
+}
+
+// writeNDEF writes the capability container and the NDEF message of
+// Layout.NDEFURL to the pages below the start page, which stay readable
+// without the password, and programs the UID and counter mirror of its
+// placeholders
+func (env *NFCEnvoriment) writeNDEF() error {
+	// Only NTAG21x have the capability container and mirror this writes
+	_, err := env.getCardInfo()
+	if err != nil {
+		return err
+	}
+	size := ndef.AreaSize(env.cfg.Layout.StartPage)
+	area, err := ndef.Area(env.cfg.Layout.NDEFURL, size)
+	if err != nil {
+		return err
+	}
+	// Phones may write up to the announced size, which has to stop short of
+	// the ConCat data
+	cc := ndef.CapabilityContainer(size)
+	current, err := env.readPage(ndef.CC_PAGE)
+	if err != nil {
+		return err
+	}
+	if len(current) < len(cc) {
+		return fmt.Errorf("Short read of the capability container")
+	}
+	if !bytes.Equal(current[:len(cc)], cc) {
+		if !ndef.CanProgram(current, cc) {
+			return fmt.Errorf("Capability container is % x and cannot be changed to % x", current[:len(cc)], cc)
+		}
+		err = env.writePage(ndef.CC_PAGE, cc)
 		if err != nil {
 			return err
 		}
-		fmt.Printf("[DEBUG] Writing data=%v\n", byte(len(tag.Data)))
-		for _, dataByte := range tag.Data {
-			accumulatedBytes = append(accumulatedBytes, dataByte)
-			accumulatedBytes, _, err = env.checkAndTransmit(accumulatedBytes)
-			if err != nil {
-				return err
-			}
+	}
+	env.setPage(ndef.DATA_PAGE)
+	err = env.writeBytes(area)
+	if err != nil {
+		return err
+	}
+	mirror, err := ndef.MirrorOf(env.cfg.Layout.NDEFURL)
+	if err != nil {
+		return err
+	}
+	return env.configureMirror(mirror)
+}
+
+// ReadNDEF decodes the capability container and the first NDEF message of
+// the card, which is readable without the password unless the card protects
+// it. It returns ndef.ErrNoNDEF for cards without a capability container.
+func (env *NFCEnvoriment) ReadNDEF() (*types.NDEF, error) {
+	ci, err := env.getCardInfo()
+	if err != nil {
+		return nil, err
+	}
+	env.setPage(ndef.CC_PAGE)
+	cc, err := env.readBytes(int(PAGE_SIZE))
+	if err != nil {
+		return nil, env.reactivate(err)
+	}
+	info, err := ndef.ParseCC(cc)
+	if err != nil {
+		return nil, err
+	}
+	limit := min(info.Size, ci.Memory)
+	var area []byte
+	for len(area) < limit {
+		if _, done := ndef.TLVLength(area); done {
+			break
+		}
+		page, err := env.readBytes(int(PAGE_SIZE))
+		if err != nil {
+			return nil, env.reactivate(err)
 		}
+		area = append(area, page...)
 	}
-	//If some bytes are remaining in the array, we need to transmit a total of 16 bytes, so we fill it with zeros
-	if len(accumulatedBytes) > 0 {
-		var transmitted bool
-		for {
-			accumulatedBytes = append(accumulatedBytes, 0x00)
-			accumulatedBytes, transmitted, err = env.checkAndTransmit(accumulatedBytes)
-			if err != nil {
-				return err
-			}
-			if transmitted {
-				break
-			}
+	logging.Debugf("NDEF data is % x\n", area)
+	info, err = ndef.Decode(cc, area)
+	if err != nil {
+		return nil, err
+	}
+	for _, record := range info.Records {
+		if mirror, ok := ndef.ParseMirror(env.cfg.Layout.NDEFURL, record.URI); ok {
+			info.Mirror = mirror
+			break
 		}
 	}
+	return info, nil
+}
 
-	return env.cardConnection.EndTransaction(0)
+// reactivate reconnects after a failed read, such as a read of a protected
+// page, which leaves the card halted until it is selected again
+func (env *NFCEnvoriment) reactivate(err error) error {
+	resetErr := env.ResetCard()
+	if resetErr != nil {
+		return fmt.Errorf("%w, then %s", err, resetErr.Error())
+	}
+	return err
+}
+
+// capacity is the number of user memory bytes from the start page
+func (env *NFCEnvoriment) capacity() (int, error) {
+	ci, err := env.getCardInfo()
+	if err != nil {
+		return 0, err
+	}
+	return ci.Memory - (int(env.cfg.Layout.StartPage)-int(USER_MEMORY_PAGE))*int(PAGE_SIZE), nil
+}
+
+// writeBytes writes data from the current page, padding the last page with zeros
+func (env *NFCEnvoriment) writeBytes(data []byte) error {
+	for len(data)%int(PAGE_SIZE) != 0 {
+		data = append(data, 0x00)
+	}
+	for i := 0; i < len(data); i += int(PAGE_SIZE) {
+		err := env.writePage(env.currentPage, data[i:i+int(PAGE_SIZE)])
+		if err != nil {
+			return err
+		}
+		env.currentPage++
+	}
+	return nil
 }
 
 func (env *NFCEnvoriment) BeepReader() error {
 	return env.controlLEDAndBuzzer(false, true, 100, 2)
 }
 
-func (env *NFCEnvoriment) ReadTags() ([]types.Tag, error) {
+// ReadTags reads the tags of the card. Cards written before the header are
+// still decoded but also return tagsdef.ErrOlderFormat. A card that is not a
+// ConCat badge or fails the CRC returns tagsdef.ErrNotConCat or
+// tagsdef.ErrCorrupt. An empty card returns no tags.
+func (env *NFCEnvoriment) ReadTags() (tags []types.Tag, err error) {
+	defer func() {
+		metrics.CardReads.WithLabelValues(env.readerName(), resultLabel(err)).Inc()
+		switch {
+		case errors.Is(err, tagsdef.ErrOlderFormat):
+			env.sendEvent("Card older format")
+		case errors.Is(err, tagsdef.ErrNewerFormat):
+			env.sendEvent("Card newer format")
+		case errors.Is(err, tagsdef.ErrNotConCat):
+			env.sendEvent("Card not ConCat")
+		case errors.Is(err, tagsdef.ErrCorrupt):
+			env.sendEvent("Card corrupt")
+		}
+	}()
 
-	var tags []types.Tag
-	var tagId byte
-	var err error
-	var tagLength byte
-	var readByte byte
-	env.setPage(STARTING_REGION)
-	for {
-		tagId, err = env.readByte()
+	env.setPage(env.cfg.Layout.StartPage)
+	data, err := env.readBytes(tagsdef.HEADER_SIZE)
+	if err != nil {
+		return tags, err
+	}
+	switch {
+	case tagsdef.HasMagic(data):
+		header, err := tagsdef.ParseHeader(data)
 		if err != nil {
 			return tags, err
 		}
-		if tagId == 0x00 {
-			return tags, nil
-		}
-		fmt.Printf("[DEBUG] Found tag 0x%x\n", tagId)
-		tagLength, err = env.readByte()
+		logging.Debugf("Card format version %d, payload length %d\n", header.Version, header.Length)
+		payload, err := env.readBytes(header.Length)
 		if err != nil {
 			return tags, err
 		}
-		fmt.Printf("[DEBUG] Tag length is %d\n", int(tagLength))
-		if tagLength == 0x00 {
-			return tags, fmt.Errorf("Tag length is zero. Probally corrupt data")
+		data = append(data, payload...)
+	case tagsdef.IsLegacyStart(data[0]):
+		// Without header the length is only known once the end marker is found
+		capacity, err := env.capacity()
+		if err != nil {
+			return tags, err
 		}
-		var tagBytes []byte
-		for i := 0; i < int(tagLength); i++ {
-			readByte, err = env.readByte()
+		for {
+			if _, done := tagsdef.LegacyLength(data); done || len(data) >= capacity {
+				break
+			}
+			page, err := env.readBytes(int(PAGE_SIZE))
 			if err != nil {
 				return tags, err
 			}
-			tagBytes = append(tagBytes, readByte)
+			data = append(data, page...)
 		}
-		fmt.Printf("[DEBUG] Tag data is %v\n", tagBytes)
-		tags = append(tags, types.Tag{
-			Id:   tagId,
-			Data: tagBytes,
-		})
-
 	}
+	logging.Debugf("Card data is % x\n", data)
+	return tagsdef.Decode(data)
 }
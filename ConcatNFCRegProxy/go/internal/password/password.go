@@ -0,0 +1,120 @@
+// Package password resolves the NTAG21x password of a card from its UID, so
+// requests do not have to carry it
+package password
+
+import (
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Provider names of the passwords.provider setting
+const (
+	PROVIDER_STATIC = "static"
+	PROVIDER_DERIVE = "derive"
+	PROVIDER_HTTP   = "http"
+)
+
+// DERIVE_INFO is the HKDF info of derived passwords, followed by the UID bytes
+const DERIVE_INFO = "ConCat NFC password v1"
+
+// FACTORY_PASSWORD is the password of a card that was never protected
+const FACTORY_PASSWORD uint32 = 0xffffffff
+
+// PLACEHOLDER_UUID is replaced by the card UID in the lookup URL
+const PLACEHOLDER_UUID = "{uuid}"
+
+type Provider interface {
+	// Password returns the password of the card with the hex UID uid
+	Password(uid string) (uint32, error)
+}
+
+// Static gives every card the same password, for testing
+type Static struct {
+	Value uint32
+}
+
+func (s Static) Password(uid string) (uint32, error) {
+	return s.Value, nil
+}
+
+// Derived computes the password as the first 4 bytes of
+// HKDF-SHA256(secret, no salt, DERIVE_INFO || UID), big endian. 0 and
+// FACTORY_PASSWORD, which mean no password, have their lowest bit flipped.
+type Derived struct {
+	secret []byte
+}
+
+func NewDerived(secret []byte) *Derived {
+	return &Derived{secret: secret}
+}
+
+func (d *Derived) Password(uid string) (uint32, error) {
+	uidBytes, err := hex.DecodeString(uid)
+	if err != nil || len(uidBytes) == 0 {
+		return 0, fmt.Errorf("Invalid card UID %q", uid)
+	}
+	key, err := hkdf.Key(sha256.New, d.secret, nil, DERIVE_INFO+string(uidBytes), 4)
+	if err != nil {
+		return 0, err
+	}
+	value := binary.BigEndian.Uint32(key)
+	if value == 0 || value == FACTORY_PASSWORD {
+		value ^= 1
+	}
+	return value, nil
+}
+
+// HTTP looks the password up on the registration backend, with the endpoint
+// the validator app uses: GET .../{uuid}/password answering {"password": 123}
+type HTTP struct {
+	URL string
+	// Token is sent as bearer token when set
+	Token  string
+	Client *http.Client
+}
+
+func NewHTTP(lookupURL string, token string, timeout time.Duration) *HTTP {
+	return &HTTP{URL: lookupURL, Token: token, Client: &http.Client{Timeout: timeout}}
+}
+
+func (p *HTTP) Password(uid string) (uint32, error) {
+	req, err := http.NewRequest(http.MethodGet, strings.ReplaceAll(p.URL, PLACEHOLDER_UUID, url.PathEscape(uid)), nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if p.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+p.Token)
+	}
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("Password lookup failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("Password lookup for %s failed: %s", uid, resp.Status)
+	}
+	var body struct {
+		Password *int64 `json:"password"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid password lookup response: %w", err)
+	}
+	if body.Password == nil {
+		return 0, fmt.Errorf("No password in the lookup response for %s", uid)
+	}
+	if *body.Password < 0 || *body.Password > math.MaxUint32 {
+		return 0, fmt.Errorf("Password of %s does not fit in 32 bits", uid)
+	}
+	return uint32(*body.Password), nil
+}
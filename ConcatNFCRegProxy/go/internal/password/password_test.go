@@ -0,0 +1,70 @@
+package password
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDerived(t *testing.T) {
+	provider := NewDerived([]byte("0123456789abcdef0123456789abcdef"))
+	first, err := provider.Password("04412a014b3403")
+	assert.NoError(t, err)
+	// Stable, case insensitive and different per card
+	again, err := provider.Password("04412A014B3403")
+	assert.NoError(t, err)
+	assert.Equal(t, first, again)
+	other, err := provider.Password("04412a014b3404")
+	assert.NoError(t, err)
+	assert.NotEqual(t, first, other)
+	assert.NotEqual(t, FACTORY_PASSWORD, first)
+
+	// Another secret gives another password
+	otherSecret, err := NewDerived([]byte("fedcba9876543210fedcba9876543210")).Password("04412a014b3403")
+	assert.NoError(t, err)
+	assert.NotEqual(t, first, otherSecret)
+
+	_, err = provider.Password("not-hex")
+	assert.Error(t, err)
+}
+
+func TestHTTP(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer backend-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/api/badge/nfc/04412a014b3403/password":
+			w.Write([]byte(`{"password": 4294967294}`))
+		case "/api/badge/nfc/04412a014b3404/password":
+			w.Write([]byte(`{}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	provider := NewHTTP(server.URL+"/api/badge/nfc/{uuid}/password", "backend-token", time.Second)
+	value, err := provider.Password("04412a014b3403")
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(4294967294), value)
+
+	_, err = provider.Password("04412a014b3404")
+	assert.ErrorContains(t, err, "No password")
+	_, err = provider.Password("04412a014b3405")
+	assert.ErrorContains(t, err, "404")
+
+	provider.Token = ""
+	_, err = provider.Password("04412a014b3403")
+	assert.ErrorContains(t, err, "401")
+}
+
+func TestStatic(t *testing.T) {
+	value, err := Static{Value: 123}.Password("04412a014b3403")
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(123), value)
+}
@@ -0,0 +1,196 @@
+package signature
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+)
+
+// ErrUnboundSignature is returned for cards whose signature does not cover
+// the card UID while policy requires it
+var ErrUnboundSignature = errors.New("Signature is not bound to the card UID")
+
+var ErrInvalidSignature = errors.New("Signature does not verify")
+
+// ErrUnknownKey is returned when the card names a key id missing from the set
+var ErrUnknownKey = errors.New("Unknown signing key")
+
+// Algorithm is the signature algorithm stored in the signature algorithm tag
+type Algorithm byte
+
+const (
+	// ALG_ES256_DER is ECDSA P-256 with SHA-256, ASN.1 DER encoded (70 to 72
+	// bytes). Cards without an algorithm tag use it.
+	ALG_ES256_DER Algorithm = 1
+	// ALG_ES256_RAW is the same signature as r||s, 64 bytes
+	ALG_ES256_RAW Algorithm = 2
+	// ALG_ED25519 is Ed25519 over the payload, 64 bytes
+	ALG_ED25519 Algorithm = 3
+)
+
+func (alg Algorithm) String() string {
+	switch alg {
+	case ALG_ES256_DER:
+		return "ES256-DER"
+	case ALG_ES256_RAW:
+		return "ES256"
+	case ALG_ED25519:
+		return "EdDSA"
+	}
+	return fmt.Sprintf("unknown(%d)", byte(alg))
+}
+
+// JWK is the subset of RFC 7517 fields used for card signing keys: EC P-256
+// keys and Ed25519 OKP keys (RFC 8037), which have no Y
+type JWK struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y,omitempty"`
+	Kid string `json:"kid,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	Use string `json:"use,omitempty"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+type Key struct {
+	Id string
+	// Public is an *ecdsa.PublicKey or an ed25519.PublicKey
+	Public crypto.PublicKey
+}
+
+// KeySet holds the public keys cards can be signed with
+type KeySet struct {
+	Keys []Key
+}
+
+// LoadKeySet reads a JWK or a JWKS file
+func LoadKeySet(path string) (*KeySet, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	ks, err := ParseKeySet(data)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid key file %s: %w", path, err)
+	}
+	return ks, nil
+}
+
+// ParseKeySet accepts a single JWK or a JWKS
+func ParseKeySet(data []byte) (*KeySet, error) {
+	var set JWKS
+	err := json.Unmarshal(data, &set)
+	if err != nil {
+		return nil, err
+	}
+	if set.Keys == nil {
+		var jwk JWK
+		err = json.Unmarshal(data, &jwk)
+		if err != nil {
+			return nil, err
+		}
+		set.Keys = []JWK{jwk}
+	}
+	ks := &KeySet{}
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		pub, err := jwk.PublicKey()
+		if err != nil {
+			return nil, err
+		}
+		ks.Keys = append(ks.Keys, Key{Id: jwk.Kid, Public: pub})
+	}
+	if len(ks.Keys) == 0 {
+		return nil, fmt.Errorf("No signing key found")
+	}
+	return ks, nil
+}
+
+// PublicKey decodes an EC P-256 or an Ed25519 JWK
+func (jwk JWK) PublicKey() (crypto.PublicKey, error) {
+	if jwk.Kty == "OKP" && jwk.Crv == "Ed25519" {
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("Invalid Ed25519 key %q", jwk.Kid)
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	if jwk.Kty != "EC" || jwk.Crv != "P-256" {
+		return nil, fmt.Errorf("Unsupported key type %s %s, expected EC P-256 or OKP Ed25519", jwk.Kty, jwk.Crv)
+	}
+	x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid x: %w", err)
+	}
+	y, err := base64.RawURLEncoding.DecodeString(jwk.Y)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid y: %w", err)
+	}
+	pub := &ecdsa.PublicKey{
+		Curve: elliptic.P256(),
+		X:     new(big.Int).SetBytes(x),
+		Y:     new(big.Int).SetBytes(y),
+	}
+	if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+		return nil, fmt.Errorf("Key %q is not on the P-256 curve", jwk.Kid)
+	}
+	return pub, nil
+}
+
+// Verify checks a signature of payload made with alg. With a key id only
+// that key is tried, otherwise every key of the set that fits alg, so keys
+// can be rotated without reissuing older badges.
+func (ks *KeySet) Verify(payload []byte, sig []byte, alg Algorithm, kid string) error {
+	if alg != ALG_ES256_DER && alg != ALG_ES256_RAW && alg != ALG_ED25519 {
+		return fmt.Errorf("Unsupported signature algorithm %d", byte(alg))
+	}
+	found := false
+	for _, key := range ks.Keys {
+		if kid != "" && key.Id != kid {
+			continue
+		}
+		found = true
+		if verifyKey(key.Public, payload, sig, alg) {
+			return nil
+		}
+	}
+	if !found && kid != "" {
+		return fmt.Errorf("%w %q", ErrUnknownKey, kid)
+	}
+	return ErrInvalidSignature
+}
+
+func verifyKey(public crypto.PublicKey, payload []byte, sig []byte, alg Algorithm) bool {
+	switch pub := public.(type) {
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(payload)
+		switch alg {
+		case ALG_ES256_DER:
+			return ecdsa.VerifyASN1(pub, digest[:], sig)
+		case ALG_ES256_RAW:
+			if len(sig) != 64 {
+				return false
+			}
+			r := new(big.Int).SetBytes(sig[:32])
+			s := new(big.Int).SetBytes(sig[32:])
+			return ecdsa.Verify(pub, digest[:], r, s)
+		}
+	case ed25519.PublicKey:
+		return alg == ALG_ED25519 && len(sig) == ed25519.SignatureSize && ed25519.Verify(pub, payload, sig)
+	}
+	return false
+}
@@ -0,0 +1,131 @@
+package signature
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testKey(t *testing.T, kid string) (*ecdsa.PrivateKey, JWK) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	return key, JWK{
+		Kty: "EC",
+		Crv: "P-256",
+		X:   base64.RawURLEncoding.EncodeToString(key.PublicKey.X.FillBytes(make([]byte, 32))),
+		Y:   base64.RawURLEncoding.EncodeToString(key.PublicKey.Y.FillBytes(make([]byte, 32))),
+		Kid: kid,
+	}
+}
+
+func TestVerify(t *testing.T) {
+	key, jwk := testKey(t, "2025")
+	_, other := testKey(t, "2024")
+	payload := []byte(`{"conventionId":2,"userId":1}`)
+	digest := sha256.Sum256(payload)
+	sig, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	assert.NoError(t, err)
+
+	single, _ := json.Marshal(jwk)
+	ks, err := ParseKeySet(single)
+	assert.NoError(t, err)
+	assert.NoError(t, ks.Verify(payload, sig, ALG_ES256_DER, ""))
+	assert.Equal(t, ErrInvalidSignature, ks.Verify([]byte(`{"conventionId":2,"userId":2}`), sig, ALG_ES256_DER, ""))
+
+	set, _ := json.Marshal(JWKS{Keys: []JWK{other, jwk}})
+	ks, err = ParseKeySet(set)
+	assert.NoError(t, err)
+	assert.Len(t, ks.Keys, 2)
+	assert.NoError(t, ks.Verify(payload, sig, ALG_ES256_DER, ""))
+	assert.NoError(t, ks.Verify(payload, sig, ALG_ES256_DER, "2025"))
+	assert.Equal(t, ErrInvalidSignature, ks.Verify(payload, sig, ALG_ES256_DER, "2024"))
+	assert.ErrorIs(t, ks.Verify(payload, sig, ALG_ES256_DER, "2023"), ErrUnknownKey)
+	assert.ErrorContains(t, ks.Verify(payload, sig, 9, ""), "Unsupported signature algorithm 9")
+
+	ks, err = ParseKeySet([]byte(`{"keys":[]}`))
+	assert.Error(t, err)
+
+	jwk.Y = jwk.X
+	bad, _ := json.Marshal(jwk)
+	_, err = ParseKeySet(bad)
+	assert.Error(t, err)
+}
+
+func TestVerifyAlgorithms(t *testing.T) {
+	ecKey, ecJWK := testKey(t, "ec")
+	edPublic, edKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	edJWK := JWK{Kty: "OKP", Crv: "Ed25519", X: base64.RawURLEncoding.EncodeToString(edPublic), Kid: "ed"}
+	set, _ := json.Marshal(JWKS{Keys: []JWK{ecJWK, edJWK}})
+	ks, err := ParseKeySet(set)
+	assert.NoError(t, err)
+
+	payload := []byte(`{"conventionId":2,"userId":1}`)
+	digest := sha256.Sum256(payload)
+	r, s, err := ecdsa.Sign(rand.Reader, ecKey, digest[:])
+	assert.NoError(t, err)
+	raw := append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	assert.NoError(t, ks.Verify(payload, raw, ALG_ES256_RAW, "ec"))
+	assert.NoError(t, ks.Verify(payload, raw, ALG_ES256_RAW, ""))
+	assert.Equal(t, ErrInvalidSignature, ks.Verify(payload, raw, ALG_ES256_DER, "ec"))
+	assert.Equal(t, ErrInvalidSignature, ks.Verify(payload, raw[:63], ALG_ES256_RAW, "ec"))
+
+	edSig := ed25519.Sign(edKey, payload)
+	assert.NoError(t, ks.Verify(payload, edSig, ALG_ED25519, "ed"))
+	assert.NoError(t, ks.Verify(payload, edSig, ALG_ED25519, ""))
+	// The key id picks the key, an Ed25519 signature never verifies with the EC key
+	assert.Equal(t, ErrInvalidSignature, ks.Verify(payload, edSig, ALG_ED25519, "ec"))
+	assert.Equal(t, ErrInvalidSignature, ks.Verify([]byte(`{"conventionId":2,"userId":2}`), edSig, ALG_ED25519, "ed"))
+
+	edJWK.X = edJWK.X[:10]
+	bad, _ := json.Marshal(edJWK)
+	_, err = ParseKeySet(bad)
+	assert.Error(t, err)
+}
+
+func TestVerifyVectors(t *testing.T) {
+	data, err := os.ReadFile("../../../../testvectors/signing-payload.json")
+	assert.NoError(t, err)
+	var file struct {
+		PublicKey        JWK `json:"publicKey"`
+		Ed25519PublicKey JWK `json:"ed25519PublicKey"`
+		Vectors          []struct {
+			Name string `json:"name"`
+			Tags []struct {
+				Id   byte   `json:"id"`
+				Data string `json:"data"`
+			} `json:"tags"`
+			Payload string `json:"payload"`
+		} `json:"vectors"`
+	}
+	assert.NoError(t, json.Unmarshal(data, &file))
+	keys, _ := json.Marshal(JWKS{Keys: []JWK{file.PublicKey, file.Ed25519PublicKey}})
+	ks, err := ParseKeySet(keys)
+	assert.NoError(t, err)
+
+	for _, v := range file.Vectors {
+		var sig []byte
+		alg, kid := ALG_ES256_DER, ""
+		for _, tag := range v.Tags {
+			value, _ := hex.DecodeString(tag.Data)
+			switch tag.Id {
+			case 0x02:
+				sig = value
+			case 0x0B:
+				alg = Algorithm(value[0])
+			case 0x0C:
+				kid = string(value)
+			}
+		}
+		assert.NoError(t, ks.Verify([]byte(v.Payload), sig, alg, kid), v.Name)
+	}
+}
@@ -0,0 +1,290 @@
+package signature
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var ErrWrongPassphrase = errors.New("Wrong passphrase for the private key")
+
+var (
+	oidPBES2          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACWithSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidAES128CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+// Signer signs card payloads with a local P-256 key, for stations that
+// cannot reach the registration backend
+type Signer struct {
+	// KeyId identifies the key in the issuance log and in JWKS files
+	KeyId string
+	key   *ecdsa.PrivateKey
+}
+
+// LoadSigner reads a PEM private key. Encrypted keys need the passphrase.
+// Without keyId, the RFC 7638 thumbprint of the public key is used.
+func LoadSigner(path string, passphrase string, keyId string) (*Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s, err := ParseSigner(data, passphrase, keyId)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid private key file %s: %w", path, err)
+	}
+	return s, nil
+}
+
+// ParseSigner accepts SEC 1 (EC PRIVATE KEY), PKCS #8 (PRIVATE KEY) and
+// PBES2 encrypted PKCS #8 (ENCRYPTED PRIVATE KEY) keys, as written by
+// `openssl genpkey -algorithm EC -pkeyopt ec_paramgen_curve:P-256 [-aes256]`
+func ParseSigner(data []byte, passphrase string, keyId string) (*Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("No PEM block found")
+	}
+	var key any
+	var err error
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		if _, encrypted := block.Headers["Proc-Type"]; encrypted {
+			return nil, fmt.Errorf("Legacy encrypted PEM keys are not supported, convert the key with `openssl pkcs8 -topk8`")
+		}
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "ENCRYPTED PRIVATE KEY":
+		if passphrase == "" {
+			return nil, fmt.Errorf("The private key is encrypted and no passphrase is set")
+		}
+		var der []byte
+		der, err = decryptPKCS8(block.Bytes, passphrase)
+		if err != nil {
+			return nil, err
+		}
+		key, err = x509.ParsePKCS8PrivateKey(der)
+		if err != nil {
+			// The padding check lets about one wrong passphrase in 256 through
+			return nil, ErrWrongPassphrase
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	ecKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok || ecKey.Curve != elliptic.P256() {
+		return nil, fmt.Errorf("Only EC P-256 private keys are supported")
+	}
+	s := &Signer{KeyId: keyId, key: ecKey}
+	if s.KeyId == "" {
+		s.KeyId = s.PublicJWK().Thumbprint()
+	}
+	return s, nil
+}
+
+// Sign returns a SHA256withECDSA signature of payload, ASN.1 DER encoded
+// for ALG_ES256_DER or r||s for ALG_ES256_RAW
+func (s *Signer) Sign(payload []byte, alg Algorithm) ([]byte, error) {
+	digest := sha256.Sum256(payload)
+	switch alg {
+	case ALG_ES256_DER:
+		return ecdsa.SignASN1(rand.Reader, s.key, digest[:])
+	case ALG_ES256_RAW:
+		r, sv, err := ecdsa.Sign(rand.Reader, s.key, digest[:])
+		if err != nil {
+			return nil, err
+		}
+		sig := make([]byte, 64)
+		r.FillBytes(sig[:32])
+		sv.FillBytes(sig[32:])
+		return sig, nil
+	}
+	return nil, fmt.Errorf("The offline key cannot make %s signatures", alg)
+}
+
+// PublicJWK returns the public key, to add to the JWKS validators use
+func (s *Signer) PublicJWK() JWK {
+	return JWK{
+		Kty: "EC",
+		Crv: "P-256",
+		X:   base64.RawURLEncoding.EncodeToString(s.key.X.FillBytes(make([]byte, 32))),
+		Y:   base64.RawURLEncoding.EncodeToString(s.key.Y.FillBytes(make([]byte, 32))),
+		Kid: s.KeyId,
+		Use: "sig",
+	}
+}
+
+// Thumbprint returns the RFC 7638 SHA-256 thumbprint of an EC key
+func (jwk JWK) Thumbprint() string {
+	// Required members only, in lexicographic order
+	canonical := fmt.Sprintf(`{"crv":%q,"kty":%q,"x":%q,"y":%q}`, jwk.Crv, jwk.Kty, jwk.X, jwk.Y)
+	digest := sha256.Sum256([]byte(canonical))
+	return base64.RawURLEncoding.EncodeToString(digest[:])
+}
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// decryptPKCS8 decrypts a PBES2 EncryptedPrivateKeyInfo (RFC 8018) using
+// PBKDF2 and AES-CBC, the scheme OpenSSL uses by default
+func decryptPKCS8(der []byte, passphrase string) ([]byte, error) {
+	var info encryptedPrivateKeyInfo
+	_, err := asn1.Unmarshal(der, &info)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid encrypted key: %w", err)
+	}
+	if !info.Algorithm.Algorithm.Equal(oidPBES2) {
+		return nil, fmt.Errorf("Unsupported key encryption %s, only PBES2 is supported", info.Algorithm.Algorithm)
+	}
+	var params pbes2Params
+	_, err = asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &params)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid PBES2 parameters: %w", err)
+	}
+	if !params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) {
+		return nil, fmt.Errorf("Unsupported key derivation %s, only PBKDF2 is supported", params.KeyDerivationFunc.Algorithm)
+	}
+	var kdf pbkdf2Params
+	_, err = asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdf)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid PBKDF2 parameters: %w", err)
+	}
+	var prf func() hash.Hash
+	switch {
+	case len(kdf.PRF.Algorithm) == 0 || kdf.PRF.Algorithm.Equal(oidHMACWithSHA1):
+		prf = sha1.New
+	case kdf.PRF.Algorithm.Equal(oidHMACWithSHA256):
+		prf = sha256.New
+	default:
+		return nil, fmt.Errorf("Unsupported PBKDF2 hash %s", kdf.PRF.Algorithm)
+	}
+	var keyLen int
+	switch {
+	case params.EncryptionScheme.Algorithm.Equal(oidAES128CBC):
+		keyLen = 16
+	case params.EncryptionScheme.Algorithm.Equal(oidAES192CBC):
+		keyLen = 24
+	case params.EncryptionScheme.Algorithm.Equal(oidAES256CBC):
+		keyLen = 32
+	default:
+		return nil, fmt.Errorf("Unsupported key cipher %s, only AES-CBC is supported", params.EncryptionScheme.Algorithm)
+	}
+	var iv []byte
+	_, err = asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv)
+	if err != nil || len(iv) != aes.BlockSize {
+		return nil, fmt.Errorf("Invalid AES-CBC IV")
+	}
+	if len(info.EncryptedData) == 0 || len(info.EncryptedData)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("Invalid encrypted key length")
+	}
+
+	key, err := pbkdf2.Key(prf, passphrase, kdf.Salt, kdf.IterationCount, keyLen)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	plain := make([]byte, len(info.EncryptedData))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, info.EncryptedData)
+
+	// A wrong passphrase shows up as invalid PKCS #7 padding
+	padding := int(plain[len(plain)-1])
+	if padding == 0 || padding > aes.BlockSize {
+		return nil, ErrWrongPassphrase
+	}
+	for _, b := range plain[len(plain)-padding:] {
+		if int(b) != padding {
+			return nil, ErrWrongPassphrase
+		}
+	}
+	return plain[:len(plain)-padding], nil
+}
+
+// Issuance records a card signed by the proxy, so the registration backend
+// can reconcile it once it is reachable again
+type Issuance struct {
+	Time         time.Time `json:"time"`
+	KeyId        string    `json:"keyId"`
+	UUID         string    `json:"uuid"`
+	AttendeeId   uint32    `json:"attendeeId"`
+	ConventionId uint32    `json:"conventionId"`
+	Issuance     uint64    `json:"issuance"`
+	Payload      string    `json:"payload"`
+	Signature    string    `json:"signature"`
+}
+
+// IssuanceLog appends issuances to a file, one JSON object per line
+type IssuanceLog struct {
+	path string
+	mu   sync.Mutex
+}
+
+func NewIssuanceLog(path string) *IssuanceLog {
+	return &IssuanceLog{path: path}
+}
+
+// Append writes the issuance and syncs the file, so a record is never lost
+// for a card that was handed out
+func (l *IssuanceLog) Append(issuance Issuance) error {
+	line, err := json.Marshal(issuance)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	err = os.MkdirAll(filepath.Dir(l.path), 0700)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(line, '\n'))
+	if err != nil {
+		return err
+	}
+	return f.Sync()
+}
@@ -0,0 +1,80 @@
+package signature
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadSigner(t *testing.T) {
+	plain, err := LoadSigner("testdata/offline-key.pem", "", "")
+	assert.NoError(t, err)
+	// Key files written by openssl: PKCS #8, SEC 1 and PBES2 encrypted PKCS #8
+	sec1, err := LoadSigner("testdata/offline-key-sec1.pem", "", "")
+	assert.NoError(t, err)
+	encrypted, err := LoadSigner("testdata/offline-key-encrypted.pem", "correct horse", "")
+	assert.NoError(t, err)
+	assert.Equal(t, plain.PublicJWK(), sec1.PublicJWK())
+	assert.Equal(t, plain.PublicJWK(), encrypted.PublicJWK())
+	assert.Len(t, plain.KeyId, 43)
+
+	_, err = LoadSigner("testdata/offline-key-encrypted.pem", "wrong horse", "")
+	assert.ErrorIs(t, err, ErrWrongPassphrase)
+	_, err = LoadSigner("testdata/offline-key-encrypted.pem", "", "")
+	assert.Error(t, err)
+
+	named, err := LoadSigner("testdata/offline-key.pem", "", "station-3")
+	assert.NoError(t, err)
+	assert.Equal(t, "station-3", named.KeyId)
+
+	// Offline signatures verify against the public key
+	payload := []byte(`{"conventionId":2,"userId":1}`)
+	sig, err := plain.Sign(payload, ALG_ES256_DER)
+	assert.NoError(t, err)
+	jwk, _ := json.Marshal(plain.PublicJWK())
+	ks, err := ParseKeySet(jwk)
+	assert.NoError(t, err)
+	assert.NoError(t, ks.Verify(payload, sig, ALG_ES256_DER, plain.KeyId))
+	raw, err := plain.Sign(payload, ALG_ES256_RAW)
+	assert.NoError(t, err)
+	assert.Len(t, raw, 64)
+	assert.NoError(t, ks.Verify(payload, raw, ALG_ES256_RAW, plain.KeyId))
+	_, err = plain.Sign(payload, ALG_ED25519)
+	assert.Error(t, err)
+}
+
+func TestThumbprint(t *testing.T) {
+	// The EC key of RFC 7517 appendix A.1, hashed over {"crv","kty","x","y"} as RFC 7638 requires
+	jwk := JWK{
+		Kty: "EC",
+		Crv: "P-256",
+		X:   "MKBCTNIcKUSDii11ySs3526iDZ8AiTo7Tu6KPAqv7D4",
+		Y:   "4Etl6SRW2YilurN5XEJhUn9bIN6v9zlmkeG9zKOjaXU",
+		Kid: "1",
+	}
+	assert.Equal(t, "l9qz7RLuHh_F_5Er60BCwUiojfvF2DACMJC6il7vRrk", jwk.Thumbprint())
+}
+
+func TestIssuanceLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "offline", "issuance.jsonl")
+	log := NewIssuanceLog(path)
+	assert.NoError(t, log.Append(Issuance{KeyId: "k1", UUID: "04412a014b3403", AttendeeId: 1}))
+	assert.NoError(t, log.Append(Issuance{KeyId: "k1", UUID: "04412a014b3404", AttendeeId: 2}))
+
+	f, err := os.Open(path)
+	assert.NoError(t, err)
+	defer f.Close()
+	var lines []Issuance
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry Issuance
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &entry))
+		lines = append(lines, entry)
+	}
+	assert.Len(t, lines, 2)
+	assert.Equal(t, uint32(2), lines[1].AttendeeId)
+}
@@ -0,0 +1,144 @@
+package tags
+
+import (
+	"fmt"
+
+	"ConcatNFCRegProxy/types"
+)
+
+// Encode returns the card image for tags: the header, the tags as id, length,
+// value and the end marker. Tags with payload version PAYLOAD_COSE are
+// written as a COSE_Sign1 message instead of TLV.
+func Encode(tags []types.Tag) ([]byte, error) {
+	version := CARD_FORMAT_VERSION
+	encode := encodeTLV
+	if PayloadVersion(tags) == PAYLOAD_COSE {
+		version = CARD_FORMAT_COSE
+		encode = encodeCOSE
+	}
+	payload, err := encode(tags)
+	if err != nil {
+		return nil, err
+	}
+	header, err := encodeHeader(version, payload)
+	if err != nil {
+		return nil, err
+	}
+	data := append(header, payload...)
+	return append(data, 0x00), nil
+}
+
+// Decode parses a card image. Bytes after the payload are ignored, so data
+// can be the whole user memory.
+//
+// An empty card returns no tags. A card written before the header returns its
+// tags along with ErrOlderFormat. Otherwise errors wrap ErrNotConCat,
+// ErrNewerFormat or ErrCorrupt.
+func Decode(data []byte) ([]types.Tag, error) {
+	if len(data) == 0 || data[0] == 0x00 {
+		return nil, nil
+	}
+	if HasMagic(data) {
+		if len(data) < HEADER_SIZE {
+			return nil, fmt.Errorf("%w: header is truncated", ErrCorrupt)
+		}
+		header, err := ParseHeader(data[:HEADER_SIZE])
+		if err != nil {
+			return nil, err
+		}
+		if len(data)-HEADER_SIZE < header.Length {
+			return nil, fmt.Errorf("%w: payload is %d bytes but only %d are left", ErrCorrupt, header.Length, len(data)-HEADER_SIZE)
+		}
+		payload := data[HEADER_SIZE : HEADER_SIZE+header.Length]
+		err = header.CheckPayload(payload)
+		if err != nil {
+			return nil, err
+		}
+		if header.Version == CARD_FORMAT_COSE {
+			return decodeCOSE(payload)
+		}
+		tags, end, err := decodeTLV(payload)
+		if err != nil {
+			return nil, err
+		}
+		if end != len(payload) {
+			return nil, fmt.Errorf("%w: end marker inside the payload", ErrCorrupt)
+		}
+		return tags, nil
+	}
+	if !IsLegacyStart(data[0]) {
+		return nil, ErrNotConCat
+	}
+	tags, _, err := decodeTLV(data)
+	if err != nil {
+		return nil, err
+	}
+	return tags, ErrOlderFormat
+}
+
+// LegacyLength tells how many bytes of a card without header hold its tags,
+// including the end marker. It returns false while data is too short to tell.
+func LegacyLength(data []byte) (int, bool) {
+	_, end, err := decodeTLV(data)
+	if err != nil {
+		return 0, false
+	}
+	if end == len(data) {
+		return 0, false
+	}
+	return end + 1, true
+}
+
+// decodeTLV parses tags until an end marker or the end of data. It returns
+// the position of the end marker, or len(data) when there is none.
+func decodeTLV(data []byte) ([]types.Tag, int, error) {
+	var tags []types.Tag
+	pos := 0
+	for pos < len(data) {
+		id := data[pos]
+		if id == 0x00 {
+			return tags, pos, nil
+		}
+		pos++
+		if pos >= len(data) {
+			return tags, pos, fmt.Errorf("%w: tag 0x%02x has no length", ErrCorrupt, id)
+		}
+		length := int(data[pos])
+		pos++
+		if data[pos-1] == EXTENDED_LENGTH {
+			if len(data)-pos < 2 {
+				return tags, pos, fmt.Errorf("%w: tag 0x%02x has a truncated length", ErrCorrupt, id)
+			}
+			length = DecodeExtendedLength(data[pos : pos+2])
+			pos += 2
+		}
+		if length == 0 {
+			return tags, pos, fmt.Errorf("%w: tag 0x%02x has length zero", ErrCorrupt, id)
+		}
+		if len(data)-pos < length {
+			return tags, pos, fmt.Errorf("%w: tag 0x%02x is %d bytes but only %d are left", ErrCorrupt, id, length, len(data)-pos)
+		}
+		tags = append(tags, types.Tag{Id: id, Data: append([]byte{}, data[pos:pos+length]...)})
+		pos += length
+	}
+	return tags, pos, nil
+}
+
+// encodeTLV writes tags as id, length, value without header or end marker
+func encodeTLV(tags []types.Tag) ([]byte, error) {
+	var data []byte
+	for _, tag := range tags {
+		err := CheckTag(tag)
+		if err != nil {
+			return nil, err
+		}
+		length, err := EncodeLength(len(tag.Data))
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, tag.Id)
+		data = append(data, length...)
+		data = append(data, tag.Data...)
+	}
+	return data, nil
+}
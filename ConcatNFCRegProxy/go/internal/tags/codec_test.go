@@ -0,0 +1,140 @@
+package tags
+
+import (
+	"errors"
+	"testing"
+
+	"ConcatNFCRegProxy/types"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncodeDecode(t *testing.T) {
+	written := []types.Tag{
+		{Id: TAG_ATTENDEE_ID, Data: []byte{0, 0, 0, 1, 0, 0, 0, 2}},
+		{Id: 0x30, Data: []byte{0xaa}},
+		{Id: TAG_SIGNATURE, Data: make([]byte, 300)},
+	}
+	data, err := Encode(written)
+	assert.NoError(t, err)
+	assert.Equal(t, HEADER_SIZE+10+3+304+1, len(data))
+	assert.Equal(t, byte(0x00), data[len(data)-1])
+
+	// Trailing bytes of the user memory are ignored
+	read, err := Decode(append(data, 0xde, 0xad))
+	assert.NoError(t, err)
+	assert.Equal(t, written, read)
+
+	read, err = Decode([]byte{0x00, 0x12, 0x34})
+	assert.NoError(t, err)
+	assert.Empty(t, read)
+
+	_, err = Decode([]byte{0x42, 0x01, 0x02})
+	assert.Equal(t, ErrNotConCat, err)
+
+	_, err = Encode([]types.Tag{{Id: TAG_SIGNATURE, Data: make([]byte, MAX_SIGNATURE+1)}})
+	assert.Error(t, err)
+}
+
+func TestDecodeLegacy(t *testing.T) {
+	legacy := []byte{TAG_ISSUANCE, 0x04, 0, 0, 0, 7, TAG_SIGNATURE, 0x02, 0xca, 0xfe, 0x00, 0xff, 0xff}
+	read, err := Decode(legacy)
+	assert.Equal(t, ErrOlderFormat, err)
+	assert.Equal(t, []types.Tag{
+		{Id: TAG_ISSUANCE, Data: []byte{0, 0, 0, 7}},
+		{Id: TAG_SIGNATURE, Data: []byte{0xca, 0xfe}},
+	}, read)
+
+	length, done := LegacyLength(legacy)
+	assert.True(t, done)
+	assert.Equal(t, 11, length)
+	_, done = LegacyLength(legacy[:8])
+	assert.False(t, done)
+	_, done = LegacyLength(legacy[:10])
+	assert.False(t, done)
+}
+
+func TestDecodeBounds(t *testing.T) {
+	valid, err := Encode([]types.Tag{{Id: TAG_ISSUANCE, Data: []byte{0, 0, 0, 1}}})
+	assert.NoError(t, err)
+
+	for name, data := range map[string][]byte{
+		"truncated header":  valid[:5],
+		"truncated payload": valid[:HEADER_SIZE+3],
+		"no length":         {TAG_ISSUANCE},
+		"zero length":       {TAG_ISSUANCE, 0x00},
+		"short value":       {TAG_ISSUANCE, 0x04, 0, 0},
+		"short extended":    {TAG_SIGNATURE, 0xff, 0x01},
+		"long extended":     {TAG_SIGNATURE, 0xff, 0xff, 0xff, 0x01},
+	} {
+		_, err := Decode(data)
+		assert.True(t, errors.Is(err, ErrCorrupt), "%s: %v", name, err)
+	}
+
+	// An end marker inside the payload does not match the header length
+	header, err := EncodeHeader([]byte{TAG_ISSUANCE, 0x01, 0x07, 0x00})
+	assert.NoError(t, err)
+	_, err = Decode(append(header, TAG_ISSUANCE, 0x01, 0x07, 0x00))
+	assert.True(t, errors.Is(err, ErrCorrupt))
+}
+
+func FuzzDecode(f *testing.F) {
+	valid, _ := Encode([]types.Tag{
+		{Id: TAG_ATTENDEE_ID, Data: []byte{0, 0, 0, 1, 0, 0, 0, 2}},
+		{Id: TAG_SIGNATURE, Data: make([]byte, 260)},
+	})
+	f.Add(valid)
+	cose, _ := Encode([]types.Tag{
+		{Id: TAG_ATTENDEE_ID, Data: []byte{0, 0, 0, 1, 0, 0, 0, 2}},
+		{Id: TAG_TIER, Data: []byte("Staff")},
+		{Id: TAG_PAYLOAD_VERSION, Data: []byte{PAYLOAD_COSE}},
+		{Id: TAG_SIGNATURE_ALG, Data: []byte{2}},
+		{Id: TAG_SIGNATURE, Data: make([]byte, 64)},
+	})
+	f.Add(cose)
+	f.Add([]byte{TAG_ISSUANCE, 0x04, 0, 0, 0, 7, 0x00})
+	f.Add([]byte{'C', 'C', 0x01, 0x00, 0x03, 0, 0, 0, 0, TAG_ISSUANCE, 0x01, 0x07})
+	f.Add([]byte{TAG_SIGNATURE, 0xff, 0x01, 0x00})
+	f.Add([]byte{})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		tags, err := Decode(data)
+		if err != nil && !errors.Is(err, ErrOlderFormat) {
+			return
+		}
+		for _, tag := range tags {
+			if tag.Id == 0x00 || len(tag.Data) == 0 || len(tag.Data) > MAX_TAG_LENGTH {
+				t.Fatalf("Decoded an invalid tag %v", tag)
+			}
+		}
+		// Whatever decodes must survive a write and read back
+		encoded, err := Encode(tags)
+		if err != nil {
+			return
+		}
+		again, err := Decode(encoded)
+		if err != nil {
+			t.Fatalf("Cannot decode what was encoded: %v", err)
+		}
+		assert.Equal(t, len(tags), len(again))
+		for i := range tags {
+			assert.Equal(t, tags[i], again[i])
+		}
+	})
+}
+
+func FuzzEncode(f *testing.F) {
+	f.Add(byte(0x01), []byte{0, 0, 0, 1, 0, 0, 0, 2}, byte(0x30), []byte{0xaa})
+	f.Add(byte(0x02), make([]byte, 300), byte(0xb0), []byte{})
+	f.Fuzz(func(t *testing.T, id1 byte, data1 []byte, id2 byte, data2 []byte) {
+		written := []types.Tag{{Id: id1, Data: data1}, {Id: id2, Data: data2}}
+		encoded, err := Encode(written)
+		if err != nil {
+			return
+		}
+		read, err := Decode(encoded)
+		if err != nil {
+			t.Fatalf("Cannot decode what was encoded: %v", err)
+		}
+		assert.Equal(t, written, read)
+	})
+}
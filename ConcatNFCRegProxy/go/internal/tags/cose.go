@@ -0,0 +1,314 @@
+package tags
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"slices"
+
+	"ConcatNFCRegProxy/types"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// Card formats of the tags.format setting. COSE cards are written whenever
+// the tags carry payload version PAYLOAD_COSE, see ToCOSE.
+const (
+	FORMAT_TLV  = "tlv"
+	FORMAT_COSE = "cose"
+)
+
+// COSE labels and algorithms used by COSE cards, from RFC 9052 and RFC 9053
+const (
+	COSE_SIGN1_TAG  = 18
+	COSE_HEADER_ALG = 1
+	COSE_HEADER_KID = 4
+	COSE_ALG_ES256  = -7
+	COSE_ALG_EDDSA  = -8
+)
+
+// coseAlgorithms maps signature algorithm tag values to COSE algorithms.
+// COSE has no DER encoded ECDSA, so algorithm 1 cannot be used.
+var coseAlgorithms = map[uint64]int64{
+	2: COSE_ALG_ES256,
+	3: COSE_ALG_EDDSA,
+}
+
+// ES256_SIGNATURE_SIZE is the length of a raw r||s ECDSA P-256 signature
+const ES256_SIGNATURE_SIZE = 64
+
+// coseHeaderTags are stored in the COSE structure instead of the payload map
+var coseHeaderTags = []byte{TAG_SIGNATURE, TAG_SIGNATURE_ALG, TAG_KEY_ID, TAG_PAYLOAD_VERSION}
+
+var coseEncoding cbor.EncMode
+
+func init() {
+	var err error
+	coseEncoding, err = cbor.CoreDetEncOptions().EncMode()
+	if err != nil {
+		panic(err)
+	}
+}
+
+// coseSign1 is the content of a COSE_Sign1 message
+type coseSign1 struct {
+	_           struct{} `cbor:",toarray"`
+	Protected   []byte
+	Unprotected map[int64]any
+	Payload     []byte
+	Signature   []byte
+}
+
+// ToCOSE marks tags to be written as a COSE card: payload version
+// PAYLOAD_COSE and, when the tags name no algorithm, raw ECDSA P-256
+// signatures. Tags asking for DER signatures are refused, since the
+// signature would not match its algorithm, and so is a signature without an
+// algorithm that is not 64 bytes long, such as a DER one. The signature has
+// to be made over the new payload.
+func ToCOSE(tags []types.Tag) ([]types.Tag, error) {
+	converted := make([]types.Tag, 0, len(tags)+2)
+	var sig []byte
+	for _, tag := range tags {
+		if tag.Id == TAG_SIGNATURE {
+			sig = tag.Data
+		}
+		if tag.Id == TAG_PAYLOAD_VERSION {
+			continue
+		}
+		converted = append(converted, tag)
+	}
+	alg, _ := SignatureKey(tags)
+	if alg == 1 && hasTag(tags, TAG_SIGNATURE_ALG) {
+		return nil, fmt.Errorf("COSE cards have no DER ECDSA signatures, use signatureAlg 2")
+	}
+	if alg == 1 && sig != nil && len(sig) != ES256_SIGNATURE_SIZE {
+		return nil, fmt.Errorf("COSE cards need a %d byte raw ECDSA signature, got %d bytes; set signatureAlg to name another algorithm", ES256_SIGNATURE_SIZE, len(sig))
+	}
+	converted = insertBeforeSignature(converted, types.Tag{Id: TAG_PAYLOAD_VERSION, Data: []byte{PAYLOAD_COSE}})
+	if alg == 1 {
+		converted = insertBeforeSignature(converted, types.Tag{Id: TAG_SIGNATURE_ALG, Data: []byte{2}})
+	}
+	return converted, nil
+}
+
+// coseSigningPayload returns the COSE Sig_structure of tags: the protected
+// header and the payload map as stored on the card, with the card UID as
+// external data
+func coseSigningPayload(tags []types.Tag, uid []byte) ([]byte, error) {
+	protected, payload, err := coseContent(tags)
+	if err != nil {
+		return nil, err
+	}
+	return coseEncoding.Marshal([]any{"Signature1", protected, uid, payload})
+}
+
+// encodeCOSE returns the COSE_Sign1 message stored on a COSE card
+func encodeCOSE(tags []types.Tag) ([]byte, error) {
+	protected, payload, err := coseContent(tags)
+	if err != nil {
+		return nil, err
+	}
+	var sig []byte
+	for _, tag := range tags {
+		if tag.Id == TAG_SIGNATURE {
+			sig = tag.Data
+		}
+	}
+	if sig == nil {
+		return nil, fmt.Errorf("COSE cards need a signature")
+	}
+	return coseEncoding.Marshal(cbor.Tag{Number: COSE_SIGN1_TAG, Content: coseSign1{
+		Protected:   protected,
+		Unprotected: map[int64]any{},
+		Payload:     payload,
+		Signature:   sig,
+	}})
+}
+
+// coseContent encodes the protected header, with the algorithm and key id,
+// and the payload map of every other tag keyed by tag id
+func coseContent(tags []types.Tag) (protected []byte, payload []byte, err error) {
+	alg, kid := SignatureKey(tags)
+	coseAlg, ok := coseAlgorithms[alg]
+	if !ok {
+		return nil, nil, fmt.Errorf("COSE cards are signed with signatureAlg 2 or 3, not %d", alg)
+	}
+	header := map[int64]any{COSE_HEADER_ALG: coseAlg}
+	if kid != "" {
+		header[COSE_HEADER_KID] = []byte(kid)
+	}
+	protected, err = coseEncoding.Marshal(header)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	values := map[uint64]any{}
+	for _, tag := range tags {
+		if bytes.IndexByte(coseHeaderTags, tag.Id) >= 0 {
+			continue
+		}
+		if _, duplicate := values[uint64(tag.Id)]; duplicate {
+			return nil, nil, fmt.Errorf("Tag 0x%02x is on the card twice", tag.Id)
+		}
+		def, known := Lookup(tag.Id)
+		if !known {
+			values[uint64(tag.Id)] = tag.Data
+			continue
+		}
+		err = def.checkSize(len(tag.Data))
+		if err != nil {
+			return nil, nil, err
+		}
+		switch def.Type {
+		case VALUE_UINT, VALUE_TIMESTAMP:
+			values[uint64(tag.Id)] = decodeUint(tag.Data)
+		case VALUE_UINT_PAIR:
+			values[uint64(tag.Id)] = []uint64{decodeUint(tag.Data[0:4]), decodeUint(tag.Data[4:8])}
+		case VALUE_STRING:
+			values[uint64(tag.Id)] = string(tag.Data)
+		default:
+			values[uint64(tag.Id)] = tag.Data
+		}
+	}
+	payload, err = coseEncoding.Marshal(values)
+	return protected, payload, err
+}
+
+// decodeCOSE parses the COSE_Sign1 message of a COSE card back into tags.
+// Messages that are not in the deterministic encoding ToCOSE cards are
+// written in are refused, so the signed bytes are the stored bytes.
+func decodeCOSE(data []byte) ([]types.Tag, error) {
+	var raw cbor.RawTag
+	err := cbor.Unmarshal(data, &raw)
+	if err != nil || raw.Number != COSE_SIGN1_TAG {
+		return nil, fmt.Errorf("%w: not a COSE_Sign1 message", ErrCorrupt)
+	}
+	var msg coseSign1
+	err = cbor.Unmarshal(raw.Content, &msg)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrCorrupt, err.Error())
+	}
+	if len(msg.Unprotected) != 0 {
+		return nil, fmt.Errorf("%w: unexpected unprotected header", ErrCorrupt)
+	}
+
+	var header map[int64]cbor.RawMessage
+	err = cbor.Unmarshal(msg.Protected, &header)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid protected header", ErrCorrupt)
+	}
+	var coseAlg int64
+	var kid []byte
+	if cbor.Unmarshal(header[COSE_HEADER_ALG], &coseAlg) != nil {
+		return nil, fmt.Errorf("%w: no COSE algorithm", ErrCorrupt)
+	}
+	if header[COSE_HEADER_KID] != nil && cbor.Unmarshal(header[COSE_HEADER_KID], &kid) != nil {
+		return nil, fmt.Errorf("%w: invalid COSE key id", ErrCorrupt)
+	}
+	var alg uint64
+	for tagAlg, value := range coseAlgorithms {
+		if value == coseAlg {
+			alg = tagAlg
+		}
+	}
+	if alg == 0 {
+		return nil, fmt.Errorf("%w: unsupported COSE algorithm %d", ErrCorrupt, coseAlg)
+	}
+
+	var values map[uint64]cbor.RawMessage
+	err = cbor.Unmarshal(msg.Payload, &values)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid payload map", ErrCorrupt)
+	}
+	var tags []types.Tag
+	for _, def := range registry {
+		value, ok := values[uint64(def.Id)]
+		if !ok {
+			continue
+		}
+		delete(values, uint64(def.Id))
+		if bytes.IndexByte(coseHeaderTags, def.Id) >= 0 {
+			return nil, fmt.Errorf("%w: tag %s in the payload map", ErrCorrupt, def.Name)
+		}
+		data, err := decodeCOSEValue(def, value)
+		if err != nil {
+			return nil, fmt.Errorf("%w: tag %s: %s", ErrCorrupt, def.Name, err.Error())
+		}
+		tags = append(tags, types.Tag{Id: def.Id, Data: data})
+	}
+	unknown := make([]uint64, 0, len(values))
+	for id := range values {
+		unknown = append(unknown, id)
+	}
+	slices.Sort(unknown)
+	for _, id := range unknown {
+		var data []byte
+		if id > 0xff || id == 0 || cbor.Unmarshal(values[id], &data) != nil {
+			return nil, fmt.Errorf("%w: invalid unknown tag %d", ErrCorrupt, id)
+		}
+		tags = append(tags, types.Tag{Id: byte(id), Data: data})
+	}
+	tags = append(tags, types.Tag{Id: TAG_PAYLOAD_VERSION, Data: []byte{PAYLOAD_COSE}})
+	tags = append(tags, types.Tag{Id: TAG_SIGNATURE_ALG, Data: []byte{byte(alg)}})
+	if len(kid) > 0 {
+		tags = append(tags, types.Tag{Id: TAG_KEY_ID, Data: kid})
+	}
+	tags = append(tags, types.Tag{Id: TAG_SIGNATURE, Data: msg.Signature})
+
+	for _, tag := range tags {
+		if len(tag.Data) == 0 || len(tag.Data) > MAX_TAG_LENGTH {
+			return nil, fmt.Errorf("%w: tag 0x%02x has length %d", ErrCorrupt, tag.Id, len(tag.Data))
+		}
+	}
+
+	encoded, err := encodeCOSE(tags)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrCorrupt, err.Error())
+	}
+	if !bytes.Equal(encoded, data) {
+		return nil, fmt.Errorf("%w: COSE message is not deterministically encoded", ErrCorrupt)
+	}
+	return tags, nil
+}
+
+// decodeCOSEValue turns a payload map value back into the tag data
+func decodeCOSEValue(def TagDefinition, value cbor.RawMessage) ([]byte, error) {
+	switch def.Type {
+	case VALUE_UINT, VALUE_TIMESTAMP:
+		var val uint64
+		err := cbor.Unmarshal(value, &val)
+		if err != nil {
+			return nil, err
+		}
+		for _, size := range def.Sizes {
+			if size == 8 || val < 1<<(8*size) {
+				return encodeUint(val, size), nil
+			}
+		}
+		return nil, fmt.Errorf("value %d is too large", val)
+	case VALUE_UINT_PAIR:
+		var pair []uint32
+		err := cbor.Unmarshal(value, &pair)
+		if err != nil || len(pair) != 2 {
+			return nil, fmt.Errorf("expected two uint32")
+		}
+		return append(encodeUint(uint64(pair[0]), 4), encodeUint(uint64(pair[1]), 4)...), nil
+	case VALUE_STRING:
+		var str string
+		err := cbor.Unmarshal(value, &str)
+		return []byte(str), err
+	default:
+		var data []byte
+		err := cbor.Unmarshal(value, &data)
+		return data, err
+	}
+}
+
+// coseUID decodes the card UID used as external data
+func coseUID(uid string) ([]byte, error) {
+	data, err := hex.DecodeString(uid)
+	if err != nil || len(data) == 0 {
+		return nil, fmt.Errorf("Invalid card UID %q", uid)
+	}
+	return data, nil
+}
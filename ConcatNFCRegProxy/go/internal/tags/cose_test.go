@@ -0,0 +1,144 @@
+package tags
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"testing"
+
+	"ConcatNFCRegProxy/types"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func coseCard(t *testing.T) []types.Tag {
+	cardTags, err := RequestToTags(types.CardDefinitionRequest{
+		AttendeeId:        2,
+		ConventionId:      24535786,
+		IssuanceCount:     1,
+		IssuanceTimestamp: "1749932218",
+		Tier:              "Sponsor",
+		KeyId:             "2025",
+		UnknownTags:       []types.RawTag{{Id: 0x30, Data: []byte{0x01}}},
+		Signature:         base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{0x5a}, ES256_SIGNATURE_SIZE)),
+	})
+	assert.NoError(t, err)
+	converted, err := ToCOSE(cardTags)
+	assert.NoError(t, err)
+	return converted
+}
+
+func TestCOSERoundTrip(t *testing.T) {
+	cardTags := coseCard(t)
+	assert.Equal(t, uint64(PAYLOAD_COSE), PayloadVersion(cardTags))
+	alg, kid := SignatureKey(cardTags)
+	assert.Equal(t, uint64(2), alg)
+	assert.Equal(t, "2025", kid)
+
+	image, err := Encode(cardTags)
+	assert.NoError(t, err)
+	assert.Equal(t, CARD_FORMAT_COSE, image[2])
+	// A tagged COSE_Sign1 right after the header
+	assert.Equal(t, byte(0xd2), image[HEADER_SIZE])
+
+	decoded, err := Decode(image)
+	assert.NoError(t, err)
+	before, err := TagsToRequest(cardTags)
+	assert.NoError(t, err)
+	after, err := TagsToRequest(decoded)
+	assert.NoError(t, err)
+	assert.Equal(t, before, after)
+
+	// Reading and writing back gives the same bytes
+	again, err := Encode(decoded)
+	assert.NoError(t, err)
+	assert.Equal(t, image, again)
+
+	// TLV cards are still written and read
+	plain, err := RequestToTags(types.CardDefinitionRequest{AttendeeId: 2, ConventionId: 3, Signature: TEST_SIGNATURE})
+	assert.NoError(t, err)
+	image, err = Encode(plain)
+	assert.NoError(t, err)
+	assert.Equal(t, CARD_FORMAT_VERSION, image[2])
+	decoded, err = Decode(image)
+	assert.NoError(t, err)
+	assert.Equal(t, plain, decoded)
+}
+
+func TestCOSESigningPayload(t *testing.T) {
+	cardTags := coseCard(t)
+	payload, err := SigningPayload(cardTags, "04412A014B3403")
+	assert.NoError(t, err)
+
+	// The Sig_structure holds the stored protected header and payload
+	var sigStructure []any
+	assert.NoError(t, cbor.Unmarshal(payload, &sigStructure))
+	assert.Equal(t, "Signature1", sigStructure[0])
+	uid, _ := hex.DecodeString("04412a014b3403")
+	assert.Equal(t, uid, sigStructure[2])
+	image, err := Encode(cardTags)
+	assert.NoError(t, err)
+	assert.True(t, bytes.Contains(image, sigStructure[1].([]byte)))
+	assert.True(t, bytes.Contains(image, sigStructure[3].([]byte)))
+
+	// Bound to the card UID
+	other, err := SigningPayload(cardTags, "04412a014b3404")
+	assert.NoError(t, err)
+	assert.NotEqual(t, payload, other)
+	_, err = SigningPayload(cardTags, "")
+	assert.Equal(t, ErrMissingUID, err)
+
+	// The signature is not signed
+	resigned := append([]types.Tag{}, cardTags...)
+	resigned[len(resigned)-1] = types.Tag{Id: TAG_SIGNATURE, Data: []byte{0x01}}
+	same, err := SigningPayload(resigned, "04412a014b3403")
+	assert.NoError(t, err)
+	assert.Equal(t, payload, same)
+}
+
+func TestCOSEErrors(t *testing.T) {
+	cardTags := coseCard(t)
+
+	// DER signatures have no COSE algorithm
+	der := append([]types.Tag{}, cardTags...)
+	for i, tag := range der {
+		if tag.Id == TAG_SIGNATURE_ALG {
+			der[i] = types.Tag{Id: TAG_SIGNATURE_ALG, Data: []byte{1}}
+		}
+	}
+	_, err := Encode(der)
+	assert.ErrorContains(t, err, "signatureAlg 2 or 3")
+	// and asking for them is refused rather than relabelled
+	_, err = ToCOSE(der)
+	assert.ErrorContains(t, err, "no DER ECDSA")
+	// as is a signature that cannot be raw ECDSA when no algorithm is named
+	plain, err := RequestToTags(types.CardDefinitionRequest{AttendeeId: 2, ConventionId: 3, Signature: TEST_SIGNATURE})
+	assert.NoError(t, err)
+	_, err = ToCOSE(plain)
+	assert.ErrorContains(t, err, "64 byte raw ECDSA signature, got 70 bytes")
+	// while a card still to be signed offline gets the raw algorithm
+	unsigned, err := ToCOSE(plain[:len(plain)-1])
+	assert.NoError(t, err)
+	alg, _ := SignatureKey(unsigned)
+	assert.Equal(t, uint64(2), alg)
+
+	_, err = Encode(cardTags[:len(cardTags)-1])
+	assert.ErrorContains(t, err, "need a signature")
+
+	// Not deterministically encoded: the payload map with an indefinite length
+	message, err := encodeCOSE(cardTags)
+	assert.NoError(t, err)
+	var raw cbor.RawTag
+	assert.NoError(t, cbor.Unmarshal(message, &raw))
+	var msg coseSign1
+	assert.NoError(t, cbor.Unmarshal(raw.Content, &msg))
+	msg.Payload = append([]byte{0xbf}, append(msg.Payload[1:], 0xff)...)
+	reencoded, err := cbor.Marshal(cbor.Tag{Number: COSE_SIGN1_TAG, Content: msg})
+	assert.NoError(t, err)
+	_, err = decodeCOSE(reencoded)
+	assert.ErrorIs(t, err, ErrCorrupt)
+
+	_, err = decodeCOSE([]byte{0x01})
+	assert.ErrorIs(t, err, ErrCorrupt)
+}
@@ -0,0 +1,85 @@
+package tags
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+
+	"ConcatNFCRegProxy/types"
+)
+
+// ENTITLEMENTS_SIZE is the encoded size of TAG_ENTITLEMENTS: the first day as
+// a uint16 count of days since 1970-01-01, the uint16 day bitmap and the
+// uint32 zone bitmap, all big endian
+const ENTITLEMENTS_SIZE = 8
+
+const DAY_FORMAT = "2006-01-02"
+
+// MAX_DAYS is the number of days the day bitmap can cover
+const MAX_DAYS = 16
+
+// MAX_ZONES is the number of zones the zone bitmap can cover
+const MAX_ZONES = 32
+
+func encodeEntitlements(e *types.Entitlements) ([]byte, error) {
+	var firstDay int64
+	if e.FirstDay != "" {
+		day, err := time.Parse(DAY_FORMAT, e.FirstDay)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid entitlements firstDay: %w", err)
+		}
+		firstDay = day.Unix() / 86400
+		if firstDay < 0 || firstDay > math.MaxUint16 {
+			return nil, fmt.Errorf("Invalid entitlements firstDay: %s is out of range", e.FirstDay)
+		}
+	} else if e.Days != 0 {
+		return nil, fmt.Errorf("Entitlements days need a firstDay")
+	}
+	data := make([]byte, ENTITLEMENTS_SIZE)
+	binary.BigEndian.PutUint16(data[0:2], uint16(firstDay))
+	binary.BigEndian.PutUint16(data[2:4], e.Days)
+	binary.BigEndian.PutUint32(data[4:8], e.Zones)
+	return data, nil
+}
+
+func decodeEntitlements(data []byte) *types.Entitlements {
+	e := &types.Entitlements{
+		Days:  binary.BigEndian.Uint16(data[2:4]),
+		Zones: binary.BigEndian.Uint32(data[4:8]),
+	}
+	firstDay := binary.BigEndian.Uint16(data[0:2])
+	if firstDay != 0 || e.Days != 0 {
+		e.FirstDay = time.Unix(int64(firstDay)*86400, 0).UTC().Format(DAY_FORMAT)
+	}
+	return e
+}
+
+// EntitlementsAllow tells whether a badge grants access to zone at the given
+// time. Days are counted in the location of at, so pass it in the convention
+// time zone. A badge without entitlements is valid everywhere, and an empty
+// bitmap does not restrict: Days 0 is every day and Zones 0 every zone.
+func EntitlementsAllow(e *types.Entitlements, zone int, at time.Time) (bool, error) {
+	if zone < 0 || zone >= MAX_ZONES {
+		return false, fmt.Errorf("Zone %d is out of range, there are %d zones", zone, MAX_ZONES)
+	}
+	if e == nil {
+		return true, nil
+	}
+	if e.Zones != 0 && e.Zones&(1<<zone) == 0 {
+		return false, nil
+	}
+	if e.Days == 0 {
+		return true, nil
+	}
+	first, err := time.Parse(DAY_FORMAT, e.FirstDay)
+	if err != nil {
+		return false, fmt.Errorf("Invalid entitlements firstDay: %w", err)
+	}
+	year, month, day := at.Date()
+	offset := int(time.Date(year, month, day, 0, 0, 0, 0, time.UTC).Sub(first).Hours() / 24)
+	if offset < 0 || offset >= MAX_DAYS {
+		return false, nil
+	}
+	return e.Days&(1<<offset) != 0, nil
+}
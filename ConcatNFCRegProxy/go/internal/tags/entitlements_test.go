@@ -0,0 +1,97 @@
+package tags
+
+import (
+	"testing"
+	"time"
+
+	"ConcatNFCRegProxy/types"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEntitlementsRoundTrip(t *testing.T) {
+	// Saturday and Sunday of a Friday to Sunday convention, general admission and the dealer den
+	weekend := &types.Entitlements{FirstDay: "2025-06-13", Days: 0b110, Zones: 0b101}
+	req := types.CardDefinitionRequest{AttendeeId: 1, ConventionId: 2, Entitlements: weekend, Signature: TEST_SIGNATURE}
+	encoded, err := RequestToTags(req)
+	assert.NoError(t, err)
+	assert.Equal(t, types.Tag{Id: TAG_ENTITLEMENTS, Data: []byte{0x4f, 0x1c, 0x00, 0x06, 0x00, 0x00, 0x00, 0x05}}, encoded[1])
+
+	decoded, err := TagsToRequest(encoded)
+	assert.NoError(t, err)
+	assert.Equal(t, weekend, decoded.Entitlements)
+
+	text, err := TagToText(encoded[1])
+	assert.NoError(t, err)
+	assert.Equal(t, "TAG=TAG_ENTITLEMENTS firstDay=2025-06-13 days=0x0006 zones=0x00000005", text)
+
+	_, err = RequestToTags(types.CardDefinitionRequest{Entitlements: &types.Entitlements{Days: 1}})
+	assert.Error(t, err)
+	_, err = RequestToTags(types.CardDefinitionRequest{Entitlements: &types.Entitlements{FirstDay: "13/06/2025", Days: 1}})
+	assert.Error(t, err)
+}
+
+func TestEntitlementsAllow(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip("No time zone data")
+	}
+	weekend := &types.Entitlements{FirstDay: "2025-06-13", Days: 0b110, Zones: 0b101}
+
+	cases := []struct {
+		zone    int
+		at      time.Time
+		allowed bool
+	}{
+		{0, time.Date(2025, 6, 13, 12, 0, 0, 0, berlin), false},
+		{0, time.Date(2025, 6, 14, 0, 30, 0, 0, berlin), true},
+		{2, time.Date(2025, 6, 15, 23, 59, 0, 0, berlin), true},
+		{1, time.Date(2025, 6, 14, 12, 0, 0, 0, berlin), false},
+		{0, time.Date(2025, 6, 16, 12, 0, 0, 0, berlin), false},
+		{0, time.Date(2025, 6, 12, 12, 0, 0, 0, berlin), false},
+	}
+	for _, c := range cases {
+		allowed, err := EntitlementsAllow(weekend, c.zone, c.at)
+		assert.NoError(t, err)
+		assert.Equal(t, c.allowed, allowed, "zone %d at %s", c.zone, c.at)
+	}
+
+	allowed, err := EntitlementsAllow(&types.Entitlements{Zones: 0b10}, 1, time.Now())
+	assert.NoError(t, err)
+	assert.True(t, allowed)
+
+	allowed, err = EntitlementsAllow(nil, 5, time.Now())
+	assert.NoError(t, err)
+	assert.True(t, allowed)
+
+	// Like days, an empty zone bitmap does not restrict
+	daysOnly := &types.Entitlements{FirstDay: "2025-06-13", Days: 0b1, Zones: 0}
+	allowed, err = EntitlementsAllow(daysOnly, 31, time.Date(2025, 6, 13, 12, 0, 0, 0, berlin))
+	assert.NoError(t, err)
+	assert.True(t, allowed)
+	allowed, err = EntitlementsAllow(daysOnly, 0, time.Date(2025, 6, 14, 12, 0, 0, 0, berlin))
+	assert.NoError(t, err)
+	assert.False(t, allowed)
+
+	_, err = EntitlementsAllow(weekend, 32, time.Now())
+	assert.Error(t, err)
+}
+
+func TestEntitlementsPatch(t *testing.T) {
+	current, err := RequestToTags(types.CardDefinitionRequest{AttendeeId: 1, ConventionId: 2, Signature: TEST_SIGNATURE})
+	assert.NoError(t, err)
+
+	updated, err := MergePatch(current, []byte(`{"entitlements":{"days":3,"firstDay":"2025-06-13","zones":3}}`))
+	assert.NoError(t, err)
+	assert.Equal(t, TAG_ENTITLEMENTS, updated[1].Id)
+	assert.Equal(t, TAG_SIGNATURE, updated[2].Id)
+
+	// Members missing from the patch are kept
+	updated, err = MergePatch(updated, []byte(`{"entitlements":{"zones":1}}`))
+	assert.NoError(t, err)
+	assert.Len(t, updated, 3)
+	decoded, err := TagsToRequest(updated)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(0b1), decoded.Entitlements.Zones)
+	assert.Equal(t, uint16(0b11), decoded.Entitlements.Days)
+}
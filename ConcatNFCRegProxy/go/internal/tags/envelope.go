@@ -0,0 +1,120 @@
+package tags
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"ConcatNFCRegProxy/types"
+)
+
+// TAG_ENVELOPE holds the other tags encrypted with AES-256-GCM. It is
+// critical, so readers without the key refuse the card instead of showing it
+// as empty.
+var TAG_ENVELOPE byte = 0x8D
+
+// ENVELOPE_VERSION is the first byte of the envelope, followed by the nonce
+// and the ciphertext with the GCM tag
+var ENVELOPE_VERSION byte = 0x01
+
+// ENVELOPE_INFO is the HKDF info of card keys, followed by the UID bytes
+const ENVELOPE_INFO = "ConCat NFC envelope v1"
+
+// ENVELOPE_KEY_SIZE is the size of the convention master key and of the
+// derived card keys
+const ENVELOPE_KEY_SIZE = 32
+
+// ENVELOPE_NONCE_SIZE is the GCM nonce, random for every write
+const ENVELOPE_NONCE_SIZE = 12
+
+var ErrEncrypted = errors.New("ConCat badge is encrypted")
+
+// IsSealed tells whether the tags of a card are an envelope
+func IsSealed(tags []types.Tag) bool {
+	return len(tags) == 1 && tags[0].Id == TAG_ENVELOPE
+}
+
+// EnvelopeKey derives the key of a card from the convention master key:
+// HKDF-SHA256(master, no salt, ENVELOPE_INFO || UID), 32 bytes
+func EnvelopeKey(master []byte, uid string) ([]byte, error) {
+	if len(master) != ENVELOPE_KEY_SIZE {
+		return nil, fmt.Errorf("Envelope master key must be %d bytes, got %d", ENVELOPE_KEY_SIZE, len(master))
+	}
+	uidBytes, err := hex.DecodeString(uid)
+	if err != nil || len(uidBytes) == 0 {
+		return nil, fmt.Errorf("Invalid card UID %q", uid)
+	}
+	return hkdf.Key(sha256.New, master, nil, ENVELOPE_INFO+string(uidBytes), ENVELOPE_KEY_SIZE)
+}
+
+// Seal encrypts tags into a single envelope tag for the card uid. The
+// signature is sealed along with the other tags, so it verifies unchanged
+// once opened.
+func Seal(tags []types.Tag, master []byte, uid string) ([]types.Tag, error) {
+	plaintext, err := encodeTLV(tags)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := envelopeCipher(master, uid)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, 1+ENVELOPE_NONCE_SIZE, 1+ENVELOPE_NONCE_SIZE+len(plaintext)+aead.Overhead())
+	data[0] = ENVELOPE_VERSION
+	nonce := data[1:]
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	data = aead.Seal(data, nonce, plaintext, data[:1])
+	return []types.Tag{{Id: TAG_ENVELOPE, Data: data}}, nil
+}
+
+// Open decrypts an envelope sealed for the card uid. Tags without an envelope
+// are returned unchanged. A wrong key, another card's envelope or a modified
+// one fail with ErrEncrypted.
+func Open(tags []types.Tag, master []byte, uid string) ([]types.Tag, error) {
+	if !IsSealed(tags) {
+		return tags, nil
+	}
+	data := tags[0].Data
+	if len(data) < 1+ENVELOPE_NONCE_SIZE || data[0] != ENVELOPE_VERSION {
+		return nil, fmt.Errorf("%w: unsupported envelope", ErrEncrypted)
+	}
+	aead, err := envelopeCipher(master, uid)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := aead.Open(nil, data[1:1+ENVELOPE_NONCE_SIZE], data[1+ENVELOPE_NONCE_SIZE:], data[:1])
+	if err != nil {
+		return nil, fmt.Errorf("%w: cannot decrypt with the configured key", ErrEncrypted)
+	}
+	opened, end, err := decodeTLV(plaintext)
+	if err != nil {
+		return nil, err
+	}
+	if end != len(plaintext) {
+		return nil, fmt.Errorf("%w: end marker inside the envelope", ErrCorrupt)
+	}
+	if hasTag(opened, TAG_ENVELOPE) {
+		return nil, fmt.Errorf("%w: nested envelope", ErrCorrupt)
+	}
+	return opened, nil
+}
+
+func envelopeCipher(master []byte, uid string) (cipher.AEAD, error) {
+	key, err := EnvelopeKey(master, uid)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,85 @@
+package tags
+
+import (
+	"bytes"
+	"testing"
+
+	"ConcatNFCRegProxy/types"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const ENVELOPE_UID = "04412a014b3403"
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	master := bytes.Repeat([]byte{0x42}, ENVELOPE_KEY_SIZE)
+	cardTags, err := RequestToTags(types.CardDefinitionRequest{
+		AttendeeId:        2,
+		ConventionId:      24535786,
+		IssuanceCount:     1,
+		IssuanceTimestamp: "1749932218",
+		Signature:         TEST_SIGNATURE,
+	})
+	assert.NoError(t, err)
+
+	sealed, err := Seal(cardTags, master, ENVELOPE_UID)
+	assert.NoError(t, err)
+	assert.True(t, IsSealed(sealed))
+	plain, _ := encodeTLV(cardTags)
+	assert.False(t, bytes.Contains(sealed[0].Data, plain[:10]))
+
+	// The nonce is random, the same card sealed twice differs
+	again, err := Seal(cardTags, master, ENVELOPE_UID)
+	assert.NoError(t, err)
+	assert.NotEqual(t, sealed[0].Data, again[0].Data)
+
+	opened, err := Open(sealed, master, ENVELOPE_UID)
+	assert.NoError(t, err)
+	assert.Equal(t, cardTags, opened)
+
+	// The image round trips through the card codec
+	image, err := Encode(sealed)
+	assert.NoError(t, err)
+	decoded, err := Decode(image)
+	assert.NoError(t, err)
+	opened, err = Open(decoded, master, ENVELOPE_UID)
+	assert.NoError(t, err)
+	assert.Equal(t, cardTags, opened)
+
+	// Plain cards are returned unchanged
+	opened, err = Open(cardTags, master, ENVELOPE_UID)
+	assert.NoError(t, err)
+	assert.Equal(t, cardTags, opened)
+}
+
+func TestEnvelopeErrors(t *testing.T) {
+	master := bytes.Repeat([]byte{0x42}, ENVELOPE_KEY_SIZE)
+	cardTags, err := RequestToTags(types.CardDefinitionRequest{AttendeeId: 2, ConventionId: 3, Signature: TEST_SIGNATURE})
+	assert.NoError(t, err)
+	sealed, err := Seal(cardTags, master, ENVELOPE_UID)
+	assert.NoError(t, err)
+
+	// Copied to another card
+	_, err = Open(sealed, master, "04412a014b3404")
+	assert.ErrorIs(t, err, ErrEncrypted)
+
+	_, err = Open(sealed, bytes.Repeat([]byte{0x43}, ENVELOPE_KEY_SIZE), ENVELOPE_UID)
+	assert.ErrorIs(t, err, ErrEncrypted)
+
+	modified := []types.Tag{{Id: TAG_ENVELOPE, Data: append([]byte{}, sealed[0].Data...)}}
+	modified[0].Data[20] ^= 0x01
+	_, err = Open(modified, master, ENVELOPE_UID)
+	assert.ErrorIs(t, err, ErrEncrypted)
+
+	_, err = Seal(cardTags, master[:16], ENVELOPE_UID)
+	assert.Error(t, err)
+
+	// Without the key the envelope is refused, even when unknown critical tags are not
+	RejectUnknownCritical = false
+	t.Cleanup(func() { RejectUnknownCritical = true })
+	_, err = TagsToRequest(sealed)
+	assert.ErrorIs(t, err, ErrEncrypted)
+
+	err = Register(TagDefinition{Id: TAG_ENVELOPE, Name: "TAG_SECRET", Type: VALUE_BYTES, Fields: []string{"secret"}, MaxSize: 8})
+	assert.Error(t, err)
+}
@@ -0,0 +1,100 @@
+package tags
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+// HEADER_MAGIC starts every card written with a header. Cards written before
+// the header start directly with a tag id, which is never 'C'.
+var HEADER_MAGIC = []byte{'C', 'C'}
+
+// CARD_FORMAT_VERSION is the version written in the header of TLV cards
+var CARD_FORMAT_VERSION byte = 0x01
+
+// CARD_FORMAT_COSE is the header version of COSE cards, whose payload is a
+// COSE_Sign1 message instead of tags. It is the newest version.
+var CARD_FORMAT_COSE byte = 0x02
+
+// HEADER_SIZE is magic, version, uint16 payload length and CRC32, big endian
+const HEADER_SIZE = 9
+
+// MAX_PAYLOAD is the user memory of an NTAG216, the largest supported card
+const MAX_PAYLOAD = 888
+
+var ErrNotConCat = errors.New("Not a ConCat badge")
+var ErrCorrupt = errors.New("Corrupt ConCat badge")
+var ErrOlderFormat = errors.New("ConCat badge in an older format")
+var ErrNewerFormat = errors.New("ConCat badge in a newer format")
+
+type Header struct {
+	Version byte
+	Length  int
+	CRC     uint32
+}
+
+// EncodeHeader returns the header for a TLV payload
+func EncodeHeader(payload []byte) ([]byte, error) {
+	return encodeHeader(CARD_FORMAT_VERSION, payload)
+}
+
+func encodeHeader(version byte, payload []byte) ([]byte, error) {
+	if len(payload) > MAX_PAYLOAD {
+		return nil, fmt.Errorf("Card payload is %d bytes, over the maximum of %d", len(payload), MAX_PAYLOAD)
+	}
+	header := make([]byte, HEADER_SIZE)
+	copy(header, HEADER_MAGIC)
+	header[2] = version
+	binary.BigEndian.PutUint16(header[3:5], uint16(len(payload)))
+	binary.BigEndian.PutUint32(header[5:9], crc32.ChecksumIEEE(payload))
+	return header, nil
+}
+
+// HasMagic tells whether the first bytes of a card are a header
+func HasMagic(start []byte) bool {
+	return len(start) >= len(HEADER_MAGIC) && start[0] == HEADER_MAGIC[0] && start[1] == HEADER_MAGIC[1]
+}
+
+// ParseHeader decodes a header. The errors wrap ErrNotConCat, ErrNewerFormat
+// or ErrCorrupt.
+func ParseHeader(data []byte) (Header, error) {
+	if len(data) < HEADER_SIZE || !HasMagic(data) {
+		return Header{}, ErrNotConCat
+	}
+	header := Header{
+		Version: data[2],
+		Length:  int(binary.BigEndian.Uint16(data[3:5])),
+		CRC:     binary.BigEndian.Uint32(data[5:9]),
+	}
+	if header.Version > CARD_FORMAT_COSE {
+		return header, fmt.Errorf("%w: version %d", ErrNewerFormat, header.Version)
+	}
+	if header.Version == 0 {
+		return header, fmt.Errorf("%w: invalid version 0", ErrCorrupt)
+	}
+	if header.Length > MAX_PAYLOAD {
+		return header, fmt.Errorf("%w: invalid payload length %d", ErrCorrupt, header.Length)
+	}
+	return header, nil
+}
+
+// CheckPayload compares the payload with the CRC of the header
+func (h Header) CheckPayload(payload []byte) error {
+	if len(payload) != h.Length {
+		return fmt.Errorf("%w: payload is %d bytes, expected %d", ErrCorrupt, len(payload), h.Length)
+	}
+	crc := crc32.ChecksumIEEE(payload)
+	if crc != h.CRC {
+		return fmt.Errorf("%w: CRC is %08x, expected %08x", ErrCorrupt, crc, h.CRC)
+	}
+	return nil
+}
+
+// IsLegacyStart tells whether a card without header starts like the cards
+// written before the header existed, with a known tag id
+func IsLegacyStart(id byte) bool {
+	_, known := Lookup(id)
+	return known
+}
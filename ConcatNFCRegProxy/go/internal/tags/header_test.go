@@ -0,0 +1,50 @@
+package tags
+
+import (
+	"errors"
+	"testing"
+
+	"ConcatNFCRegProxy/types"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHeader(t *testing.T) {
+	written := []types.Tag{
+		{Id: TAG_ATTENDEE_ID, Data: []byte{0, 0, 0, 1, 0, 0, 0, 2}},
+		{Id: TAG_SIGNATURE, Data: make([]byte, 300)},
+	}
+	payload, err := encodeTLV(written)
+	assert.NoError(t, err)
+	header, err := EncodeHeader(payload)
+	assert.NoError(t, err)
+	assert.Len(t, header, HEADER_SIZE)
+	assert.Equal(t, []byte{'C', 'C', CARD_FORMAT_VERSION, 0x01, 0x3a}, header[:5])
+
+	parsed, err := ParseHeader(header)
+	assert.NoError(t, err)
+	assert.NoError(t, parsed.CheckPayload(payload))
+	read, _, err := decodeTLV(payload)
+	assert.NoError(t, err)
+	assert.Equal(t, written, read)
+
+	payload[20] ^= 0x01
+	assert.True(t, errors.Is(parsed.CheckPayload(payload), ErrCorrupt))
+	assert.True(t, errors.Is(parsed.CheckPayload(payload[:10]), ErrCorrupt))
+
+	_, err = ParseHeader([]byte{0x01, 0x08, 0, 0, 0, 1, 0, 0, 0})
+	assert.Equal(t, ErrNotConCat, err)
+
+	newer := append([]byte{}, header...)
+	newer[2] = CARD_FORMAT_COSE + 1
+	_, err = ParseHeader(newer)
+	assert.True(t, errors.Is(err, ErrNewerFormat))
+
+	tooLong := append([]byte{}, header...)
+	tooLong[3], tooLong[4] = 0xff, 0xff
+	_, err = ParseHeader(tooLong)
+	assert.True(t, errors.Is(err, ErrCorrupt))
+
+	assert.True(t, IsLegacyStart(TAG_ATTENDEE_ID))
+	assert.False(t, IsLegacyStart(HEADER_MAGIC[0]))
+}
@@ -0,0 +1,219 @@
+package tags
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"ConcatNFCRegProxy/types"
+)
+
+// patchIgnored are request fields that do not describe the card contents
+var patchIgnored = []string{"password", "uuid"}
+
+// MergePatch applies a JSON merge patch (RFC 7396) to the card definition of
+// tags. Fields set to null are removed from the card, other fields are added
+// or replaced, zero values included, and fields missing from the patch are
+// kept. Objects such as custom and entitlements are merged member by member.
+// Tags already on the card keep their position, new ones go before the
+// signature, and tags the patch does not name keep their exact bytes.
+func MergePatch(tags []types.Tag, patch []byte) ([]types.Tag, error) {
+	var patchDoc map[string]any
+	err := decodeJSON(patch, &patchDoc)
+	if err != nil || patchDoc == nil {
+		return nil, fmt.Errorf("A merge patch must be a JSON object")
+	}
+	for _, field := range patchIgnored {
+		delete(patchDoc, field)
+	}
+
+	doc, err := Document(tags)
+	if err != nil {
+		return nil, err
+	}
+	merged, _ := mergeValue(doc, patchDoc).(map[string]any)
+	updated, err := DocumentToTags(merged)
+	if err != nil {
+		return nil, err
+	}
+	return keepOrder(tags, updated, func(tag types.Tag) bool {
+		return patchNames(patchDoc, tag)
+	}), nil
+}
+
+// patchNames reports whether the patch sets or removes a field of the tag.
+// Custom fields are named inside the custom object, and tags this proxy does
+// not know are only named as a whole by unknownTags.
+func patchNames(patchDoc map[string]any, tag types.Tag) bool {
+	def, ok := Lookup(tag.Id)
+	if !ok {
+		_, named := patchDoc["unknownTags"]
+		return named
+	}
+	custom, _ := patchDoc["custom"].(map[string]any)
+	for _, field := range def.Fields {
+		if _, named := patchDoc[field]; named {
+			return true
+		}
+		if _, named := custom[field]; named {
+			return true
+		}
+	}
+	// A null custom object removes every custom field
+	value, named := patchDoc["custom"]
+	_, builtin := requestFields[def.Fields[0]]
+	return named && value == nil && !builtin
+}
+
+// DocumentToTags encodes a card definition given as a JSON object with the
+// field names of types.CardDefinitionRequest. Unlike RequestToTags, numeric
+// fields present in the document are written even when they are zero.
+func DocumentToTags(doc map[string]any) ([]types.Tag, error) {
+	for _, field := range sortedKeys(doc) {
+		if doc[field] == "" {
+			return nil, fmt.Errorf("'%s' is empty, use null to remove it", field)
+		}
+	}
+	req, explicit, err := documentRequest(doc)
+	if err != nil {
+		return nil, err
+	}
+	return requestToTags(req, explicit)
+}
+
+// DocumentErrors encodes each tag of a card document on its own and returns
+// every field that cannot be written, where DocumentToTags stops at the first
+func DocumentErrors(doc map[string]any) []types.FieldError {
+	var errs []types.FieldError
+	for _, field := range sortedKeys(doc) {
+		if doc[field] == "" {
+			errs = append(errs, types.FieldError{Field: field, Message: "Empty, use null to remove it"})
+		}
+	}
+	req, explicit, err := documentRequest(doc)
+	if err != nil {
+		return append(errs, types.FieldError{Message: err.Error()})
+	}
+	for _, def := range registry {
+		_, _, err := encodeTag(def, &req, explicit)
+		if err != nil {
+			errs = append(errs, types.FieldError{Field: def.Fields[0], Message: err.Error()})
+		}
+	}
+	return errs
+}
+
+func documentRequest(doc map[string]any) (types.CardDefinitionRequest, map[string]bool, error) {
+	var req types.CardDefinitionRequest
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return req, nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	dec.DisallowUnknownFields()
+	err = dec.Decode(&req)
+	if err != nil {
+		return req, nil, fmt.Errorf("Invalid card definition: %w", err)
+	}
+	explicit := map[string]bool{}
+	for field := range doc {
+		explicit[field] = true
+	}
+	return req, explicit, nil
+}
+
+func sortedKeys(doc map[string]any) []string {
+	keys := make([]string, 0, len(doc))
+	for key := range doc {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Document returns the card definition of tags as a JSON object. Unlike the
+// omitempty JSON of types.CardDefinitionRequest it keeps zero values, so a
+// zero on the card can be told from a missing tag.
+func Document(tags []types.Tag) (map[string]any, error) {
+	req, err := TagsToRequest(tags)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string]any
+	err = decodeJSON(data, &doc)
+	if err != nil {
+		return nil, err
+	}
+	for _, tag := range tags {
+		def, ok := Lookup(tag.Id)
+		if !ok {
+			continue
+		}
+		for _, field := range def.Fields {
+			if _, set := doc[field]; set {
+				continue
+			}
+			if v, builtin := requestField(&req, field); builtin {
+				doc[field] = v.Interface()
+			}
+		}
+	}
+	return doc, nil
+}
+
+// mergeValue is the MergePatch algorithm of RFC 7396 section 2
+func mergeValue(target any, patch any) any {
+	patchObj, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	targetObj, ok := target.(map[string]any)
+	if !ok {
+		targetObj = map[string]any{}
+	}
+	for key, value := range patchObj {
+		if value == nil {
+			delete(targetObj, key)
+		} else {
+			targetObj[key] = mergeValue(targetObj[key], value)
+		}
+	}
+	return targetObj
+}
+
+// keepOrder returns updated with the tags that were already on the card at
+// their previous position, and the added ones before the signature. Tags
+// that changed reports false for are kept as they were on the card, so a
+// value read back in another form is not written with a new encoding.
+func keepOrder(previous []types.Tag, updated []types.Tag, changed func(types.Tag) bool) []types.Tag {
+	pending := append([]types.Tag{}, updated...)
+	var result []types.Tag
+	for _, tag := range previous {
+		for idx, candidate := range pending {
+			if candidate.Id == tag.Id {
+				if !changed(tag) {
+					candidate = tag
+				}
+				result = append(result, candidate)
+				pending = append(pending[:idx], pending[idx+1:]...)
+				break
+			}
+		}
+	}
+	for _, tag := range pending {
+		result = insertBeforeSignature(result, tag)
+	}
+	return result
+}
+
+func decodeJSON(data []byte, v any) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
@@ -0,0 +1,136 @@
+package tags
+
+import (
+	"testing"
+
+	"ConcatNFCRegProxy/types"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMergePatch(t *testing.T) {
+	current, err := RequestToTags(types.CardDefinitionRequest{
+		AttendeeId:        1,
+		ConventionId:      2,
+		IssuanceCount:     1,
+		IssuanceTimestamp: "1000",
+		Tier:              "Sponsor",
+		Signature:         TEST_SIGNATURE,
+	})
+	assert.NoError(t, err)
+	unknown := types.Tag{Id: 0x30, Data: []byte{0xde, 0xad}}
+	current = append(current[:1], append([]types.Tag{unknown}, current[1:]...)...)
+
+	// Add, replace and remove in one patch, password and uuid are not card fields
+	updated, err := MergePatch(current, []byte(`{"expiration":5000,"issuance":2,"tier":null,"password":123,"uuid":"04412a014b3403"}`))
+	assert.NoError(t, err)
+	decoded, err := TagsToRequest(updated)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(5000), decoded.Expiration)
+	assert.Equal(t, uint64(2), decoded.IssuanceCount)
+	assert.Equal(t, "", decoded.Tier)
+	assert.Equal(t, uint32(1), decoded.AttendeeId)
+	assert.Equal(t, "1000", decoded.IssuanceTimestamp)
+	// Tags keep their place, the new one goes before the signature
+	assert.Equal(t, []byte{TAG_ATTENDEE_ID, 0x30, TAG_ISSUANCE, TAG_TIMESTAMP, TAG_EXPIRATION, TAG_SIGNATURE}, tagIds(updated))
+
+	// Zero is a value, not "unchanged"
+	zero, err := MergePatch(updated, []byte(`{"issuance":0}`))
+	assert.NoError(t, err)
+	assert.Contains(t, zero, types.Tag{Id: TAG_ISSUANCE, Data: []byte{0, 0, 0, 0}})
+	// and survives the next patch
+	zero, err = MergePatch(zero, []byte(`{"expiration":6000}`))
+	assert.NoError(t, err)
+	assert.Contains(t, zero, types.Tag{Id: TAG_ISSUANCE, Data: []byte{0, 0, 0, 0}})
+
+	// An empty patch changes nothing
+	same, err := MergePatch(current, []byte(`{}`))
+	assert.NoError(t, err)
+	assert.Equal(t, current, same)
+
+	cleared, err := MergePatch(current, []byte(`{"unknownTags":null}`))
+	assert.NoError(t, err)
+	assert.NotContains(t, cleared, unknown)
+
+	_, err = MergePatch(current, []byte(`[]`))
+	assert.EqualError(t, err, "A merge patch must be a JSON object")
+	_, err = MergePatch(current, []byte(`{"tier":""}`))
+	assert.EqualError(t, err, "'tier' is empty, use null to remove it")
+	_, err = MergePatch(current, []byte(`{"seat":12}`))
+	assert.ErrorContains(t, err, "Invalid card definition")
+	_, err = MergePatch(current, []byte(`{"conventionId":null}`))
+	assert.Error(t, err)
+	_, err = MergePatch(current, []byte(`{"attendeeId":null,"conventionId":null}`))
+	assert.NoError(t, err)
+}
+
+func TestMergePatchObjects(t *testing.T) {
+	restoreRegistry(t)
+	assert.NoError(t, Register(TagDefinition{Id: 0x20, Name: "TAG_SEAT", Type: VALUE_UINT, Fields: []string{"seat"}, Sizes: []int{2}}))
+	assert.NoError(t, Register(TagDefinition{Id: 0x21, Name: "TAG_ROW", Type: VALUE_UINT, Fields: []string{"row"}, Sizes: []int{1}}))
+
+	current, err := RequestToTags(types.CardDefinitionRequest{
+		AttendeeId:   1,
+		ConventionId: 2,
+		Entitlements: &types.Entitlements{FirstDay: "2025-06-13", Days: 0b11, Zones: 0b1},
+		Custom:       map[string]any{"seat": 1234, "row": 3},
+		Signature:    TEST_SIGNATURE,
+	})
+	assert.NoError(t, err)
+
+	updated, err := MergePatch(current, []byte(`{"entitlements":{"zones":5},"custom":{"row":null,"seat":0}}`))
+	assert.NoError(t, err)
+	decoded, err := TagsToRequest(updated)
+	assert.NoError(t, err)
+	assert.Equal(t, &types.Entitlements{FirstDay: "2025-06-13", Days: 0b11, Zones: 5}, decoded.Entitlements)
+	assert.Equal(t, map[string]any{"seat": uint64(0)}, decoded.Custom)
+}
+
+func tagIds(tags []types.Tag) []byte {
+	var ids []byte
+	for _, tag := range tags {
+		ids = append(ids, tag.Id)
+	}
+	return ids
+}
+
+func TestMergePatchKeepsBytes(t *testing.T) {
+	restoreRegistry(t)
+	assert.NoError(t, Register(TagDefinition{Id: 0x20, Name: "TAG_SEAT", Type: VALUE_UINT, Fields: []string{"seat"}, Sizes: []int{2}}))
+
+	current, err := RequestToTags(types.CardDefinitionRequest{
+		AttendeeId:        1,
+		ConventionId:      2,
+		IssuanceTimestamp: "1000",
+		Expiration:        5000,
+		BadgeName:         "Zoë",
+		Tier:              "Sponsor",
+		Entitlements:      &types.Entitlements{FirstDay: "2025-06-13", Days: 0b11, Zones: 0b1},
+		Custom:            map[string]any{"seat": 1234},
+		Signature:         TEST_SIGNATURE,
+	})
+	assert.NoError(t, err)
+	// An older card with the 8 byte issuance, which would be written with 4
+	legacy := types.Tag{Id: TAG_ISSUANCE, Data: []byte{0, 0, 0, 0, 0, 0, 0, 7}}
+	unknown := types.Tag{Id: 0x30, Data: []byte{0xde, 0xad}}
+	current = append(current[:1], append([]types.Tag{legacy, unknown}, current[1:]...)...)
+
+	patches := map[string]byte{
+		`{"tier":"Staff"}`:               TAG_TIER,
+		`{"custom":{"seat":12}}`:         0x20,
+		`{"entitlements":{"zones":3}}`:   TAG_ENTITLEMENTS,
+		`{"unknownTags":[]}`:             0x30,
+		`{"expiration":6000,"uuid":"x"}`: TAG_EXPIRATION,
+	}
+	for patch, changed := range patches {
+		updated, err := MergePatch(current, []byte(patch))
+		assert.NoError(t, err, patch)
+		for _, tag := range current {
+			if tag.Id == changed {
+				assert.NotContains(t, updated, tag, patch)
+			} else {
+				assert.Contains(t, updated, tag, patch)
+			}
+		}
+	}
+}
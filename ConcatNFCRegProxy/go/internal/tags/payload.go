@@ -0,0 +1,165 @@
+package tags
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"ConcatNFCRegProxy/types"
+)
+
+// payloadKeys are the keys of the signed payload. They follow the validator
+// apps and differ from the JSON names of the card definition. The payload
+// version is not among them: only version 2 payloads name it, next to the uid.
+var payloadKeys = map[byte]string{
+	TAG_ATTENDEE_ID:   "userId",
+	TAG_ISSUANCE:      "issuanceCount",
+	TAG_TIMESTAMP:     "timestamp",
+	TAG_EXPIRATION:    "expiration",
+	TAG_BADGE_NAME:    "badgeName",
+	TAG_TIER:          "tier",
+	TAG_PRONOUNS:      "pronouns",
+	TAG_ENTITLEMENTS:  "entitlements",
+	TAG_SIGNATURE_ALG: "signatureAlg",
+	TAG_KEY_ID:        "keyId",
+}
+
+// PAYLOAD_V1 signs the tags only. PAYLOAD_V2 adds the card UID, so the tags
+// cannot be copied to another card. Cards without a payload version tag are v1.
+// PAYLOAD_COSE cards are a COSE_Sign1 message, see cose.go.
+const PAYLOAD_V1 = 1
+const PAYLOAD_V2 = 2
+const PAYLOAD_COSE = 3
+
+var ErrMissingUID = errors.New("Payload version 2 and up need the card UID")
+
+// PayloadVersion returns the payload version a card is signed with
+func PayloadVersion(tags []types.Tag) uint64 {
+	for _, tag := range tags {
+		if tag.Id == TAG_PAYLOAD_VERSION && len(tag.Data) == 1 {
+			return decodeUint(tag.Data)
+		}
+	}
+	return PAYLOAD_V1
+}
+
+// SignatureKey returns the signature algorithm and the signing key id of a
+// card. Cards without an algorithm tag use algorithm 1, DER encoded ECDSA
+// P-256; kid is empty when the card names no key.
+func SignatureKey(tags []types.Tag) (alg uint64, kid string) {
+	alg = 1
+	for _, tag := range tags {
+		switch {
+		case tag.Id == TAG_SIGNATURE_ALG && len(tag.Data) == 1:
+			alg = decodeUint(tag.Data)
+		case tag.Id == TAG_KEY_ID:
+			kid = string(tag.Data)
+		}
+	}
+	return alg, kid
+}
+
+// SigningPayload returns the bytes the signature of a card covers: a JSON
+// object of the built-in tags with sorted keys and no whitespace. The
+// signature, custom and unknown tags are left out. The timestamp is a quoted
+// string and text values only escape '"' and '\', as the validator apps do.
+// Version 2 payloads also hold "payloadVersion":2 and the card UID as lower
+// case hex under "uid". Version 1 payloads never name their version, even
+// when the card has a version tag, and ignore uid. COSE cards sign the COSE
+// Sig_structure of the stored message instead, with the UID bytes as
+// external data.
+func SigningPayload(tags []types.Tag, uid string) ([]byte, error) {
+	values := map[string]string{}
+	switch PayloadVersion(tags) {
+	case PAYLOAD_COSE:
+		if uid == "" {
+			return nil, ErrMissingUID
+		}
+		uidBytes, err := coseUID(uid)
+		if err != nil {
+			return nil, err
+		}
+		return coseSigningPayload(tags, uidBytes)
+	case PAYLOAD_V1:
+	case PAYLOAD_V2:
+		if uid == "" {
+			return nil, ErrMissingUID
+		}
+		_, err := hex.DecodeString(uid)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid card UID %q", uid)
+		}
+		values["payloadVersion"] = strconv.Itoa(PAYLOAD_V2)
+		values["uid"] = `"` + strings.ToLower(uid) + `"`
+	default:
+		return nil, fmt.Errorf("Unsupported payload version %d", PayloadVersion(tags))
+	}
+	for _, tag := range tags {
+		key, ok := payloadKeys[tag.Id]
+		if !ok {
+			continue
+		}
+		def, _ := Lookup(tag.Id)
+		err := def.checkSize(len(tag.Data))
+		if err != nil {
+			return nil, err
+		}
+		switch tag.Id {
+		case TAG_ATTENDEE_ID:
+			values[key] = strconv.FormatUint(uint64(binary.BigEndian.Uint32(tag.Data[0:4])), 10)
+			values["conventionId"] = strconv.FormatUint(uint64(binary.BigEndian.Uint32(tag.Data[4:8])), 10)
+		case TAG_TIMESTAMP:
+			values[key] = `"` + strconv.FormatUint(decodeUint(tag.Data), 10) + `"`
+		case TAG_BADGE_NAME, TAG_TIER, TAG_PRONOUNS, TAG_KEY_ID:
+			err = checkText(def.Fields[0], string(tag.Data))
+			if err != nil {
+				return nil, err
+			}
+			values[key] = quoteText(string(tag.Data))
+		case TAG_ENTITLEMENTS:
+			e := decodeEntitlements(tag.Data)
+			if e.FirstDay == "" {
+				values[key] = fmt.Sprintf(`{"days":%d,"zones":%d}`, e.Days, e.Zones)
+			} else {
+				values[key] = fmt.Sprintf(`{"days":%d,"firstDay":"%s","zones":%d}`, e.Days, e.FirstDay, e.Zones)
+			}
+		default:
+			values[key] = strconv.FormatUint(decodeUint(tag.Data), 10)
+		}
+	}
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var sb strings.Builder
+	sb.WriteString("{")
+	for i, key := range keys {
+		if i > 0 {
+			sb.WriteString(",")
+		}
+		sb.WriteString(`"` + key + `":` + values[key])
+	}
+	sb.WriteString("}")
+	return []byte(sb.String()), nil
+}
+
+// RequestSigningPayload returns the signed payload of the tags a request
+// would write to the card with UID req.UUID
+func RequestSigningPayload(req types.CardDefinitionRequest) ([]byte, error) {
+	tags, err := RequestToTags(req)
+	if err != nil {
+		return nil, err
+	}
+	return SigningPayload(tags, req.UUID)
+}
+
+func quoteText(str string) string {
+	str = strings.ReplaceAll(str, `\`, `\\`)
+	str = strings.ReplaceAll(str, `"`, `\"`)
+	return `"` + str + `"`
+}
@@ -0,0 +1,102 @@
+package tags
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"testing"
+
+	"ConcatNFCRegProxy/types"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// VECTORS_FILE holds the golden payloads shared with the validator apps and the ESP32
+const VECTORS_FILE = "../../../../testvectors/signing-payload.json"
+
+type payloadVector struct {
+	Name string `json:"name"`
+	Tags []struct {
+		Id   byte   `json:"id"`
+		Data string `json:"data"`
+	} `json:"tags"`
+	UID     string `json:"uid"`
+	Card    string `json:"card"`
+	Payload string `json:"payload"`
+}
+
+func TestSigningPayloadVectors(t *testing.T) {
+	data, err := os.ReadFile(VECTORS_FILE)
+	assert.NoError(t, err)
+	var file struct {
+		Vectors []payloadVector `json:"vectors"`
+	}
+	assert.NoError(t, json.Unmarshal(data, &file))
+	assert.NotEmpty(t, file.Vectors)
+
+	for _, v := range file.Vectors {
+		var cardTags []types.Tag
+		for _, tag := range v.Tags {
+			value, err := hex.DecodeString(tag.Data)
+			assert.NoError(t, err, v.Name)
+			cardTags = append(cardTags, types.Tag{Id: tag.Id, Data: value})
+		}
+		payload, err := SigningPayload(cardTags, v.UID)
+		assert.NoError(t, err, v.Name)
+		assert.Equal(t, v.Payload, string(payload), v.Name)
+
+		card, err := hex.DecodeString(v.Card)
+		assert.NoError(t, err, v.Name)
+		decoded, err := Decode(card)
+		assert.NoError(t, err, v.Name)
+		assert.Equal(t, cardTags, decoded, v.Name)
+		encoded, err := Encode(cardTags)
+		assert.NoError(t, err, v.Name)
+		assert.Equal(t, card, encoded, v.Name)
+	}
+}
+
+func TestPayloadVersion(t *testing.T) {
+	req := types.CardDefinitionRequest{AttendeeId: 1, ConventionId: 2, PayloadVersion: PAYLOAD_V2, UUID: "04412A014B3403"}
+	cardTags, err := RequestToTags(req)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(PAYLOAD_V2), PayloadVersion(cardTags))
+
+	payload, err := SigningPayload(cardTags, req.UUID)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"conventionId":2,"payloadVersion":2,"uid":"04412a014b3403","userId":1}`, string(payload))
+
+	_, err = SigningPayload(cardTags, "")
+	assert.Equal(t, ErrMissingUID, err)
+	_, err = SigningPayload(cardTags, `04","userId":2`)
+	assert.Error(t, err)
+
+	// v1 payloads do not depend on the card
+	v1, err := SigningPayload(cardTags[:1], "04412a014b3403")
+	assert.NoError(t, err)
+	assert.Equal(t, `{"conventionId":2,"userId":1}`, string(v1))
+	assert.Equal(t, uint64(PAYLOAD_V1), PayloadVersion(cardTags[:1]))
+
+	req.PayloadVersion = 4
+	cardTags, err = RequestToTags(req)
+	assert.NoError(t, err)
+	_, err = SigningPayload(cardTags, req.UUID)
+	assert.ErrorContains(t, err, "Unsupported payload version 4")
+}
+
+func TestSignatureKey(t *testing.T) {
+	cardTags, err := RequestToTags(types.CardDefinitionRequest{AttendeeId: 1, ConventionId: 2})
+	assert.NoError(t, err)
+	alg, kid := SignatureKey(cardTags)
+	assert.Equal(t, uint64(1), alg)
+	assert.Equal(t, "", kid)
+
+	cardTags, err = RequestToTags(types.CardDefinitionRequest{AttendeeId: 1, ConventionId: 2, SignatureAlg: 3, KeyId: "2025"})
+	assert.NoError(t, err)
+	alg, kid = SignatureKey(cardTags)
+	assert.Equal(t, uint64(3), alg)
+	assert.Equal(t, "2025", kid)
+
+	_, err = RequestToTags(types.CardDefinitionRequest{KeyId: "a-key-id-longer-than-16"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,223 @@
+package tags
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"ConcatNFCRegProxy/types"
+)
+
+type ValueType string
+
+const (
+	// VALUE_UINT is a big endian unsigned integer
+	VALUE_UINT ValueType = "uint"
+	// VALUE_UINT_PAIR is two big endian uint32 stored back to back
+	VALUE_UINT_PAIR ValueType = "uintpair"
+	// VALUE_TIMESTAMP is a big endian unix time in seconds
+	VALUE_TIMESTAMP ValueType = "timestamp"
+	// VALUE_BYTES is opaque data, base64 encoded in JSON
+	VALUE_BYTES ValueType = "bytes"
+	// VALUE_STRING is printable UTF-8 text, MaxSize counts bytes not characters
+	VALUE_STRING ValueType = "string"
+	// VALUE_ENTITLEMENTS is a types.Entitlements, see entitlements.go. Only
+	// built-in tags can use it.
+	VALUE_ENTITLEMENTS ValueType = "entitlements"
+)
+
+// TagDefinition describes how a tag is stored on the card and where its
+// value goes in types.CardDefinitionRequest
+type TagDefinition struct {
+	Id   byte
+	Name string
+	Type ValueType
+	// Fields are the JSON names of the request fields holding the value.
+	// VALUE_UINT_PAIR has two, every other type has one. Fields that are not
+	// part of types.CardDefinitionRequest are stored in its Custom map.
+	Fields []string
+	// Sizes are the accepted value lengths, the first one that holds the
+	// value is used when encoding. When empty any length up to MaxSize is
+	// accepted.
+	Sizes   []int
+	MaxSize int
+}
+
+var TAG_ATTENDEE_ID byte = 0x01
+var TAG_SIGNATURE byte = 0x02
+var TAG_ISSUANCE byte = 0x03
+var TAG_TIMESTAMP byte = 0x04
+var TAG_EXPIRATION byte = 0x05
+var TAG_BADGE_NAME byte = 0x06
+var TAG_TIER byte = 0x07
+var TAG_PRONOUNS byte = 0x08
+var TAG_ENTITLEMENTS byte = 0x09
+var TAG_PAYLOAD_VERSION byte = 0x0A
+var TAG_SIGNATURE_ALG byte = 0x0B
+var TAG_KEY_ID byte = 0x0C
+
+// Text tags are kept short so a card with every tag set stays well within an NTAG215
+const MAX_BADGE_NAME = 32
+const MAX_TIER = 16
+const MAX_PRONOUNS = 16
+const MAX_KEY_ID = 16
+
+// MAX_SIGNATURE leaves room for certificates or several signatures on an NTAG216
+const MAX_SIGNATURE = 512
+
+// TAG_CRITICAL_BIT marks tags that a reader must understand to make sense of
+// the card. Unknown tags without it can be skipped safely.
+var TAG_CRITICAL_BIT byte = 0x80
+
+// RejectUnknownCritical makes decoding fail on unknown critical tags instead
+// of returning them as unknown tags
+var RejectUnknownCritical = true
+
+// registry lists the known tags in the order they are written to the card.
+// The signature is always written last.
+var registry = []TagDefinition{
+	{Id: TAG_ATTENDEE_ID, Name: "TAG_ATTENDEE_ID", Type: VALUE_UINT_PAIR, Fields: []string{"attendeeId", "conventionId"}, Sizes: []int{8}},
+	{Id: TAG_ISSUANCE, Name: "TAG_ISSUANCE", Type: VALUE_UINT, Fields: []string{"issuance"}, Sizes: []int{4, 8}},
+	{Id: TAG_TIMESTAMP, Name: "TAG_TIMESTAMP", Type: VALUE_TIMESTAMP, Fields: []string{"timestamp"}, Sizes: []int{8}},
+	{Id: TAG_EXPIRATION, Name: "TAG_EXPIRATION", Type: VALUE_TIMESTAMP, Fields: []string{"expiration"}, Sizes: []int{8}},
+	{Id: TAG_BADGE_NAME, Name: "TAG_BADGE_NAME", Type: VALUE_STRING, Fields: []string{"badgeName"}, MaxSize: MAX_BADGE_NAME},
+	{Id: TAG_TIER, Name: "TAG_TIER", Type: VALUE_STRING, Fields: []string{"tier"}, MaxSize: MAX_TIER},
+	{Id: TAG_PRONOUNS, Name: "TAG_PRONOUNS", Type: VALUE_STRING, Fields: []string{"pronouns"}, MaxSize: MAX_PRONOUNS},
+	{Id: TAG_ENTITLEMENTS, Name: "TAG_ENTITLEMENTS", Type: VALUE_ENTITLEMENTS, Fields: []string{"entitlements"}, Sizes: []int{ENTITLEMENTS_SIZE}},
+	{Id: TAG_PAYLOAD_VERSION, Name: "TAG_PAYLOAD_VERSION", Type: VALUE_UINT, Fields: []string{"payloadVersion"}, Sizes: []int{1}},
+	{Id: TAG_SIGNATURE_ALG, Name: "TAG_SIGNATURE_ALG", Type: VALUE_UINT, Fields: []string{"signatureAlg"}, Sizes: []int{1}},
+	{Id: TAG_KEY_ID, Name: "TAG_KEY_ID", Type: VALUE_STRING, Fields: []string{"keyId"}, MaxSize: MAX_KEY_ID},
+	{Id: TAG_SIGNATURE, Name: "TAG_SIGNATURE", Type: VALUE_BYTES, Fields: []string{"signature"}, MaxSize: MAX_SIGNATURE},
+}
+
+// requestFields maps JSON names to the index of the field in types.CardDefinitionRequest
+var requestFields = map[string]int{}
+
+func init() {
+	t := reflect.TypeOf(types.CardDefinitionRequest{})
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			requestFields[name] = i
+		}
+	}
+}
+
+// Lookup returns the definition of a tag id
+func Lookup(id byte) (TagDefinition, bool) {
+	for _, def := range registry {
+		if def.Id == id {
+			return def, true
+		}
+	}
+	return TagDefinition{}, false
+}
+
+// IsCritical tells whether a tag id has the critical bit set
+func IsCritical(id byte) bool {
+	return id&TAG_CRITICAL_BIT != 0
+}
+
+// Definitions returns the registered tags in write order
+func Definitions() []TagDefinition {
+	return append([]TagDefinition{}, registry...)
+}
+
+// Register adds a custom tag. Custom tags are written before the signature.
+func Register(def TagDefinition) error {
+	err := def.validate()
+	if err != nil {
+		return err
+	}
+	for _, existing := range registry {
+		if existing.Id == def.Id {
+			return fmt.Errorf("Tag 0x%02x is already registered as %s", def.Id, existing.Name)
+		}
+		for _, field := range def.Fields {
+			for _, existingField := range existing.Fields {
+				if field == existingField {
+					return fmt.Errorf("Field %q of %s is already used by %s", field, def.Name, existing.Name)
+				}
+			}
+		}
+	}
+	for _, field := range def.Fields {
+		if _, builtin := requestFields[field]; builtin {
+			return fmt.Errorf("Field %q of %s is reserved", field, def.Name)
+		}
+	}
+	registry = append(registry[:len(registry)-1], def, registry[len(registry)-1])
+	return nil
+}
+
+func (def TagDefinition) validate() error {
+	if def.Id == 0x00 {
+		return fmt.Errorf("Tag 0x00 is reserved as the end marker")
+	}
+	if def.Id == TAG_ENVELOPE {
+		return fmt.Errorf("Tag 0x%02x is reserved for the encrypted envelope", def.Id)
+	}
+	// Cards without a header start with a tag id, which must not read as one
+	if def.Id == HEADER_MAGIC[0] {
+		return fmt.Errorf("Tag 0x%02x is reserved, it starts the card header", def.Id)
+	}
+	if def.Name == "" {
+		return fmt.Errorf("Tag 0x%02x needs a name", def.Id)
+	}
+	expectedFields := 1
+	if def.Type == VALUE_UINT_PAIR {
+		expectedFields = 2
+	}
+	if len(def.Fields) != expectedFields {
+		return fmt.Errorf("Tag %s needs %d field(s), got %d", def.Name, expectedFields, len(def.Fields))
+	}
+	switch def.Type {
+	case VALUE_UINT:
+		if len(def.Sizes) == 0 {
+			return fmt.Errorf("Tag %s needs at least one size", def.Name)
+		}
+		for _, size := range def.Sizes {
+			if size < 1 || size > 8 {
+				return fmt.Errorf("Tag %s: uint size must be between 1 and 8, got %d", def.Name, size)
+			}
+		}
+	case VALUE_UINT_PAIR, VALUE_TIMESTAMP:
+		if len(def.Sizes) != 1 || def.Sizes[0] != 8 {
+			return fmt.Errorf("Tag %s: %s values are 8 bytes", def.Name, def.Type)
+		}
+	case VALUE_BYTES:
+		if len(def.Sizes) == 0 && (def.MaxSize < 1 || def.MaxSize > MAX_TAG_LENGTH) {
+			return fmt.Errorf("Tag %s needs sizes or a max size between 1 and %d", def.Name, MAX_TAG_LENGTH)
+		}
+	case VALUE_STRING:
+		if len(def.Sizes) != 0 || def.MaxSize < 1 || def.MaxSize > 255 {
+			return fmt.Errorf("Tag %s needs a max size between 1 and 255 and no sizes", def.Name)
+		}
+	default:
+		return fmt.Errorf("Tag %s has unknown type %q", def.Name, def.Type)
+	}
+	return nil
+}
+
+func (def TagDefinition) checkSize(size int) error {
+	if len(def.Sizes) == 0 {
+		if size > def.MaxSize {
+			return fmt.Errorf("Tag %s expected at most %d bytes but got %d", def.Name, def.MaxSize, size)
+		}
+		return nil
+	}
+	for _, allowed := range def.Sizes {
+		if size == allowed {
+			return nil
+		}
+	}
+	return fmt.Errorf("Tag %s expected %s bytes but got %d", def.Name, joinSizes(def.Sizes), size)
+}
+
+func joinSizes(sizes []int) string {
+	var parts []string
+	for _, size := range sizes {
+		parts = append(parts, fmt.Sprintf("%d", size))
+	}
+	return strings.Join(parts, " or ")
+}
@@ -4,213 +4,432 @@ import (
 	"ConcatNFCRegProxy/types"
 	"encoding/base64"
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
+	"math"
+	"reflect"
 	"strconv"
+	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
-var TAG_ATTENDEE_ID byte = 0x01
-var TAG_SIGNATURE byte = 0x02
-var TAG_ISSUANCE byte = 0x03
-var TAG_TIMESTAMP byte = 0x04
-var TAG_EXPIRATION byte = 0x05
-
 func TagToText(tag types.Tag) (string, error) {
-	switch tag.Id {
-	case TAG_ATTENDEE_ID:
-		{
-			if len(tag.Data) != 8 {
-				return "", fmt.Errorf("Tag TAG_ATTENDEE_ID expected 4 bytes but got %d", len(tag.Data))
-			}
-			val := binary.BigEndian.Uint32(tag.Data[0:4])
-			val2 := binary.BigEndian.Uint32(tag.Data[4:8])
-			return fmt.Sprintf("TAG=TAG_ATTENDEE_ID UserID=%d ConventionID=%d", val, val2), nil
-		}
-	case TAG_SIGNATURE:
-		{
-			base64Str := base64.StdEncoding.EncodeToString(tag.Data)
-			return fmt.Sprintf("TAG=TAG_SIGNATURE Value=%s", base64Str), nil
-		}
-	case TAG_ISSUANCE:
-		{
-			if len(tag.Data) != 4 {
-				return "", fmt.Errorf("Tag TAG_ISSUANCE expected 4 bytes but got %d", len(tag.Data))
-			}
-			val := binary.BigEndian.Uint32(tag.Data)
-			return fmt.Sprintf("TAG=TAG_ISSUANCE Value=%d", val), nil
-		}
-	case TAG_TIMESTAMP:
-		{
-			if len(tag.Data) != 8 {
-				return "", fmt.Errorf("Tag TAG_TIMESTAMP expected 8 bytes but got %d", len(tag.Data))
-			}
-			ts := binary.BigEndian.Uint64(tag.Data)
-			issued := time.Unix(int64(ts), 0)
-			return fmt.Sprintf("TAG=TAG_TIMESTAMP Issued=%s", issued.Format(time.RFC3339)), nil
-		}
-	case TAG_EXPIRATION:
-		{
-			if len(tag.Data) != 8 {
-				return "", fmt.Errorf("Tag TAG_EXPIRATION expected 8 bytes but got %d", len(tag.Data))
-			}
-			ts := binary.BigEndian.Uint64(tag.Data)
-			issued := time.Unix(int64(ts), 0)
-			return fmt.Sprintf("TAG=TAG_TIMESTAMP Expiration=%s", issued.Format(time.RFC3339)), nil
-		}
+	def, ok := Lookup(tag.Id)
+	if !ok {
+		return fmt.Sprintf("TAG=UNKNOWN_0x%02x data=%s", tag.Id, base64.StdEncoding.EncodeToString(tag.Data)), nil
+	}
+	err := def.checkSize(len(tag.Data))
+	if err != nil {
+		return "", err
+	}
+	switch def.Type {
+	case VALUE_UINT_PAIR:
+		val := binary.BigEndian.Uint32(tag.Data[0:4])
+		val2 := binary.BigEndian.Uint32(tag.Data[4:8])
+		return fmt.Sprintf("TAG=%s %s=%d %s=%d", def.Name, def.Fields[0], val, def.Fields[1], val2), nil
+	case VALUE_UINT:
+		return fmt.Sprintf("TAG=%s %s=%d", def.Name, def.Fields[0], decodeUint(tag.Data)), nil
+	case VALUE_TIMESTAMP:
+		ts := time.Unix(int64(binary.BigEndian.Uint64(tag.Data)), 0).UTC()
+		return fmt.Sprintf("TAG=%s %s=%s", def.Name, def.Fields[0], ts.Format(time.RFC3339)), nil
+	case VALUE_STRING:
+		return fmt.Sprintf("TAG=%s %s=%q", def.Name, def.Fields[0], string(tag.Data)), nil
+	case VALUE_ENTITLEMENTS:
+		e := decodeEntitlements(tag.Data)
+		return fmt.Sprintf("TAG=%s firstDay=%s days=0x%04x zones=0x%08x", def.Name, e.FirstDay, e.Days, e.Zones), nil
 	default:
-		{
-			return "", fmt.Errorf("Unexpected tag type: %x", tag.Id)
-		}
+		return fmt.Sprintf("TAG=%s %s=%s", def.Name, def.Fields[0], base64.StdEncoding.EncodeToString(tag.Data)), nil
 	}
 }
 
+// TagsToRequest decodes the tags read from a card. Unknown tags are returned
+// in UnknownTags unless they are critical and RejectUnknownCritical is set.
 func TagsToRequest(tags []types.Tag) (types.CardDefinitionRequest, error) {
 	var resp types.CardDefinitionRequest
 	for _, tag := range tags {
-		switch tag.Id {
-		case TAG_ATTENDEE_ID:
-			{
-				if len(tag.Data) != 8 {
-					return resp, fmt.Errorf("Tag TAG_ATTENDEE_ID expected 8 bytes but got %d", len(tag.Data))
-				}
-				resp.AttendeeId = binary.BigEndian.Uint32(tag.Data[0:4])
-				resp.ConventionId = binary.BigEndian.Uint32(tag.Data[4:8])
-			}
-		case TAG_SIGNATURE:
-			{
-				resp.Signature = base64.StdEncoding.EncodeToString(tag.Data)
-			}
-		case TAG_ISSUANCE:
-			{
-				switch len(tag.Data) {
-				case 4:
-					resp.IssuanceCount = binary.BigEndian.Uint32(tag.Data)
-				case 8:
-					resp.IssuanceCount = uint32(binary.BigEndian.Uint64(tag.Data))
-				default:
-					return resp, fmt.Errorf("Tag TAG_ISSUANCE expected 4 bytes but got %d", len(tag.Data))
-				}
+		def, ok := Lookup(tag.Id)
+		if !ok {
+			err := checkUnknown(tag.Id)
+			if err != nil {
+				return resp, err
 			}
-		case TAG_TIMESTAMP:
-			{
-				if len(tag.Data) != 8 {
-					return resp, fmt.Errorf("Tag TAG_TIMESTAMP expected 8 bytes but got %d", len(tag.Data))
-				}
-				resp.IssuanceTimestamp = fmt.Sprintf("%v", binary.BigEndian.Uint64(tag.Data))
-			}
-		case TAG_EXPIRATION:
-			{
-				if len(tag.Data) != 8 {
-					return resp, fmt.Errorf("Tag TAG_EXPIRATION expected 8 bytes but got %d", len(tag.Data))
+			resp.UnknownTags = append(resp.UnknownTags, types.RawTag{Id: tag.Id, Data: append([]byte{}, tag.Data...)})
+			continue
+		}
+		err := decodeTag(def, tag.Data, &resp)
+		if err != nil {
+			return resp, err
+		}
+	}
+	return resp, nil
+}
+
+// RequestToTags encodes every field set in the request, in registry order.
+// Unknown tags carried over from a read are kept before the signature.
+func RequestToTags(req types.CardDefinitionRequest) ([]types.Tag, error) {
+	return requestToTags(req, nil)
+}
+
+// requestToTags is RequestToTags where the numeric fields in explicit are
+// written even when they are zero
+func requestToTags(req types.CardDefinitionRequest, explicit map[string]bool) ([]types.Tag, error) {
+	var tags []types.Tag
+	for _, def := range registry {
+		if def.Id == TAG_SIGNATURE {
+			for _, unknown := range req.UnknownTags {
+				if _, known := Lookup(unknown.Id); known || unknown.Id == 0x00 || unknown.Id == TAG_ENVELOPE {
+					return nil, fmt.Errorf("Tag 0x%02x is not an unknown tag", unknown.Id)
 				}
-				resp.Expiration = binary.BigEndian.Uint64(tag.Data)
-			}
-		default:
-			{
-				return resp, fmt.Errorf("Unexpected tag type: %x", tag.Id)
+				tags = append(tags, types.Tag{Id: unknown.Id, Data: unknown.Data})
 			}
 		}
+		data, present, err := encodeTag(def, &req, explicit)
+		if err != nil {
+			return nil, err
+		}
+		if present {
+			tags = append(tags, types.Tag{Id: def.Id, Data: data})
+		}
 	}
-	return resp, nil
+	return tags, nil
 }
 
-func NewAttendeeId(userid uint32, conventionid uint32) types.Tag {
-	data := make([]byte, 8)
-	binary.BigEndian.PutUint32(data[0:4], userid)
-	binary.BigEndian.PutUint32(data[4:8], conventionid)
-	return types.Tag{
-		Id:   TAG_ATTENDEE_ID,
-		Data: data,
+func ValidateSignatureStructure(str string) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(str)
+	if err != nil {
+		return []byte{}, err
 	}
+
+	return data, nil
 }
 
-func NewIssuance(value uint32) types.Tag {
-	data := make([]byte, 4)
-	binary.BigEndian.PutUint32(data, value)
-	return types.Tag{
-		Id:   TAG_ISSUANCE,
-		Data: data,
+func hasTag(tags []types.Tag, id byte) bool {
+	for _, tag := range tags {
+		if tag.Id == id {
+			return true
+		}
 	}
+	return false
 }
 
-func NewTimestamp(unixTimestamp uint64) types.Tag {
-	data := make([]byte, 8)
-	binary.BigEndian.PutUint64(data, unixTimestamp)
-	return types.Tag{
-		Id:   TAG_TIMESTAMP,
-		Data: data,
+func insertBeforeSignature(tags []types.Tag, tag types.Tag) []types.Tag {
+	for idx, existing := range tags {
+		if existing.Id == TAG_SIGNATURE {
+			return append(tags[:idx], append([]types.Tag{tag}, tags[idx:]...)...)
+		}
 	}
+	return append(tags, tag)
 }
 
-func NewExpiration(unixTimestamp uint64) types.Tag {
-	data := make([]byte, 8)
-	binary.BigEndian.PutUint64(data, unixTimestamp)
-	return types.Tag{
-		Id:   TAG_EXPIRATION,
-		Data: data,
+func checkUnknown(id byte) error {
+	if id == TAG_ENVELOPE {
+		return fmt.Errorf("%w: the envelope key is not configured", ErrEncrypted)
 	}
+	if IsCritical(id) && RejectUnknownCritical {
+		return fmt.Errorf("Unexpected critical tag type: %x", id)
+	}
+	return nil
 }
 
-func NewSignature(signatureData []byte) types.Tag {
-	return types.Tag{
-		Id:   TAG_SIGNATURE,
-		Data: signatureData,
+func decodeUint(data []byte) uint64 {
+	var val uint64
+	for _, b := range data {
+		val = val<<8 | uint64(b)
 	}
+	return val
 }
 
-func ValidateSignatureStructure(str string) ([]byte, error) {
-	data, err := base64.StdEncoding.DecodeString(str)
+func encodeUint(val uint64, size int) []byte {
+	data := make([]byte, size)
+	for i := size - 1; i >= 0; i-- {
+		data[i] = byte(val)
+		val >>= 8
+	}
+	return data
+}
+
+func decodeTag(def TagDefinition, data []byte, req *types.CardDefinitionRequest) error {
+	err := def.checkSize(len(data))
 	if err != nil {
-		return []byte{}, err
+		return err
 	}
+	switch def.Type {
+	case VALUE_UINT_PAIR:
+		err = setUint(req, def.Fields[0], uint64(binary.BigEndian.Uint32(data[0:4])))
+		if err != nil {
+			return err
+		}
+		return setUint(req, def.Fields[1], uint64(binary.BigEndian.Uint32(data[4:8])))
+	case VALUE_UINT, VALUE_TIMESTAMP:
+		return setUint(req, def.Fields[0], decodeUint(data))
+	case VALUE_BYTES:
+		setBytes(req, def.Fields[0], data)
+	case VALUE_STRING:
+		err = checkText(def.Fields[0], string(data))
+		if err != nil {
+			return err
+		}
+		setString(req, def.Fields[0], string(data))
+	case VALUE_ENTITLEMENTS:
+		v, ok := requestField(req, def.Fields[0])
+		if !ok {
+			return fmt.Errorf("Tag %s needs a built-in field", def.Name)
+		}
+		v.Set(reflect.ValueOf(decodeEntitlements(data)))
+	}
+	return nil
+}
 
-	return data, nil
+// encodeTag returns the value of the tag from the request, and false if the
+// request does not set it. Numeric fields in explicit are set even when zero.
+func encodeTag(def TagDefinition, req *types.CardDefinitionRequest, explicit map[string]bool) ([]byte, bool, error) {
+	switch def.Type {
+	case VALUE_UINT_PAIR:
+		first, firstSet, err := getUint(req, def.Fields[0])
+		if err != nil {
+			return nil, false, err
+		}
+		second, secondSet, err := getUint(req, def.Fields[1])
+		if err != nil {
+			return nil, false, err
+		}
+		firstSet = firstSet || explicit[def.Fields[0]]
+		secondSet = secondSet || explicit[def.Fields[1]]
+		if !firstSet && !secondSet {
+			return nil, false, nil
+		}
+		if !firstSet || !secondSet {
+			return nil, false, fmt.Errorf("'%s' and '%s' should not be zero or empty", def.Fields[0], def.Fields[1])
+		}
+		if first > math.MaxUint32 || second > math.MaxUint32 {
+			return nil, false, fmt.Errorf("'%s' and '%s' must fit in 32 bits", def.Fields[0], def.Fields[1])
+		}
+		data := make([]byte, 8)
+		binary.BigEndian.PutUint32(data[0:4], uint32(first))
+		binary.BigEndian.PutUint32(data[4:8], uint32(second))
+		return data, true, nil
+	case VALUE_UINT, VALUE_TIMESTAMP:
+		val, set, err := getUint(req, def.Fields[0])
+		if err != nil || !(set || explicit[def.Fields[0]]) {
+			return nil, false, err
+		}
+		for _, size := range def.Sizes {
+			if size >= 8 || val>>(8*size) == 0 {
+				return encodeUint(val, size), true, nil
+			}
+		}
+		return nil, false, fmt.Errorf("'%s' does not fit in %d bytes", def.Fields[0], def.Sizes[len(def.Sizes)-1])
+	case VALUE_BYTES:
+		data, set, err := getBytes(req, def.Fields[0])
+		if err != nil || !set {
+			return nil, false, err
+		}
+		err = def.checkSize(len(data))
+		if err != nil {
+			return nil, false, err
+		}
+		return data, true, nil
+	case VALUE_STRING:
+		str, set, err := getString(req, def.Fields[0])
+		if err != nil || !set {
+			return nil, false, err
+		}
+		err = checkText(def.Fields[0], str)
+		if err != nil {
+			return nil, false, err
+		}
+		err = def.checkSize(len(str))
+		if err != nil {
+			return nil, false, err
+		}
+		return []byte(str), true, nil
+	case VALUE_ENTITLEMENTS:
+		v, ok := requestField(req, def.Fields[0])
+		if !ok {
+			return nil, false, fmt.Errorf("Tag %s needs a built-in field", def.Name)
+		}
+		e, _ := v.Interface().(*types.Entitlements)
+		if e == nil {
+			return nil, false, nil
+		}
+		data, err := encodeEntitlements(e)
+		if err != nil {
+			return nil, false, err
+		}
+		return data, true, nil
+	}
+	return nil, false, fmt.Errorf("Tag %s has unknown type %q", def.Name, def.Type)
 }
 
-func UpdateTagAttendee(tags types.Tag, data types.CardDefinitionRequest) (types.Tag, error) {
-	if data.AttendeeId == 0 || data.ConventionId == 0 {
-		return types.Tag{}, fmt.Errorf("'attendeeId' and 'conventionId' should not be zero or empty")
+// requestField returns the struct field for a JSON name, if it is not a custom field
+func requestField(req *types.CardDefinitionRequest, field string) (reflect.Value, bool) {
+	idx, ok := requestFields[field]
+	if !ok {
+		return reflect.Value{}, false
 	}
-	return NewAttendeeId(data.AttendeeId, data.ConventionId), nil
+	return reflect.ValueOf(req).Elem().Field(idx), true
 }
 
-func UpdateTags(tags []types.Tag, data types.CardDefinitionRequest) ([]types.Tag, error) {
-	var err error
-	var content types.Tag
-	for idx, tag := range tags {
-		if tag.Id == TAG_ATTENDEE_ID {
-			if data.AttendeeId != 0 || data.ConventionId != 0 {
-				content, err = UpdateTagAttendee(tag, data)
-				if err != nil {
-					return []types.Tag{}, err
-				}
-				tags[idx] = content
-			}
-		} else if tag.Id == TAG_ISSUANCE {
-			if data.IssuanceCount != 0 {
-				tags[idx] = NewIssuance(data.IssuanceCount)
-			}
-		} else if tag.Id == TAG_TIMESTAMP {
-			if data.IssuanceTimestamp != "" {
-				timestamp, err := strconv.ParseUint(data.IssuanceTimestamp, 10, 64)
-				if err != nil {
-					return nil, err
-				}
-				tags[idx] = NewTimestamp(timestamp)
+// getUint reads a numeric field. Built-in fields treat zero as not set.
+func getUint(req *types.CardDefinitionRequest, field string) (uint64, bool, error) {
+	if v, ok := requestField(req, field); ok {
+		switch v.Kind() {
+		case reflect.Uint32, reflect.Uint64:
+			return v.Uint(), v.Uint() != 0, nil
+		case reflect.String:
+			if v.String() == "" {
+				return 0, false, nil
 			}
-		} else if tag.Id == TAG_EXPIRATION {
-			if data.Expiration != 0 {
-				tags[idx] = NewExpiration(data.Expiration)
-			}
-		} else if tag.Id == TAG_SIGNATURE {
-			if data.Signature != "" {
-				sign, err := ValidateSignatureStructure(data.Signature)
-				if err != nil {
-					return []types.Tag{}, err
-				}
-				tags[idx] = NewSignature(sign)
+			val, err := strconv.ParseUint(v.String(), 10, 64)
+			if err != nil {
+				return 0, false, fmt.Errorf("Invalid %s: %w", field, err)
 			}
+			return val, true, nil
 		}
+		return 0, false, fmt.Errorf("Field %s is not numeric", field)
 	}
-	return tags, nil
+	raw, ok := req.Custom[field]
+	if !ok || raw == nil {
+		return 0, false, nil
+	}
+	switch val := raw.(type) {
+	case uint64:
+		return val, true, nil
+	case int:
+		if val < 0 {
+			return 0, false, fmt.Errorf("Invalid %s: expected an unsigned integer", field)
+		}
+		return uint64(val), true, nil
+	case float64:
+		if val < 0 || val != math.Trunc(val) || val > math.MaxUint64 {
+			return 0, false, fmt.Errorf("Invalid %s: expected an unsigned integer", field)
+		}
+		return uint64(val), true, nil
+	case json.Number:
+		parsed, err := strconv.ParseUint(val.String(), 10, 64)
+		if err != nil {
+			return 0, false, fmt.Errorf("Invalid %s: %w", field, err)
+		}
+		return parsed, true, nil
+	case string:
+		parsed, err := strconv.ParseUint(val, 10, 64)
+		if err != nil {
+			return 0, false, fmt.Errorf("Invalid %s: %w", field, err)
+		}
+		return parsed, true, nil
+	}
+	return 0, false, fmt.Errorf("Invalid %s: expected an unsigned integer", field)
+}
+
+func setUint(req *types.CardDefinitionRequest, field string, val uint64) error {
+	if v, ok := requestField(req, field); ok {
+		if v.Kind() == reflect.String {
+			v.SetString(strconv.FormatUint(val, 10))
+		} else if v.OverflowUint(val) {
+			return fmt.Errorf("Value %d of %s does not fit in %d bits", val, field, v.Type().Bits())
+		} else {
+			v.SetUint(val)
+		}
+		return nil
+	}
+	setCustom(req, field, val)
+	return nil
+}
+
+// getBytes reads a base64 encoded field
+func getBytes(req *types.CardDefinitionRequest, field string) ([]byte, bool, error) {
+	var str string
+	if v, ok := requestField(req, field); ok {
+		str = v.String()
+	} else {
+		raw, ok := req.Custom[field]
+		if !ok || raw == nil {
+			return nil, false, nil
+		}
+		str, ok = raw.(string)
+		if !ok {
+			return nil, false, fmt.Errorf("Invalid %s: expected a base64 string", field)
+		}
+	}
+	if str == "" {
+		return nil, false, nil
+	}
+	data, err := ValidateSignatureStructure(str)
+	if err != nil {
+		return nil, false, fmt.Errorf("Invalid %s: %w", field, err)
+	}
+	return data, true, nil
+}
+
+func setBytes(req *types.CardDefinitionRequest, field string, data []byte) {
+	str := base64.StdEncoding.EncodeToString(data)
+	if v, ok := requestField(req, field); ok {
+		v.SetString(str)
+		return
+	}
+	setCustom(req, field, str)
+}
+
+// getString reads a text field. Empty strings are not set.
+func getString(req *types.CardDefinitionRequest, field string) (string, bool, error) {
+	if v, ok := requestField(req, field); ok {
+		return v.String(), v.String() != "", nil
+	}
+	raw, ok := req.Custom[field]
+	if !ok || raw == nil {
+		return "", false, nil
+	}
+	str, ok := raw.(string)
+	if !ok {
+		return "", false, fmt.Errorf("Invalid %s: expected a string", field)
+	}
+	return str, str != "", nil
+}
+
+func setString(req *types.CardDefinitionRequest, field string, str string) {
+	if v, ok := requestField(req, field); ok {
+		v.SetString(str)
+		return
+	}
+	setCustom(req, field, str)
+}
+
+// checkText accepts valid UTF-8 without control characters, so the value can
+// be shown as is on a validator screen
+func checkText(field string, str string) error {
+	if !utf8.ValidString(str) {
+		return fmt.Errorf("Invalid %s: not valid UTF-8", field)
+	}
+	for _, r := range str {
+		if unicode.IsControl(r) {
+			return fmt.Errorf("Invalid %s: control characters are not allowed", field)
+		}
+	}
+	return nil
+}
+
+func setCustom(req *types.CardDefinitionRequest, field string, val any) {
+	if req.Custom == nil {
+		req.Custom = map[string]any{}
+	}
+	req.Custom[field] = val
+}
+
+// ParseValueType accepts the value type names used in the config file
+func ParseValueType(name string) (ValueType, error) {
+	switch ValueType(strings.ToLower(name)) {
+	case VALUE_UINT:
+		return VALUE_UINT, nil
+	case VALUE_UINT_PAIR:
+		return VALUE_UINT_PAIR, nil
+	case VALUE_TIMESTAMP:
+		return VALUE_TIMESTAMP, nil
+	case VALUE_BYTES:
+		return VALUE_BYTES, nil
+	case VALUE_STRING:
+		return VALUE_STRING, nil
+	}
+	return "", fmt.Errorf("Unknown tag value type %q", name)
 }
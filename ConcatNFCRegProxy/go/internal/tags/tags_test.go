@@ -0,0 +1,233 @@
+package tags
+
+import (
+	"encoding/json"
+	"testing"
+
+	"ConcatNFCRegProxy/types"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const TEST_SIGNATURE = "MEQCIHpXY2gII+lYW6s7NkXrJkLRLDE8KIDB8It/O/5gfIvdAiBFMwKSbLkmwUUrlDdIobSCahZ/xZUvhBK7JCp1UKKv2w=="
+
+func restoreRegistry(t *testing.T) {
+	saved := Definitions()
+	t.Cleanup(func() {
+		registry = saved
+	})
+}
+
+func TestRequestRoundTrip(t *testing.T) {
+	req := types.CardDefinitionRequest{
+		AttendeeId:        2,
+		ConventionId:      24535786,
+		IssuanceCount:     32,
+		IssuanceTimestamp: "1749932218",
+		Expiration:        1750000000,
+		Signature:         TEST_SIGNATURE,
+	}
+	encoded, err := RequestToTags(req)
+	assert.NoError(t, err)
+
+	var ids []byte
+	for _, tag := range encoded {
+		ids = append(ids, tag.Id)
+	}
+	assert.Equal(t, []byte{TAG_ATTENDEE_ID, TAG_ISSUANCE, TAG_TIMESTAMP, TAG_EXPIRATION, TAG_SIGNATURE}, ids)
+
+	decoded, err := TagsToRequest(encoded)
+	assert.NoError(t, err)
+	assert.Equal(t, req, decoded)
+}
+
+func TestSizeRules(t *testing.T) {
+	// Issuance is written with 4 bytes but older cards may carry 8
+	decoded, err := TagsToRequest([]types.Tag{{Id: TAG_ISSUANCE, Data: []byte{0, 0, 0, 0, 0, 0, 0, 7}}})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(7), decoded.IssuanceCount)
+
+	text, err := TagToText(types.Tag{Id: TAG_ISSUANCE, Data: []byte{0, 0, 0, 0, 0, 0, 0, 7}})
+	assert.NoError(t, err)
+	assert.Equal(t, "TAG=TAG_ISSUANCE issuance=7", text)
+
+	// Counts past 32 bits use the 8 byte form and read back unchanged
+	encoded, err := RequestToTags(types.CardDefinitionRequest{AttendeeId: 1, ConventionId: 2, IssuanceCount: 1 << 32, Signature: TEST_SIGNATURE})
+	assert.NoError(t, err)
+	assert.Equal(t, types.Tag{Id: TAG_ISSUANCE, Data: []byte{0, 0, 0, 1, 0, 0, 0, 0}}, encoded[1])
+	decoded, err = TagsToRequest(encoded)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1<<32), decoded.IssuanceCount)
+
+	_, err = TagsToRequest([]types.Tag{{Id: TAG_ISSUANCE, Data: []byte{0, 7}}})
+	assert.EqualError(t, err, "Tag TAG_ISSUANCE expected 4 or 8 bytes but got 2")
+
+	text, err = TagToText(types.Tag{Id: TAG_EXPIRATION, Data: []byte{0, 0, 0, 0, 0x68, 0x4e, 0x9a, 0x80}})
+	assert.NoError(t, err)
+	assert.Equal(t, "TAG=TAG_EXPIRATION expiration=2025-06-15T10:03:44Z", text)
+
+	_, err = RequestToTags(types.CardDefinitionRequest{AttendeeId: 1})
+	assert.Error(t, err)
+}
+
+func TestCustomTag(t *testing.T) {
+	restoreRegistry(t)
+
+	err := Register(TagDefinition{Id: 0x20, Name: "TAG_SEAT", Type: VALUE_UINT, Fields: []string{"seat"}, Sizes: []int{2}})
+	assert.NoError(t, err)
+	assert.Error(t, Register(TagDefinition{Id: 0x20, Name: "TAG_OTHER", Type: VALUE_UINT, Fields: []string{"other"}, Sizes: []int{2}}))
+	assert.Error(t, Register(TagDefinition{Id: 0x21, Name: "TAG_OTHER", Type: VALUE_UINT, Fields: []string{"attendeeId"}, Sizes: []int{2}}))
+	assert.ErrorContains(t, Register(TagDefinition{Id: 'C', Name: "TAG_OTHER", Type: VALUE_UINT, Fields: []string{"other"}, Sizes: []int{2}}), "card header")
+
+	var req types.CardDefinitionRequest
+	assert.NoError(t, json.Unmarshal([]byte(`{"attendeeId":1,"conventionId":2,"signature":"`+TEST_SIGNATURE+`","custom":{"seat":1234}}`), &req))
+	encoded, err := RequestToTags(req)
+	assert.NoError(t, err)
+	assert.Equal(t, TAG_SIGNATURE, encoded[len(encoded)-1].Id)
+	assert.Equal(t, types.Tag{Id: 0x20, Data: []byte{0x04, 0xd2}}, encoded[1])
+
+	decoded, err := TagsToRequest(encoded)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1234), decoded.Custom["seat"])
+
+	req.Custom["seat"] = 70000
+	_, err = RequestToTags(req)
+	assert.Error(t, err)
+}
+
+func TestUnknownTags(t *testing.T) {
+	current, err := RequestToTags(types.CardDefinitionRequest{
+		AttendeeId:        1,
+		ConventionId:      2,
+		IssuanceCount:     1,
+		IssuanceTimestamp: "1000",
+		Signature:         TEST_SIGNATURE,
+	})
+	assert.NoError(t, err)
+	unknown := types.Tag{Id: 0x30, Data: []byte{0xde, 0xad, 0xbe, 0xef}}
+	current = append(current[:1], append([]types.Tag{unknown}, current[1:]...)...)
+
+	decoded, err := TagsToRequest(current)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.RawTag{{Id: 0x30, Data: []byte{0xde, 0xad, 0xbe, 0xef}}}, decoded.UnknownTags)
+
+	text, err := TagToText(unknown)
+	assert.NoError(t, err)
+	assert.Equal(t, "TAG=UNKNOWN_0x30 data=3q2+7w==", text)
+
+	updated, err := MergePatch(current, []byte(`{"issuance":2}`))
+	assert.NoError(t, err)
+	assert.Equal(t, unknown, updated[1])
+
+	// Written back before the signature
+	rewritten, err := RequestToTags(decoded)
+	assert.NoError(t, err)
+	assert.Equal(t, unknown, rewritten[len(rewritten)-2])
+	assert.Equal(t, TAG_SIGNATURE, rewritten[len(rewritten)-1].Id)
+
+	decoded.UnknownTags = []types.RawTag{{Id: TAG_ISSUANCE, Data: []byte{1}}}
+	_, err = RequestToTags(decoded)
+	assert.Error(t, err)
+}
+
+func TestUnknownCriticalTags(t *testing.T) {
+	t.Cleanup(func() {
+		RejectUnknownCritical = true
+	})
+	critical := []types.Tag{{Id: TAG_ISSUANCE, Data: []byte{0, 0, 0, 1}}, {Id: 0xb0, Data: []byte{1}}}
+
+	RejectUnknownCritical = true
+	_, err := TagsToRequest(critical)
+	assert.EqualError(t, err, "Unexpected critical tag type: b0")
+	_, err = MergePatch(critical, []byte(`{"issuance":2}`))
+	assert.Error(t, err)
+
+	RejectUnknownCritical = false
+	decoded, err := TagsToRequest(critical)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.RawTag{{Id: 0xb0, Data: []byte{1}}}, decoded.UnknownTags)
+}
+
+func TestTextTags(t *testing.T) {
+	req := types.CardDefinitionRequest{
+		AttendeeId:   1,
+		ConventionId: 2,
+		BadgeName:    "Zoë Fluffytail 🦊",
+		Tier:         "Sponsor",
+		Pronouns:     "they/them",
+		Signature:    TEST_SIGNATURE,
+	}
+	encoded, err := RequestToTags(req)
+	assert.NoError(t, err)
+	assert.Equal(t, types.Tag{Id: TAG_BADGE_NAME, Data: []byte("Zoë Fluffytail 🦊")}, encoded[1])
+
+	decoded, err := TagsToRequest(encoded)
+	assert.NoError(t, err)
+	assert.Equal(t, req, decoded)
+
+	text, err := TagToText(encoded[2])
+	assert.NoError(t, err)
+	assert.Equal(t, `TAG=TAG_TIER tier="Sponsor"`, text)
+
+	// Limits count bytes, not characters
+	req.BadgeName = "🦊🦊🦊🦊🦊🦊🦊🦊🦊"
+	_, err = RequestToTags(req)
+	assert.EqualError(t, err, "Tag TAG_BADGE_NAME expected at most 32 bytes but got 36")
+
+	req.BadgeName = "Line\nbreak"
+	_, err = RequestToTags(req)
+	assert.Error(t, err)
+
+	_, err = TagsToRequest([]types.Tag{{Id: TAG_PRONOUNS, Data: []byte{0xff, 0xfe}}})
+	assert.EqualError(t, err, "Invalid pronouns: not valid UTF-8")
+}
+
+func TestExtendedLength(t *testing.T) {
+	cases := []struct {
+		length  int
+		encoded []byte
+	}{
+		{1, []byte{0x01}},
+		{254, []byte{0xfe}},
+		{255, []byte{0xff, 0x00, 0xff}},
+		{600, []byte{0xff, 0x02, 0x58}},
+		{MAX_TAG_LENGTH, []byte{0xff, 0xff, 0xff}},
+	}
+	for _, c := range cases {
+		encoded, err := EncodeLength(c.length)
+		assert.NoError(t, err)
+		assert.Equal(t, c.encoded, encoded)
+		if len(encoded) == 3 {
+			assert.Equal(t, c.length, DecodeExtendedLength(encoded[1:]))
+		}
+	}
+	_, err := EncodeLength(MAX_TAG_LENGTH + 1)
+	assert.Error(t, err)
+
+	assert.NoError(t, CheckTag(types.Tag{Id: TAG_SIGNATURE, Data: make([]byte, MAX_SIGNATURE)}))
+	assert.EqualError(t, CheckTag(types.Tag{Id: TAG_SIGNATURE, Data: make([]byte, MAX_SIGNATURE+1)}),
+		"Tag TAG_SIGNATURE expected at most 512 bytes but got 513")
+	assert.NoError(t, CheckTag(types.Tag{Id: 0x30, Data: make([]byte, 1000)}))
+	assert.Error(t, CheckTag(types.Tag{Id: 0x30, Data: make([]byte, MAX_TAG_LENGTH+1)}))
+	assert.Error(t, CheckTag(types.Tag{Id: 0x30}))
+	assert.Error(t, CheckTag(types.Tag{Id: 0x00, Data: []byte{1}}))
+}
+
+func TestSigningPayload(t *testing.T) {
+	req := types.CardDefinitionRequest{
+		AttendeeId:        12345,
+		ConventionId:      1,
+		IssuanceCount:     1,
+		IssuanceTimestamp: "1672531200",
+		Expiration:        1675123200,
+		BadgeName:         `Zoë "Fox" \ Fluffytail`,
+		Pronouns:          "they/them",
+		Entitlements:      &types.Entitlements{Zones: 1},
+		Signature:         TEST_SIGNATURE,
+		Custom:            map[string]any{"seat": 1},
+	}
+	payload, err := RequestSigningPayload(req)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"badgeName":"Zoë \"Fox\" \\ Fluffytail","conventionId":1,"entitlements":{"days":0,"zones":1},`+
+		`"expiration":1675123200,"issuanceCount":1,"pronouns":"they/them","timestamp":"1672531200","userId":12345}`, string(payload))
+}
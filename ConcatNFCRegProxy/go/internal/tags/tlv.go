@@ -0,0 +1,52 @@
+package tags
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	"ConcatNFCRegProxy/types"
+)
+
+// EXTENDED_LENGTH escapes the length byte: it is followed by the real length
+// as a big endian uint16. Lengths under 0xFF keep the single byte form so
+// older cards parse the same.
+var EXTENDED_LENGTH byte = 0xFF
+
+// MAX_TAG_LENGTH is the longest value the extended length form can hold
+const MAX_TAG_LENGTH = math.MaxUint16
+
+// EncodeLength returns the length field for a value of n bytes
+func EncodeLength(n int) ([]byte, error) {
+	if n < 0 || n > MAX_TAG_LENGTH {
+		return nil, fmt.Errorf("Tag length %d is over the maximum of %d", n, MAX_TAG_LENGTH)
+	}
+	if n < int(EXTENDED_LENGTH) {
+		return []byte{byte(n)}, nil
+	}
+	return []byte{EXTENDED_LENGTH, byte(n >> 8), byte(n)}, nil
+}
+
+// DecodeExtendedLength reads the two bytes following EXTENDED_LENGTH
+func DecodeExtendedLength(data []byte) int {
+	return int(binary.BigEndian.Uint16(data))
+}
+
+// CheckTag refuses a tag that cannot be written: a reserved id, a value over
+// the maximum of its definition or over what the length field can hold
+func CheckTag(tag types.Tag) error {
+	if tag.Id == 0x00 {
+		return fmt.Errorf("Tag 0x00 is reserved as the end marker")
+	}
+	if len(tag.Data) == 0 {
+		return fmt.Errorf("Tag 0x%02x has no data", tag.Id)
+	}
+	if len(tag.Data) > MAX_TAG_LENGTH {
+		return fmt.Errorf("Tag 0x%02x is %d bytes, over the maximum of %d", tag.Id, len(tag.Data), MAX_TAG_LENGTH)
+	}
+	def, ok := Lookup(tag.Id)
+	if !ok {
+		return nil
+	}
+	return def.checkSize(len(tag.Data))
+}
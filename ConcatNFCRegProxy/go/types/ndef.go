@@ -0,0 +1,38 @@
+package types
+
+// NDEF is the public NDEF content of a card, readable without the password
+type NDEF struct {
+	// Version is the mapping version of the capability container, such as "1.0"
+	Version string `json:"version"`
+	// Size is the data area size announced by the capability container
+	Size     int          `json:"size"`
+	ReadOnly bool         `json:"readOnly"`
+	Records  []NDEFRecord `json:"records"`
+	// Mirror is set when a URL record matches the layout.ndefUrl template
+	Mirror *NDEFMirror `json:"mirror,omitempty"`
+}
+
+// NDEFMirror holds the values NTAG21x mirrors into the NDEF URL on each read
+type NDEFMirror struct {
+	// UID is the card UID in lowercase hex
+	UID string `json:"uid,omitempty"`
+	// Counter is the NFC read counter, incremented on the first read after
+	// each tap
+	Counter *uint32 `json:"counter,omitempty"`
+}
+
+// NDEFRecord is one decoded record. URI, Text and MIME records fill their
+// fields, other records only carry the raw payload.
+type NDEFRecord struct {
+	// TNF is the type name format, 1 for well known types such as "U" and "T"
+	TNF  byte   `json:"tnf"`
+	Type string `json:"type"`
+	Id   string `json:"id,omitempty"`
+	URI  string `json:"uri,omitempty"`
+	Text string `json:"text,omitempty"`
+	Lang string `json:"lang,omitempty"`
+	// MimeType is set for MIME media records, with the payload in Payload
+	MimeType string `json:"mimeType,omitempty"`
+	// Payload is base64 encoded in JSON
+	Payload []byte `json:"payload,omitempty"`
+}
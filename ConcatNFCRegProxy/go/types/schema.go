@@ -6,6 +6,35 @@ type Response struct {
 	Success bool   `json:"success"`
 	//Use pointer because if we use a empty object the response will always contain an empty card object
 	Card *CardDefinitionRequest `json:"card,omitempty"`
+	// OlderFormat is set when the card was written before the card header existed
+	OlderFormat bool `json:"olderFormat,omitempty"`
+	// Encrypted is set when the card was sealed in an envelope
+	Encrypted bool `json:"encrypted,omitempty"`
+	// SignatureValid is set when the read asked for signature verification
+	SignatureValid *bool `json:"signatureValid,omitempty"`
+	// Signature and KeyId are set when the proxy signed the card itself
+	Signature string `json:"signature,omitempty"`
+	KeyId     string `json:"keyId,omitempty"`
+	// Before and After are the card contents around a PATCH
+	Before *CardDefinitionRequest `json:"before,omitempty"`
+	After  *CardDefinitionRequest `json:"after,omitempty"`
+	// NDEF is the public NDEF content of the card, when it has one
+	NDEF *NDEF `json:"ndef,omitempty"`
+}
+
+type VerifyResponse struct {
+	Error          string `json:"error,omitempty"`
+	Success        bool   `json:"success"`
+	SignatureValid bool   `json:"signatureValid"`
+	// Payload is the signed payload built from the card definition
+	Payload string `json:"payload,omitempty"`
+}
+
+type CanonicalResponse struct {
+	Error   string `json:"error,omitempty"`
+	Success bool   `json:"success"`
+	// Payload is the exact text the signature of the card covers
+	Payload string `json:"payload,omitempty"`
 }
 
 type Tag struct {
@@ -13,18 +42,73 @@ type Tag struct {
 	Data []byte
 }
 
+// RawTag is a tag this proxy does not understand, kept byte for byte
+type RawTag struct {
+	Id   byte   `json:"id"`
+	Data []byte `json:"data"`
+}
+
 type CardDefinitionRequest struct {
 	AttendeeId        uint32 `json:"attendeeId,omitempty"`
 	ConventionId      uint32 `json:"conventionId,omitempty"`
-	IssuanceCount     uint32 `json:"issuance,omitempty"`
+	IssuanceCount     uint64 `json:"issuance,omitempty"`
 	IssuanceTimestamp string `json:"timestamp,omitempty"`
 	Expiration        uint64 `json:"expiration,omitempty"`
-	Signature         string `json:"signature,omitempty"`
-	Password          uint32 `json:"password,omitempty"`
-	UUID              string `json:"uuid,omitempty"`
+	BadgeName         string `json:"badgeName,omitempty"`
+	Tier              string `json:"tier,omitempty"`
+	Pronouns          string `json:"pronouns,omitempty"`
+	// Entitlements restricts the days and zones the badge is valid for
+	Entitlements *Entitlements `json:"entitlements,omitempty"`
+	// PayloadVersion 2 binds the signature to the card UID, see tags.SigningPayload
+	PayloadVersion uint32 `json:"payloadVersion,omitempty"`
+	// SignatureAlg is the signature algorithm, 1 (default) DER ECDSA P-256,
+	// 2 raw r||s ECDSA P-256 or 3 Ed25519
+	SignatureAlg uint32 `json:"signatureAlg,omitempty"`
+	// KeyId names the signing key in the validators' JWKS
+	KeyId     string `json:"keyId,omitempty"`
+	Signature string `json:"signature,omitempty"`
+	Password  uint32 `json:"password,omitempty"`
+	UUID      string `json:"uuid,omitempty"`
+	// Custom holds the values of tags registered from the config, by field name
+	Custom map[string]any `json:"custom,omitempty"`
+	// UnknownTags holds the tags found on the card that are not registered.
+	// They are written back unchanged, before the signature.
+	UnknownTags []RawTag `json:"unknownTags,omitempty"`
+}
+
+// Entitlements are the days and zones a badge grants access to. Bit n of Days
+// is FirstDay + n, bit n of Zones is zone n. An empty bitmap does not
+// restrict: Days 0 means every day and Zones 0 every zone.
+type Entitlements struct {
+	FirstDay string `json:"firstDay,omitempty"`
+	Days     uint16 `json:"days"`
+	Zones    uint32 `json:"zones"`
 }
 
 type CardReadSetPasswordRequest struct {
 	Password uint32 `json:"password,omitempty"`
 	UUID     string `json:"uuid,omitempty"`
+	// Verify adds signatureValid to the /read response
+	Verify bool `json:"verify,omitempty"`
+}
+
+type PairRequest struct {
+	Code   string   `json:"code"`
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes,omitempty"`
+}
+
+type PairResponse struct {
+	Error   string   `json:"error,omitempty"`
+	Success bool     `json:"success"`
+	Key     string   `json:"key,omitempty"`
+	Scopes  []string `json:"scopes,omitempty"`
+}
+
+type EventTicketResponse struct {
+	Error   string `json:"error,omitempty"`
+	Success bool   `json:"success"`
+	Ticket  string `json:"ticket,omitempty"`
+	// ExpiresIn is the number of seconds the ticket can be redeemed in
+	ExpiresIn int `json:"expiresIn,omitempty"`
 }
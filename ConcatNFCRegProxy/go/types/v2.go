@@ -0,0 +1,125 @@
+package types
+
+// Error codes of the v2 API, in ErrorV2.Code
+const (
+	ERR_INVALID_REQUEST      = "invalid_request"
+	ERR_UNAUTHORIZED         = "unauthorized"
+	ERR_FORBIDDEN            = "forbidden"
+	ERR_NOT_CONFIGURED       = "not_configured"
+	ERR_CARD_NOT_READY       = "card_not_ready"
+	ERR_CARD_MISMATCH        = "card_mismatch"
+	ERR_CARD_AUTH            = "card_auth_failed"
+	ERR_CARD_UNREADABLE      = "card_unreadable"
+	ERR_PASSWORD_UNAVAILABLE = "password_unavailable"
+	ERR_INVALID_SIGNATURE    = "invalid_signature"
+	ERR_INTERNAL             = "internal"
+)
+
+// ResponseV2 is the envelope of every v2 response. Data is set on success,
+// Error otherwise.
+type ResponseV2 struct {
+	Success bool     `json:"success"`
+	Data    any      `json:"data,omitempty"`
+	Error   *ErrorV2 `json:"error,omitempty"`
+}
+
+type ErrorV2 struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// Fields lists the invalid request fields, by JSON path
+	Fields []FieldError `json:"fields,omitempty"`
+}
+
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// CardV2 is the card definition of the v2 API. Optional fields are pointers:
+// zero is a value, a missing or null field is a tag absent from the card.
+// Times are RFC 3339 strings, written to the card with a one second resolution.
+type CardV2 struct {
+	AttendeeId     *uint32       `json:"attendeeId,omitempty"`
+	ConventionId   *uint32       `json:"conventionId,omitempty"`
+	Issuance       *uint64       `json:"issuance,omitempty"`
+	IssuedAt       *string       `json:"issuedAt,omitempty"`
+	ExpiresAt      *string       `json:"expiresAt,omitempty"`
+	BadgeName      *string       `json:"badgeName,omitempty"`
+	Tier           *string       `json:"tier,omitempty"`
+	Pronouns       *string       `json:"pronouns,omitempty"`
+	Entitlements   *Entitlements `json:"entitlements,omitempty"`
+	PayloadVersion *uint32       `json:"payloadVersion,omitempty"`
+	SignatureAlg   *uint32       `json:"signatureAlg,omitempty"`
+	KeyId          *string       `json:"keyId,omitempty"`
+	// Signature is base64 encoded in JSON
+	Signature   []byte         `json:"signature,omitempty"`
+	Custom      map[string]any `json:"custom,omitempty"`
+	UnknownTags []RawTag       `json:"unknownTags,omitempty"`
+}
+
+// CardRequestV2 selects the card on the reader. Password is required to
+// write unless a password provider is configured, which also resolves it for
+// reads without one. Reads otherwise try the factory default.
+type CardRequestV2 struct {
+	UUID     string  `json:"uuid"`
+	Password *uint32 `json:"password,omitempty"`
+}
+
+type ReadRequestV2 struct {
+	CardRequestV2
+	// Verify adds signatureValid to the result
+	Verify bool `json:"verify,omitempty"`
+}
+
+type WriteRequestV2 struct {
+	CardRequestV2
+	Card CardV2 `json:"card"`
+}
+
+// CardDefinitionV2 is a card that is not on the reader, for /v2/verify and
+// /v2/canonical. UUID is needed for UID-bound payloads.
+type CardDefinitionV2 struct {
+	UUID string `json:"uuid,omitempty"`
+	Card CardV2 `json:"card"`
+}
+
+type UUIDResultV2 struct {
+	UUID string `json:"uuid"`
+}
+
+type NDEFResultV2 struct {
+	UUID string `json:"uuid"`
+	// NDEF is nil when the card has no capability container
+	NDEF *NDEF `json:"ndef"`
+}
+
+type ReadResultV2 struct {
+	UUID string `json:"uuid"`
+	// Card is nil when the card is empty
+	Card           *CardV2 `json:"card"`
+	OlderFormat    bool    `json:"olderFormat"`
+	Encrypted      bool    `json:"encrypted,omitempty"`
+	SignatureValid *bool   `json:"signatureValid,omitempty"`
+	// SignatureError tells why the signature could not be checked
+	SignatureError string `json:"signatureError,omitempty"`
+	NDEF           *NDEF  `json:"ndef,omitempty"`
+}
+
+type WriteResultV2 struct {
+	UUID   string  `json:"uuid"`
+	Before *CardV2 `json:"before,omitempty"`
+	After  CardV2  `json:"after"`
+	// Signature and KeyId are set when the proxy signed the card itself
+	Signature []byte `json:"signature,omitempty"`
+	KeyId     string `json:"keyId,omitempty"`
+}
+
+type VerifyResultV2 struct {
+	SignatureValid bool   `json:"signatureValid"`
+	SignatureError string `json:"signatureError,omitempty"`
+	Payload        string `json:"payload"`
+}
+
+type CanonicalResultV2 struct {
+	Payload string `json:"payload"`
+}
@@ -80,6 +80,8 @@ dependencies {
     
     // Testing
     testImplementation(libs.junit)
+    // org.json is only stubbed in local unit tests
+    testImplementation("org.json:json:20231013")
     androidTestImplementation(libs.androidx.junit)
     androidTestImplementation(libs.androidx.espresso.core)
     androidTestImplementation(platform(libs.androidx.compose.bom))
@@ -63,6 +63,7 @@ class MainActivity : ComponentActivity(), NfcAdapter.ReaderCallback {
 
 
     private val validationState = mutableStateOf<Boolean?>(null)
+    private val holderState = mutableStateOf<List<String>>(emptyList())
     private val waitCardState = mutableStateOf<Boolean?>(null)
     private val isLoggedIn = mutableStateOf(false)
 
@@ -127,7 +128,7 @@ class MainActivity : ComponentActivity(), NfcAdapter.ReaderCallback {
                         horizontalAlignment = Alignment.CenterHorizontally
                     ) {
                         when (validationState.value) {
-                            true -> ValidationResult(isValid = true)
+                            true -> ValidationResult(isValid = true, holder = holderState.value)
                             false -> ValidationResult(isValid = false)
                             null -> {
                                 if (waitCardState.value == true){
@@ -255,7 +256,16 @@ class MainActivity : ComponentActivity(), NfcAdapter.ReaderCallback {
                 Toast.makeText(this, "Tag is still locked.", Toast.LENGTH_LONG).show()
                 return
             }
-            val tags = nfc.readTags()
+            val tags: TagArray
+            try {
+                tags = nfc.readTags()
+            } catch (e: Exception) {
+                showValidationResult(false)
+                soundPool.play(failId, 1f, 1f, 0, 0, 1f)
+                Log.d("NFC", "Cannot read tags: ${e.message}")
+                Toast.makeText(this, e.message, Toast.LENGTH_LONG).show()
+                return
+            }
 
             val attendeeAndConvention = tags.getTag(TagId.ATTENDEE_CONVENTION_ID)
             val signatureTag = tags.getTag(TagId.SIGNATURE)
@@ -277,27 +287,28 @@ class MainActivity : ComponentActivity(), NfcAdapter.ReaderCallback {
                 Toast.makeText(this, e.message, Toast.LENGTH_LONG).show()
                 return
             }
-            val tagsJson = tags.toJSON()
-            val jsonKeys = tagsJson.keys()
-            val map = mutableMapOf<String, Any>()
-
-            for (key in jsonKeys) {
-                map[key] = tagsJson.get(key)
-            }
-            val sortedMap = map.toSortedMap()
-            var sortedJSONString = "{"
-            for ((key, value) in sortedMap) {
-                when (key) {
-                    "signature" -> continue
-                    "timestamp" -> sortedJSONString += "\"$key\":\"$value\","
-                    else -> sortedJSONString += "\"$key\":$value,"
-                }
+            val sortedJSONString: String
+            try {
+                sortedJSONString = tags.toSigningPayload(uid.joinToString("") { "%02x".format(it) })
+            } catch (e: Exception) {
+                showValidationResult(false)
+                soundPool.play(failId, 1f, 1f, 0, 0, 1f)
+                Log.d("NFC", "Cannot build signed payload: ${e.message}")
+                Toast.makeText(this, e.message, Toast.LENGTH_LONG).show()
+                return
             }
-            sortedJSONString = sortedJSONString.dropLast(1)
-            sortedJSONString += "}"
 
             Log.d("NFC", "Sorted JSON String: $sortedJSONString")
 
+            val keyId = tags.getKeyId()
+            if (keyId != null && nfcPublicKey.kid != null && keyId != nfcPublicKey.kid) {
+                showValidationResult(false)
+                soundPool.play(failId, 1f, 1f, 0, 0, 1f)
+                Log.d("NFC", "Badge signed with key $keyId, expected ${nfcPublicKey.kid}")
+                Toast.makeText(this, "Badge signed with unknown key $keyId", Toast.LENGTH_LONG).show()
+                return
+            }
+
             val algorithmParameters = AlgorithmParameters.getInstance("EC")
             val curveName = when (nfcPublicKey.crv) {
                 "P-256" -> "secp256r1" // P-256 is also known as secp256r1
@@ -323,10 +334,26 @@ class MainActivity : ComponentActivity(), NfcAdapter.ReaderCallback {
             signatureValidator.initVerify(ecPublicKey)
             signatureValidator.update(sortedJSONString.toByteArray())
 
-            val signatureBytes = signatureTag.getTagValueBytes().getOrElse { throw it }
+            val signatureBytes: ByteArray
+            try {
+                val rawSignature = signatureTag.getTagValueBytes().getOrElse { throw it }
+                signatureBytes = when (val alg = tags.getSignatureAlg()) {
+                    1 -> rawSignature
+                    2 -> rawEcdsaToDer(rawSignature)
+                    // Ed25519 needs API level 33, the backend key is P-256 anyway
+                    else -> throw IllegalArgumentException("Unsupported signature algorithm $alg")
+                }
+            } catch (e: Exception) {
+                showValidationResult(false)
+                soundPool.play(failId, 1f, 1f, 0, 0, 1f)
+                Log.d("NFC", "Cannot read signature: ${e.message}")
+                Toast.makeText(this, e.message, Toast.LENGTH_LONG).show()
+                return
+            }
 
             val isValid = signatureValidator.verify(signatureBytes)
 
+            holderState.value = listOfNotNull(tags.getBadgeName(), tags.getTier(), tags.getPronouns())
             showValidationResult(isValid)
             if (isValid) {
                 soundPool.play(successId, 1f, 1f, 0, 0, 1f)
@@ -449,7 +476,7 @@ fun Greeting(name: String, modifier: Modifier = Modifier) {
 }
 
 @Composable
-fun ValidationResult(isValid: Boolean, modifier: Modifier = Modifier) {
+fun ValidationResult(isValid: Boolean, modifier: Modifier = Modifier, holder: List<String> = emptyList()) {
     Column(
         modifier = modifier.fillMaxSize(),
         verticalArrangement = Arrangement.Center,
@@ -467,6 +494,13 @@ fun ValidationResult(isValid: Boolean, modifier: Modifier = Modifier) {
                 text = "Card is Valid",
                 style = MaterialTheme.typography.headlineMedium
             )
+            for (line in holder) {
+                Spacer(modifier = Modifier.height(8.dp))
+                Text(
+                    text = line,
+                    style = MaterialTheme.typography.titleLarge
+                )
+            }
         } else {
             Icon(
                 imageVector = Icons.Filled.Error,
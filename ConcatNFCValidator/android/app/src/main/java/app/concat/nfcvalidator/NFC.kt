@@ -4,18 +4,41 @@ import android.nfc.tech.MifareUltralight
 import android.util.SparseArray
 import java.nio.ByteBuffer
 import java.nio.ByteOrder
+import java.text.SimpleDateFormat
+import java.util.Date
+import java.util.Locale
+import java.util.TimeZone
+import java.util.zip.CRC32
 import org.json.JSONObject
 
 
 
 data class DoubleUint(val first: UInt, val second: UInt)
 
+// Bit n of days is firstDay + n days, bit n of zones is zone n. 0 means every day or every zone
+data class Entitlements(val firstDay: String?, val days: UInt, val zones: UInt) {
+    // Signed form: keys sorted, firstDay left out when empty
+    fun toCanonicalJSON(): String {
+        if (firstDay == null) {
+            return "{\"days\":$days,\"zones\":$zones}"
+        }
+        return "{\"days\":$days,\"firstDay\":\"$firstDay\",\"zones\":$zones}"
+    }
+}
+
 enum class TagId(val id: Byte) {
     ATTENDEE_CONVENTION_ID(0x01.toByte()),
     SIGNATURE(0x02.toByte()),
     ISSUANCE(0x03.toByte()),
     TIMESTAMP(0x04.toByte()),
-    EXPIRATION(0x05.toByte());
+    EXPIRATION(0x05.toByte()),
+    BADGE_NAME(0x06.toByte()),
+    TIER(0x07.toByte()),
+    PRONOUNS(0x08.toByte()),
+    ENTITLEMENTS(0x09.toByte()),
+    PAYLOAD_VERSION(0x0A.toByte()),
+    SIGNATURE_ALG(0x0B.toByte()),
+    KEY_ID(0x0C.toByte());
 
     companion object {
         fun fromId(id: Byte): TagId? {
@@ -109,6 +132,23 @@ class Tag(val id: Byte, val data: ByteArray) {
     fun getTagValueBytes(): Result<ByteArray> {
         return runCatching { data }
     }
+    fun getTagValueEntitlements(): Result<Entitlements> {
+        return runCatching {
+            require(data.size == 8) { "Entitlements tag is not 8 bytes long" }
+            val firstDay = ((data[0].toUInt() and 0xFFu) shl 8) or (data[1].toUInt() and 0xFFu)
+            val days = ((data[2].toUInt() and 0xFFu) shl 8) or (data[3].toUInt() and 0xFFu)
+            val zones = data.copyOfRange(4, 8).toUIntBe()
+            val format = SimpleDateFormat("yyyy-MM-dd", Locale.US)
+            format.timeZone = TimeZone.getTimeZone("UTC")
+            val day = if (firstDay != 0u || days != 0u) format.format(Date(firstDay.toLong() * 86400000L)) else null
+            Entitlements(day, days, zones)
+        }
+    }
+    fun getTagValueString(): Result<String> {
+        return runCatching {
+            Charsets.UTF_8.newDecoder().decode(ByteBuffer.wrap(data)).toString()
+        }
+    }
 }
 
 class TagArray {
@@ -176,6 +216,79 @@ class TagArray {
         return tag.getTagValueULong()
     }
 
+    fun getBadgeName(): String? {
+        return getTag(TagId.BADGE_NAME)?.getTagValueString()?.getOrNull()
+    }
+
+    fun getTier(): String? {
+        return getTag(TagId.TIER)?.getTagValueString()?.getOrNull()
+    }
+
+    fun getPronouns(): String? {
+        return getTag(TagId.PRONOUNS)?.getTagValueString()?.getOrNull()
+    }
+
+    fun getPayloadVersion(): Int {
+        val tag = getTag(TagId.PAYLOAD_VERSION) ?: return 1
+        require(tag.data.size == 1) { "Payload version tag is not 1 byte long" }
+        return tag.data[0].toInt() and 0xFF
+    }
+
+    // 1 DER ECDSA P-256 (also when the tag is missing), 2 raw r||s ECDSA P-256, 3 Ed25519
+    fun getSignatureAlg(): Int {
+        val tag = getTag(TagId.SIGNATURE_ALG) ?: return 1
+        require(tag.data.size == 1) { "Signature algorithm tag is not 1 byte long" }
+        return tag.data[0].toInt() and 0xFF
+    }
+
+    // The kid of the signing key in the JWKS, null when the card does not name one
+    fun getKeyId(): String? {
+        return getTag(TagId.KEY_ID)?.getTagValueString()?.getOrNull()
+    }
+
+    // The text the signature covers: the known tags as JSON with sorted keys and no
+    // whitespace, without the signature. The timestamp is quoted. Version 2 adds the
+    // card UID as lower case hex, so copied tags do not verify on another card. Every
+    // signer and validator has to produce the same bytes, see testvectors/signing-payload.json.
+    fun toSigningPayload(uid: String): String {
+        val values = sortedMapOf<String, String>()
+        when (val version = getPayloadVersion()) {
+            1 -> {}
+            2 -> {
+                require(uid.matches(Regex("^([0-9a-fA-F]{2})+$"))) { "Invalid card UID" }
+                values["payloadVersion"] = version.toString()
+                values["uid"] = "\"${uid.lowercase()}\""
+            }
+            else -> throw IllegalArgumentException("Unsupported payload version $version")
+        }
+        for (tag in tags) {
+            when (TagId.fromId(tag.id)) {
+                TagId.ATTENDEE_CONVENTION_ID -> {
+                    val attendeeAndConvention = tag.getTagValueDualUInt().getOrElse { throw it }
+                    values["userId"] = attendeeAndConvention.first.toString()
+                    values["conventionId"] = attendeeAndConvention.second.toString()
+                }
+                TagId.ISSUANCE -> values["issuanceCount"] = tag.getTagValueULong().getOrElse { throw it }.toString()
+                TagId.TIMESTAMP -> values["timestamp"] = "\"${tag.getTagValueULong().getOrElse { throw it }}\""
+                TagId.EXPIRATION -> values["expiration"] = tag.getTagValueULong().getOrElse { throw it }.toString()
+                TagId.BADGE_NAME -> values["badgeName"] = quoteText(tag.getTagValueString().getOrElse { throw it })
+                TagId.TIER -> values["tier"] = quoteText(tag.getTagValueString().getOrElse { throw it })
+                TagId.PRONOUNS -> values["pronouns"] = quoteText(tag.getTagValueString().getOrElse { throw it })
+                TagId.ENTITLEMENTS -> values["entitlements"] = tag.getTagValueEntitlements().getOrElse { throw it }.toCanonicalJSON()
+                TagId.SIGNATURE_ALG -> values["signatureAlg"] = getSignatureAlg().toString()
+                TagId.KEY_ID -> values["keyId"] = quoteText(tag.getTagValueString().getOrElse { throw it })
+                else -> {}
+            }
+        }
+        return values.entries.joinToString(",", "{", "}") { "\"${it.key}\":${it.value}" }
+    }
+
+    // Text tags cannot hold control characters, so only quotes and backslashes
+    // need escaping. Anything more would change the signed bytes.
+    private fun quoteText(value: String): String {
+        return "\"" + value.replace("\\", "\\\\").replace("\"", "\\\"") + "\""
+    }
+
     fun toJSON(): JSONObject {
         val json = JSONObject()
         for (tag in tags) {
@@ -204,6 +317,18 @@ class TagArray {
                 TagId.EXPIRATION -> json.put("expiration", tag.getTagValueULong()
                     .getOrElse { throw it }
                 )
+                TagId.BADGE_NAME -> json.put("badgeName", tag.getTagValueString()
+                    .getOrElse { throw it }
+                )
+                TagId.TIER -> json.put("tier", tag.getTagValueString()
+                    .getOrElse { throw it }
+                )
+                TagId.PRONOUNS -> json.put("pronouns", tag.getTagValueString()
+                    .getOrElse { throw it }
+                )
+                TagId.ENTITLEMENTS -> json.put("entitlements", tag.getTagValueEntitlements()
+                    .getOrElse { throw it }
+                )
                 else -> {}
             }
         }
@@ -282,18 +407,65 @@ class NFC constructor(val mifare: MifareUltralight) {
         return data
     }
 
+    // Cards written with a header start with "CC", version, payload length
+    // and CRC32. Older cards start directly with the first tag.
     fun readTags(): TagArray {
         val tags = TagArray()
-        while (true) {
+        val first = readByte()
+        if (first != 'C'.code.toByte()) {
+            bytePosition = 0
+            return readTagList(tags, Int.MAX_VALUE)
+        }
+        if (readByte() != 'C'.code.toByte()) {
+            throw Exception("Not a ConCat badge")
+        }
+        val header = readBytes(7)
+        val version = header[0].toInt() and 0xFF
+        if (version != 1) {
+            throw Exception("Unsupported badge format version $version")
+        }
+        val length = ((header[1].toInt() and 0xFF) shl 8) or (header[2].toInt() and 0xFF)
+        val expectedCrc = header.copyOfRange(3, 7).toUIntBe().toLong()
+        val payloadStart = bytePosition
+        val payload = readBytes(length)
+        val crc = CRC32()
+        crc.update(payload)
+        if (crc.value != expectedCrc) {
+            throw Exception("Corrupt ConCat badge")
+        }
+        bytePosition = payloadStart
+        return readTagList(tags, payloadStart + length)
+    }
+
+    private fun readTagList(tags: TagArray, end: Int): TagArray {
+        while (bytePosition < end) {
             val tag = readByte()
             if (tag == 0x0.toByte()) {
                 break
             }
-            val length = readByte()
-            val data = readBytes(length.toInt())
+            // 0xFF escapes a big endian uint16 length for values of 255 bytes or more
+            var length = readByte().toInt() and 0xFF
+            if (length == 0xFF) {
+                length = ((readByte().toInt() and 0xFF) shl 8) or (readByte().toInt() and 0xFF)
+            }
+            val data = readBytes(length)
             tags.addTag(Tag(tag, data))
         }
         return tags
     }
 }
 
+// Converts a 64 byte r||s ECDSA P-256 signature to the ASN.1 DER form
+// java.security.Signature expects
+fun rawEcdsaToDer(raw: ByteArray): ByteArray {
+    require(raw.size == 64) { "Raw ECDSA signature is not 64 bytes long" }
+    fun derInteger(value: ByteArray): ByteArray {
+        var start = 0
+        while (start < value.size - 1 && value[start] == 0.toByte()) start++
+        var bytes = value.copyOfRange(start, value.size)
+        if (bytes[0].toInt() and 0x80 != 0) bytes = byteArrayOf(0) + bytes
+        return byteArrayOf(0x02, bytes.size.toByte()) + bytes
+    }
+    val body = derInteger(raw.copyOfRange(0, 32)) + derInteger(raw.copyOfRange(32, 64))
+    return byteArrayOf(0x30, body.size.toByte()) + body
+}
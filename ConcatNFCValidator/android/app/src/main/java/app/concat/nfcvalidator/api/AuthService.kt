@@ -14,6 +14,7 @@ class JWK(
     val x: String,
     val y: String,
     val crv: String,
+    val kid: String? = null,
 ) {
     fun toJSONString(): String {
         return """{"kty":"$kty","x":"$x","y":"$y","crv":"$crv"}"""
@@ -0,0 +1,80 @@
+package app.concat.nfcvalidator
+
+import org.json.JSONObject
+import org.junit.Assert.assertEquals
+import org.junit.Assert.assertTrue
+import org.junit.Test
+import java.io.File
+import java.math.BigInteger
+import java.security.AlgorithmParameters
+import java.security.KeyFactory
+import java.security.Signature
+import java.security.spec.ECGenParameterSpec
+import java.security.spec.ECParameterSpec
+import java.security.spec.ECPoint
+import java.security.spec.ECPublicKeySpec
+import java.util.Base64
+
+/**
+ * Checks the signed payload against the golden vectors shared with the proxy
+ * and the ESP32. Gradle runs unit tests from the app module directory.
+ */
+class SigningPayloadTest {
+    private val vectors = JSONObject(File("../../../testvectors/signing-payload.json").readText())
+
+    private fun hexToBytes(hex: String): ByteArray {
+        return ByteArray(hex.length / 2) { hex.substring(it * 2, it * 2 + 2).toInt(16).toByte() }
+    }
+
+    @Test
+    fun signingPayload_matchesVectors() {
+        val list = vectors.getJSONArray("vectors")
+        assertTrue(list.length() > 0)
+        for (i in 0 until list.length()) {
+            val vector = list.getJSONObject(i)
+            val tags = TagArray()
+            val tagList = vector.getJSONArray("tags")
+            for (j in 0 until tagList.length()) {
+                val tag = tagList.getJSONObject(j)
+                tags.addTag(Tag(tag.getInt("id").toByte(), hexToBytes(tag.getString("data"))))
+            }
+            val uid = vector.optString("uid", "")
+            assertEquals(vector.getString("name"), vector.getString("payload"), tags.toSigningPayload(uid))
+        }
+    }
+
+    @Test
+    fun signature_verifiesVectors() {
+        val jwk = vectors.getJSONObject("publicKey")
+        val parameters = AlgorithmParameters.getInstance("EC")
+        parameters.init(ECGenParameterSpec("secp256r1"))
+        val point = ECPoint(
+            BigInteger(1, Base64.getUrlDecoder().decode(jwk.getString("x"))),
+            BigInteger(1, Base64.getUrlDecoder().decode(jwk.getString("y")))
+        )
+        val publicKey = KeyFactory.getInstance("EC")
+            .generatePublic(ECPublicKeySpec(point, parameters.getParameterSpec(ECParameterSpec::class.java)))
+
+        val list = vectors.getJSONArray("vectors")
+        for (i in 0 until list.length()) {
+            val vector = list.getJSONObject(i)
+            val tagList = vector.getJSONArray("tags")
+            var signature = ByteArray(0)
+            var alg = 1
+            for (j in 0 until tagList.length()) {
+                val tag = tagList.getJSONObject(j)
+                when (tag.getInt("id")) {
+                    TagId.SIGNATURE.id.toInt() -> signature = hexToBytes(tag.getString("data"))
+                    TagId.SIGNATURE_ALG.id.toInt() -> alg = hexToBytes(tag.getString("data"))[0].toInt()
+                }
+            }
+            // The app only verifies P-256 signatures, Ed25519 vectors are covered by the payload test
+            if (alg == 3) continue
+            if (alg == 2) signature = rawEcdsaToDer(signature)
+            val verifier = Signature.getInstance("SHA256withECDSA")
+            verifier.initVerify(publicKey)
+            verifier.update(vector.getString("payload").toByteArray())
+            assertTrue(vector.getString("name"), verifier.verify(signature))
+        }
+    }
+}